@@ -0,0 +1,300 @@
+// go-my-index/charset/charset.go
+package charset
+
+import (
+	"bytes"
+	"fmt"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	xunicode "golang.org/x/text/encoding/unicode"
+)
+
+// 検出できる文字コードの名前です。Document.Encodingに記録されます。
+const (
+	UTF8     = "UTF-8"
+	UTF16LE  = "UTF-16LE"
+	UTF16BE  = "UTF-16BE"
+	ShiftJIS = "Shift_JIS"
+	EUCJP    = "EUC-JP"
+	Latin1   = "windows-1252" // ISO-8859-1の上位互換として扱う
+)
+
+const (
+	sniffLen               = 64 * 1024 // 判定に使う先頭のバイト数
+	maxInvalidUTF8Fraction = 0.01      // 多少の壊れたバイトはUTF-8として許容する
+	maxLatin1Control       = 0.05      // 制御文字がこれより多ければLatin-1とはみなさない
+	maxLatin1HighBytes     = 0.3       // 0x80以上のバイトがこれより多ければLatin-1のテキストとはみなさない
+	maxUTF16Invalid        = 0.05      // BOMのあるUTF-16として読めない文字がこれより多ければBOMを信用しない
+	minUTF16ZeroFraction   = 0.3       // BOMのないUTF-16とみなすNULバイトの割合
+)
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// Detect はバイト列の文字コードを推定します。
+// BOM、BOMのないUTF-16、UTF-8、Shift_JIS、EUC-JP、Latin-1の順に判定し、
+// どれにも当てはまらない場合(バイナリなど)は空文字を返します。
+// UTF-16のBOMは偶然FF FEやFE FFで始まるバイナリもあるため、続く内容がUTF-16のテキストとして読める場合だけ信用します。
+func Detect(b []byte) string {
+	sample := b
+	truncated := len(sample) > sniffLen
+	if truncated {
+		sample = sample[:sniffLen]
+	}
+
+	switch {
+	case bytes.HasPrefix(b, bomUTF8):
+		return UTF8
+	case bytes.HasPrefix(b, bomUTF16LE) && looksUTF16(sample[2:], false, truncated):
+		return UTF16LE
+	case bytes.HasPrefix(b, bomUTF16BE) && looksUTF16(sample[2:], true, truncated):
+		return UTF16BE
+	}
+
+	if enc := detectUTF16(sample); enc != "" {
+		return enc
+	}
+
+	invalid := invalidUTF8(sample, truncated)
+	if invalid == 0 {
+		return UTF8
+	}
+
+	sjisErrors, sjisHits := scoreShiftJIS(sample, truncated)
+	eucErrors, eucHits := scoreEUCJP(sample, truncated)
+	switch {
+	case sjisErrors == 0 && eucErrors == 0:
+		if eucHits > sjisHits {
+			return EUCJP
+		}
+		return ShiftJIS
+	case sjisErrors == 0:
+		return ShiftJIS
+	case eucErrors == 0:
+		return EUCJP
+	}
+
+	if float64(invalid)/float64(len(sample)) <= maxInvalidUTF8Fraction {
+		return UTF8
+	}
+	if looksLatin1(sample) {
+		return Latin1
+	}
+	return ""
+}
+
+// InvalidUTF8Fraction はバイト列に含まれる不正なUTF-8バイトの割合を返します。
+func InvalidUTF8Fraction(b []byte) float64 {
+	sample := b
+	truncated := len(sample) > sniffLen
+	if truncated {
+		sample = sample[:sniffLen]
+	}
+	if len(sample) == 0 {
+		return 0
+	}
+	return float64(invalidUTF8(sample, truncated)) / float64(len(sample))
+}
+
+// Decode はnameの文字コードとして解釈したバイト列をUTF-8の文字列に変換します。
+// 先頭のBOMは取り除かれます。nameが空の場合はUTF-8として扱います。
+func Decode(b []byte, name string) (string, error) {
+	var enc encoding.Encoding
+	switch name {
+	case "", UTF8:
+		return string(bytes.TrimPrefix(b, bomUTF8)), nil
+	case UTF16LE:
+		enc = xunicode.UTF16(xunicode.LittleEndian, xunicode.UseBOM)
+	case UTF16BE:
+		enc = xunicode.UTF16(xunicode.BigEndian, xunicode.UseBOM)
+	case ShiftJIS:
+		enc = japanese.ShiftJIS
+	case EUCJP:
+		enc = japanese.EUCJP
+	case Latin1:
+		enc = charmap.Windows1252
+	default:
+		return "", fmt.Errorf("unsupported encoding %q", name)
+	}
+	decoded, err := enc.NewDecoder().Bytes(b)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode %s: %w", name, err)
+	}
+	return string(decoded), nil
+}
+
+// invalidUTF8 は不正なUTF-8のバイト数を数えます。
+// truncatedの場合、末尾で途切れたマルチバイト文字は数えません。
+func invalidUTF8(b []byte, truncated bool) int {
+	invalid := 0
+	for i := 0; i < len(b); {
+		r, size := utf8.DecodeRune(b[i:])
+		if r == utf8.RuneError && size == 1 {
+			if truncated && !utf8.FullRune(b[i:]) {
+				break
+			}
+			invalid++
+		}
+		i += size
+	}
+	return invalid
+}
+
+// looksUTF16 はBOMの後のバイト列がUTF-16のテキストとして読めるかを返します。
+// 対になっていないサロゲート、U+FFFD、制御文字、未割り当てや私用の文字が多ければ、テキストではないとみなします。
+// truncatedの場合、末尾で途切れた文字は数えません。
+func looksUTF16(b []byte, bigEndian, truncated bool) bool {
+	units := make([]uint16, len(b)/2)
+	for i := range units {
+		if bigEndian {
+			units[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		} else {
+			units[i] = uint16(b[2*i+1])<<8 | uint16(b[2*i])
+		}
+	}
+	invalid := 0
+	if len(b)%2 != 0 && !truncated {
+		invalid++ // 奇数長のUTF-16はない
+	}
+	for i := 0; i < len(units); i++ {
+		r := rune(units[i])
+		if utf16.IsSurrogate(r) {
+			if i+1 < len(units) {
+				if pair := utf16.DecodeRune(r, rune(units[i+1])); pair != utf8.RuneError {
+					r = pair
+					i++
+				}
+			} else if truncated {
+				break
+			}
+		}
+		if r == utf8.RuneError || utf16.IsSurrogate(r) || (!unicode.IsGraphic(r) && !unicode.IsSpace(r)) {
+			invalid++
+		}
+	}
+	if len(units) == 0 {
+		return invalid == 0
+	}
+	return float64(invalid)/float64(len(units)) <= maxUTF16Invalid
+}
+
+// detectUTF16 はBOMのないUTF-16を、ASCII文字の上位(下位)バイトに現れるNULの偏りから推定します。
+func detectUTF16(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	var evenZeros, oddZeros int
+	for i, c := range b {
+		if c != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenZeros++
+		} else {
+			oddZeros++
+		}
+	}
+	half := float64(len(b) / 2)
+	switch {
+	case float64(oddZeros)/half >= minUTF16ZeroFraction && evenZeros == 0:
+		return UTF16LE
+	case float64(evenZeros)/half >= minUTF16ZeroFraction && oddZeros == 0:
+		return UTF16BE
+	}
+	return ""
+}
+
+// scoreShiftJIS はShift_JISとして不正なバイト列の数と、ひらがな・カタカナらしい文字の数を返します。
+func scoreShiftJIS(b []byte, truncated bool) (errors int, hits int) {
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		switch {
+		case c < 0x80 || (c >= 0xA1 && c <= 0xDF): // ASCII、半角カナ
+		case (c >= 0x81 && c <= 0x9F) || (c >= 0xE0 && c <= 0xFC):
+			if i+1 >= len(b) {
+				if !truncated {
+					errors++
+				}
+				continue
+			}
+			t := b[i+1]
+			if t < 0x40 || t == 0x7F || t > 0xFC {
+				errors++
+				continue
+			}
+			if c == 0x82 || c == 0x83 {
+				hits++
+			}
+			i++
+		default:
+			errors++
+		}
+	}
+	return errors, hits
+}
+
+// scoreEUCJP はEUC-JPとして不正なバイト列の数と、ひらがな・カタカナらしい文字の数を返します。
+func scoreEUCJP(b []byte, truncated bool) (errors int, hits int) {
+	isEUCByte := func(c byte) bool { return c >= 0xA1 && c <= 0xFE }
+	for i := 0; i < len(b); i++ {
+		c := b[i]
+		need := 0
+		switch {
+		case c < 0x80:
+			continue
+		case c == 0x8E: // 半角カナ
+			need = 1
+		case c == 0x8F: // 補助漢字
+			need = 2
+		case isEUCByte(c):
+			need = 1
+		default:
+			errors++
+			continue
+		}
+		if i+need >= len(b) {
+			if !truncated {
+				errors++
+			}
+			break
+		}
+		valid := true
+		for j := 1; j <= need; j++ {
+			if !isEUCByte(b[i+j]) {
+				valid = false
+			}
+		}
+		if !valid {
+			errors++
+			continue
+		}
+		if c == 0xA4 || c == 0xA5 {
+			hits++
+		}
+		i += need
+	}
+	return errors, hits
+}
+
+// looksLatin1 は制御文字が少なく、1バイト文字コードのテキストとして読めそうかを返します。
+// Latin-1のテキストは大部分がASCIIなので、0x80以上のバイトばかりのものもテキストとはみなしません。
+func looksLatin1(b []byte) bool {
+	controls, high := 0, 0
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' && c != '\f' {
+			controls++
+		}
+		if c >= 0x80 {
+			high++
+		}
+	}
+	return float64(controls)/float64(len(b)) <= maxLatin1Control && float64(high)/float64(len(b)) <= maxLatin1HighBytes
+}
@@ -0,0 +1,61 @@
+package charset
+
+import (
+	"testing"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func TestDetectAndDecode(t *testing.T) {
+	const japaneseText = "これは古い日本語のドキュメントです。検索 index に登録します。"
+	tests := []struct {
+		name string
+		enc  encoding.Encoding
+		text string
+		want string
+	}{
+		{"utf8", encoding.Nop, japaneseText, UTF8},
+		{"shift_jis", japanese.ShiftJIS, japaneseText, ShiftJIS},
+		{"euc-jp", japanese.EUCJP, japaneseText, EUCJP},
+		{"utf16le bom", unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), japaneseText, UTF16LE},
+		{"utf16be no bom", unicode.UTF16(unicode.BigEndian, unicode.IgnoreBOM), "plain ascii text in utf-16", UTF16BE},
+		{"latin1", charmap.Windows1252, "Café crème à la carte, déjà vu", Latin1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := tt.enc.NewEncoder().Bytes([]byte(tt.text))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := Detect(raw)
+			if got != tt.want {
+				t.Fatalf("Detect() = %q, want %q", got, tt.want)
+			}
+			decoded, err := Decode(raw, got)
+			if err != nil || decoded != tt.text {
+				t.Errorf("Decode() = %q, %v; want %q", decoded, err, tt.text)
+			}
+		})
+	}
+}
+
+func TestDetectBinary(t *testing.T) {
+	raw := []byte{0x7f, 0x45, 0x4c, 0x46, 0x02, 0x01, 0x01, 0x00, 0x00, 0x03, 0x00, 0x3e, 0x00, 0x01, 0x00, 0x00, 0xe0, 0x12, 0x90, 0x01}
+	if got := Detect(raw); got != "" {
+		t.Errorf("Detect(binary) = %q, want empty", got)
+	}
+}
+
+func TestDetectRejectsBinaryWithUTF16BOM(t *testing.T) {
+	for _, raw := range [][]byte{
+		{0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0xfa},
+		{0xfe, 0xff, 0x00, 0x01, 0x00, 0x02, 0xd8, 0x00, 0x00, 0x03, 0xff, 0xfd},
+	} {
+		if got := Detect(raw); got != "" {
+			t.Errorf("Detect(% x) = %q, want empty", raw, got)
+		}
+	}
+}
@@ -1,3 +1,10 @@
 module gmi
 
 go 1.24.2
+
+require (
+	golang.org/x/term v0.40.0
+	golang.org/x/text v0.34.0
+)
+
+require golang.org/x/sys v0.41.0 // indirect
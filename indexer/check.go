@@ -0,0 +1,154 @@
+package indexer
+
+import (
+	"fmt"
+	"os"
+	"sort"
+)
+
+// インデックスの検査で見つかる問題の種類です。
+const (
+	ProblemDanglingPosting  = "dangling-posting"  // ポスティングのDocIDがDocsに存在しない
+	ProblemPostingOrder     = "posting-order"     // ポスティングがDocIDの昇順に並んでいない
+	ProblemDuplicatePosting = "duplicate-posting" // 同じ単語に同じDocIDのポスティングが複数ある
+	ProblemFrequency        = "frequency"         // FrequencyがPositionsの数と一致しない
+	ProblemPositionOrder    = "position-order"    // Positionsが昇順に並んでいない
+	ProblemPositionRange    = "position-range"    // PositionsがドキュメントのTotalWordsの範囲外
+	ProblemNextDocID        = "next-doc-id"       // NextDocIDが既存のドキュメントID以下
+	ProblemMissingFile      = "missing-file"      // ファイルのドキュメントがディスク上に存在しない
+)
+
+// Problem はインデックスの不整合1件です。
+type Problem struct {
+	Kind   string
+	Term   string // 問題のあるポスティングの単語 (ポスティング以外の問題では空)
+	DocID  int
+	Detail string
+}
+
+func (p Problem) String() string {
+	if p.Term != "" {
+		return fmt.Sprintf("%s: term %q, doc %d: %s", p.Kind, p.Term, p.DocID, p.Detail)
+	}
+	return fmt.Sprintf("%s: doc %d: %s", p.Kind, p.DocID, p.Detail)
+}
+
+// CheckOptions は検査の対象を指定します。
+type CheckOptions struct {
+	CheckFiles bool // ファイルのドキュメントがディスク上に存在するかも確認する
+}
+
+// CheckIndex はインデックスの不変条件を検査し、見つかった問題を返します。インデックスは変更しません。
+func CheckIndex(idx *InvertedIndex, opts CheckOptions) []Problem {
+	return checkIndex(idx, opts, false)
+}
+
+// RepairIndex はCheckIndexと同じ検査を行い、見つかった問題をその場で修復します。
+// 存在しないドキュメントを指すポスティングと範囲外の位置を持つポスティングは削除し、
+// 消えたファイルのドキュメントはポスティングごと削除します。並び順、Frequency、NextDocIDは直します。
+// 同じ単語に同じDocIDのポスティングが複数あれば、問題のない最初のものだけを残します。
+// 修復した問題を返します。
+func RepairIndex(idx *InvertedIndex, opts CheckOptions) []Problem {
+	return checkIndex(idx, opts, true)
+}
+
+func checkIndex(idx *InvertedIndex, opts CheckOptions, repair bool) []Problem {
+	var problems []Problem
+
+	ids := make([]int, 0, len(idx.Docs))
+	for id := range idx.Docs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	if opts.CheckFiles {
+		stale := make(map[int]bool)
+		for _, id := range ids {
+			doc := idx.Docs[id]
+			if !doc.IsFile() {
+				continue
+			}
+			if _, err := os.Stat(doc.Path); os.IsNotExist(err) {
+				problems = append(problems, Problem{Kind: ProblemMissingFile, DocID: id, Detail: fmt.Sprintf("file %s no longer exists", doc.Path)})
+				stale[id] = true
+			}
+		}
+		if repair {
+			for id := range stale {
+				idx.forgetDocument(idx.Docs[id])
+			}
+			idx.removePostings(stale)
+		}
+	}
+
+	if len(ids) > 0 && idx.NextDocID <= ids[len(ids)-1] {
+		problems = append(problems, Problem{Kind: ProblemNextDocID, DocID: ids[len(ids)-1],
+			Detail: fmt.Sprintf("NextDocID %d does not exceed the largest document ID", idx.NextDocID)})
+		if repair {
+			idx.NextDocID = ids[len(ids)-1] + 1
+		}
+	}
+
+	terms := make([]string, 0, len(idx.Index))
+	for term := range idx.Index {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	for _, term := range terms {
+		postings := idx.Index[term]
+		kept := make([]Posting, 0, len(postings)) // 検査だけの場合に元のスライスを書き換えないよう別に確保する
+		seen := make(map[int]bool, len(postings))
+		for i, p := range postings {
+			if seen[p.DocID] {
+				problems = append(problems, Problem{Kind: ProblemDuplicatePosting, Term: term, DocID: p.DocID, Detail: "document has more than one posting"})
+				continue // 修復時は削除する
+			}
+			if i > 0 && postings[i-1].DocID > p.DocID {
+				problems = append(problems, Problem{Kind: ProblemPostingOrder, Term: term, DocID: p.DocID, Detail: "postings are not sorted by document ID"})
+			}
+			doc, ok := idx.Docs[p.DocID]
+			if !ok {
+				problems = append(problems, Problem{Kind: ProblemDanglingPosting, Term: term, DocID: p.DocID, Detail: "document does not exist"})
+				continue // 修復時は削除する
+			}
+			if p.Frequency != len(p.Positions) {
+				problems = append(problems, Problem{Kind: ProblemFrequency, Term: term, DocID: p.DocID,
+					Detail: fmt.Sprintf("frequency %d but %d positions", p.Frequency, len(p.Positions))})
+				p.Frequency = len(p.Positions)
+			}
+			if !sort.IntsAreSorted(p.Positions) {
+				problems = append(problems, Problem{Kind: ProblemPositionOrder, Term: term, DocID: p.DocID, Detail: "positions are not sorted"})
+				if repair {
+					p.Positions = append([]int(nil), p.Positions...)
+					sort.Ints(p.Positions)
+				}
+			}
+			if outOfRange(p.Positions, doc.TotalWords) {
+				problems = append(problems, Problem{Kind: ProblemPositionRange, Term: term, DocID: p.DocID,
+					Detail: fmt.Sprintf("positions %v exceed the document's %d words", p.Positions, doc.TotalWords)})
+				continue // 修復時は削除する
+			}
+			seen[p.DocID] = true
+			kept = append(kept, p)
+		}
+		if !repair {
+			continue
+		}
+		sort.Slice(kept, func(i, j int) bool { return kept[i].DocID < kept[j].DocID })
+		if len(kept) == 0 {
+			delete(idx.Index, term)
+		} else {
+			idx.Index[term] = kept
+		}
+	}
+	return problems
+}
+
+func outOfRange(positions []int, totalWords int) bool {
+	for _, pos := range positions {
+		if pos < 0 || pos >= totalWords {
+			return true
+		}
+	}
+	return false
+}
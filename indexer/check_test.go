@@ -0,0 +1,59 @@
+package indexer
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckAndRepairIndex(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "a.txt"), "go go index")
+	idx, err := BuildIndex([]string{dir}, nil, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := CheckIndex(idx, CheckOptions{CheckFiles: true}); len(problems) != 0 {
+		t.Fatalf("CheckIndex() on a fresh index = %v", problems)
+	}
+
+	idx.Docs[5] = Document{ID: 5, Path: filepath.Join(dir, "gone.txt"), TotalWords: 1}
+	idx.Index["go"] = append(idx.Index["go"], Posting{DocID: 9, Frequency: 1, Positions: []int{0}})
+	idx.Index["index"][0].Frequency = 3
+	idx.Index["stale"] = []Posting{{DocID: 0, Frequency: 1, Positions: []int{42}}}
+	idx.Index["index"] = append(idx.Index["index"], Posting{DocID: 0, Frequency: 1, Positions: []int{2}})
+
+	want := map[string]bool{
+		ProblemMissingFile: true, ProblemNextDocID: true, ProblemDanglingPosting: true,
+		ProblemFrequency: true, ProblemPositionRange: true, ProblemDuplicatePosting: true,
+	}
+	problems := CheckIndex(idx, CheckOptions{CheckFiles: true})
+	got := make(map[string]bool)
+	for _, p := range problems {
+		got[p.Kind] = true
+	}
+	for kind := range want {
+		if !got[kind] {
+			t.Errorf("CheckIndex() did not report %s: %v", kind, problems)
+		}
+	}
+	if len(idx.Index["go"]) != 2 || idx.Index["index"][0].Frequency != 3 {
+		t.Error("CheckIndex() modified the index")
+	}
+
+	repaired := RepairIndex(idx, CheckOptions{CheckFiles: true})
+	if len(repaired) != len(problems) {
+		t.Errorf("RepairIndex() repaired %d problems, want %d", len(repaired), len(problems))
+	}
+	if remaining := CheckIndex(idx, CheckOptions{CheckFiles: true}); len(remaining) != 0 {
+		t.Errorf("problems remain after RepairIndex(): %v", remaining)
+	}
+	if _, ok := idx.Docs[5]; ok {
+		t.Error("document of a missing file was not removed")
+	}
+	if _, ok := idx.Index["stale"]; ok {
+		t.Error("posting with out-of-range positions was not removed")
+	}
+	if idx.NextDocID <= 0 || len(idx.Index["go"]) != 1 || len(idx.Index["index"]) != 1 || idx.Index["index"][0].Frequency != 1 {
+		t.Errorf("index after repair: next %d, go %+v, index %+v", idx.NextDocID, idx.Index["go"], idx.Index["index"])
+	}
+}
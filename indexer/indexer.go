@@ -9,6 +9,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -17,92 +18,144 @@ import (
 // processFileResultはワーカーgoroutineからの処理結果を格納
 type processedFileResult struct {
 	filePath     string
+	root         string
+	encoding     string
 	tokens       []string
-	totalWords   int
+	offsets      []int  // tokensの各単語のバイトオフセット
+	text         string // StoreContentが有効な場合の本文
+	skipReason   string // 空でなければファイルをスキップした理由
 	lastModified time.Time
+	size         int64
 	err          error
 }
 
-func BuildIndex(rootDirPath string, oldIdx *InvertedIndex) (*InvertedIndex, error) {
-	fmt.Printf("%s Starting to build/update index for: %s\n", ui.Cyan("▶"), rootDirPath)
+// scannedFile は走査で見つかったファイルとその所属するルートディレクトリです。
+type scannedFile struct {
+	info fs.FileInfo
+	root string
+}
 
-	newIdx := NewInvertedIndex()
-	if oldIdx != nil && oldIdx.NextDocID > 0 {
-		newIdx.NextDocID = oldIdx.NextDocID
+// BuildIndex は1つ以上のルートディレクトリ配下のファイルからインデックスを構築・更新します。
+// oldIdxが与えられた場合はそれを直接更新し、変更・追加されたファイルだけを再処理します。
+// 削除の判定は今回走査したルート配下のドキュメントに限られ、他のルートのドキュメントは保持されます。
+// 大きすぎるファイルやバイナリファイルはスキップし、最後に理由とともに一覧を表示します。
+func BuildIndex(rootDirPaths []string, oldIdx *InvertedIndex, opts BuildOptions) (*InvertedIndex, error) {
+	roots := make([]string, 0, len(rootDirPaths))
+	for _, root := range rootDirPaths {
+		roots = append(roots, filepath.Clean(root))
 	}
+	fmt.Fprintf(os.Stderr, "%s Starting to build/update index for: %s\n", ui.Cyan("▶"), strings.Join(roots, ", "))
 
-	currentFileSystemFiles := make(map[string]fs.FileInfo) // path -> FileInfo
-	err := filepath.WalkDir(rootDirPath, func(path string, d fs.DirEntry, err error) error {
-		if err != nil {
-			fmt.Printf("%s accessing path %q during WalkDir: %v\n", ui.Yellow("Warning:"), path, err)
-			return err
-		}
-		lowerName := strings.ToLower(d.Name())
-		if !d.IsDir() && (strings.HasSuffix(lowerName, ".txt") || strings.HasSuffix(lowerName, ".md")) {
-			info, statErr := d.Info()
-			if statErr != nil {
-				fmt.Printf("%s getting FileInfo for %s: %v\n", ui.Yellow("Warning:"), path, statErr)
-				return nil
+	currentFileSystemFiles := make(map[string]scannedFile) // path -> FileInfo, root
+	var skipped []SkippedFile
+	skippedPaths := make(map[string]bool)
+	for _, root := range roots {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s accessing path %q during WalkDir: %v\n", ui.Yellow("Warning:"), path, err)
+				return err
 			}
-			currentFileSystemFiles[path] = info
+			lowerName := strings.ToLower(d.Name())
+			if !d.IsDir() && (strings.HasSuffix(lowerName, ".txt") || strings.HasSuffix(lowerName, ".md")) {
+				if _, seen := currentFileSystemFiles[path]; seen {
+					return nil // ルートが重なっている場合は先に指定されたルートに属させる
+				}
+				info, statErr := d.Info()
+				if statErr != nil {
+					fmt.Fprintf(os.Stderr, "%s getting FileInfo for %s: %v\n", ui.Yellow("Warning:"), path, statErr)
+					return nil
+				}
+				if opts.MaxFileSize > 0 && info.Size() > opts.MaxFileSize {
+					if !skippedPaths[path] {
+						skipped = append(skipped, SkippedFile{Path: path, Reason: fmt.Sprintf("file too large (%s > %s)", FormatSize(info.Size()), FormatSize(opts.MaxFileSize))})
+						skippedPaths[path] = true
+					}
+					return nil
+				}
+				currentFileSystemFiles[path] = scannedFile{info: info, root: root}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s walking the path %q to gather files: %w", "error", root, err)
 		}
-		return nil
-	})
-	if err != nil {
-		return nil, fmt.Errorf("%s walking the path %q to gather files: %w", "error", rootDirPath, err)
 	}
 
 	if len(currentFileSystemFiles) == 0 {
-		fmt.Println(ui.Yellow("No files found in the target directory. Returning an empty index."))
-		return NewInvertedIndex(), nil
+		fmt.Fprintln(os.Stderr, ui.Yellow("No files found in the target directories."))
+	} else {
+		fmt.Fprintf(os.Stderr, "%s Found %d files in current file system.\n", ui.Cyan("ℹ"), len(currentFileSystemFiles))
+	}
+
+	idx := oldIdx
+	if idx == nil {
+		idx = NewInvertedIndex()
 	}
-	fmt.Printf("%s Found %d files in current file system.\n", ui.Cyan("ℹ"), len(currentFileSystemFiles))
 
+	// 標準入力などファイル以外から取り込んだドキュメントは走査の対象外なので保持する
 	var filesToProcess []string
 	oldDocsByPath := make(map[string]Document)
-	if oldIdx != nil {
-		for _, doc := range oldIdx.Docs {
+	for _, doc := range idx.Docs {
+		if doc.IsFile() {
 			oldDocsByPath[doc.Path] = doc
 		}
 	}
 
-	for path, fileInfo := range currentFileSystemFiles {
+	staleDocIDs := make(map[int]bool) // ポスティングを作り直す(または削除する)ドキュメント
+	for path, file := range currentFileSystemFiles {
 		oldDoc, existsInOldIndex := oldDocsByPath[path]
-		if existsInOldIndex && oldDoc.LastModified.Equal(fileInfo.ModTime()) {
-			newIdx.Docs[oldDoc.ID] = oldDoc
-			filesToProcess = append(filesToProcess, path)
-		} else {
-			if existsInOldIndex {
-				fmt.Printf("%s File %s changed (OldTime: %s, NewTime: %s).\n", ui.Yellow("↺"), path, oldDoc.LastModified, fileInfo.ModTime())
-			} else {
-				fmt.Printf("%s New file %s found.\n", ui.Green("+"), path)
+		unchanged := existsInOldIndex && oldDoc.LastModified.Equal(file.info.ModTime())
+		if unchanged && (oldDoc.ContentStored || !idx.StoreContent) {
+			// 以前のバージョンで作ったインデックスにはサイズと拡張子がないので、ここで補う
+			if oldDoc.Root != file.root || oldDoc.Size != file.info.Size() || oldDoc.Ext != FileExt(path) {
+				oldDoc.Root = file.root
+				oldDoc.Size = file.info.Size()
+				oldDoc.Ext = FileExt(path)
+				idx.Docs[oldDoc.ID] = oldDoc
 			}
-			filesToProcess = append(filesToProcess, path)
+			continue
 		}
+		if unchanged {
+			fmt.Fprintf(os.Stderr, "%s File %s will be reprocessed to store its content.\n", ui.Yellow("↺"), path)
+			staleDocIDs[oldDoc.ID] = true
+		} else if existsInOldIndex {
+			fmt.Fprintf(os.Stderr, "%s File %s changed (OldTime: %s, NewTime: %s).\n", ui.Yellow("↺"), path, oldDoc.LastModified, file.info.ModTime())
+			staleDocIDs[oldDoc.ID] = true
+		} else {
+			fmt.Fprintf(os.Stderr, "%s New file %s found.\n", ui.Green("+"), path)
+		}
+		filesToProcess = append(filesToProcess, path)
 	}
 
-	if oldIdx != nil {
-		for path := range oldDocsByPath {
-			if _, existsInCurrentFS := currentFileSystemFiles[path]; !existsInCurrentFS {
-				fmt.Printf("%s File %s was deleted.\n", ui.Yellow("-"), path)
+	for path, oldDoc := range oldDocsByPath {
+		if !docInRoots(oldDoc, roots) {
+			continue
+		}
+		if _, existsInCurrentFS := currentFileSystemFiles[path]; !existsInCurrentFS {
+			if skippedPaths[path] {
+				fmt.Fprintf(os.Stderr, "%s File %s is now skipped and was removed from the index.\n", ui.Yellow("-"), path)
+			} else {
+				fmt.Fprintf(os.Stderr, "%s File %s was deleted.\n", ui.Yellow("-"), path)
 			}
+			staleDocIDs[oldDoc.ID] = true
+			idx.forgetDocument(oldDoc)
 		}
 	}
+	idx.removePostings(staleDocIDs)
 
 	if len(filesToProcess) == 0 {
-		fmt.Println("No files to process (all files unchanged or directory empty). Returning old index (or new if old was nil).")
-		if oldIdx != nil && len(currentFileSystemFiles) > 0 {
-			return oldIdx, nil
-		}
-		return newIdx, nil
+		fmt.Fprintln(os.Stderr, "No files to process (all files unchanged). Returning the current index.")
+		printSkippedFiles(skipped)
+		return idx, nil
 	}
-	fmt.Printf("%s %d files will be (re)processed.\n", ui.Cyan("▶"), len(filesToProcess))
+	fmt.Fprintf(os.Stderr, "%s %d files will be (re)processed.\n", ui.Cyan("▶"), len(filesToProcess))
 
 	numWorkers := runtime.NumCPU()
 	if numWorkers > len(filesToProcess) {
 		numWorkers = len(filesToProcess)
 	}
 
+	storeContent := idx.StoreContent
 	jobs := make(chan string, len(filesToProcess))
 	results := make(chan processedFileResult, len(filesToProcess))
 	var wg sync.WaitGroup
@@ -112,20 +165,23 @@ func BuildIndex(rootDirPath string, oldIdx *InvertedIndex) (*InvertedIndex, erro
 		go func(workerID int) {
 			defer wg.Done()
 			for filePath := range jobs {
-				fileInfo := currentFileSystemFiles[filePath]
+				file := currentFileSystemFiles[filePath]
 				content, err := os.ReadFile(filePath)
 				if err != nil {
 					results <- processedFileResult{filePath: filePath, err: fmt.Errorf("worker %d error reading file %q: %w", workerID, filePath, err)}
 					continue
 				}
-				tokens := tokenizer.Tokenize(string(content))
-				validTokensCount := 0
-				for _, t := range tokens {
-					if t != "" {
-						validTokensCount++
-					}
+				text, encoding, skipReason := decodeText(content)
+				if skipReason != "" {
+					results <- processedFileResult{filePath: filePath, skipReason: skipReason}
+					continue
 				}
-				results <- processedFileResult{filePath: filePath, tokens: tokens, totalWords: validTokensCount, lastModified: fileInfo.ModTime(), err: nil}
+				tokens, offsets := tokenizer.TokenizeWithOffsets(text)
+				result := processedFileResult{filePath: filePath, root: file.root, encoding: encoding, tokens: tokens, offsets: offsets, lastModified: file.info.ModTime(), size: file.info.Size(), err: nil}
+				if storeContent {
+					result.text = text
+				}
+				results <- result
 			}
 		}(w)
 	}
@@ -139,26 +195,32 @@ func BuildIndex(rootDirPath string, oldIdx *InvertedIndex) (*InvertedIndex, erro
 	resultWg.Add(1)
 	go func() {
 		defer resultWg.Done()
-		processedCount := 0
 		for result := range results {
-			processedCount++
+			oldDoc, pathExistedInOld := oldDocsByPath[result.filePath]
+			if result.skipReason != "" {
+				skipped = append(skipped, SkippedFile{Path: result.filePath, Reason: result.skipReason})
+				if pathExistedInOld {
+					idx.forgetDocument(oldDoc)
+				}
+				continue
+			}
 			if result.err != nil {
-				fmt.Printf("%s processing file %s: %v\n", ui.Yellow("Warning:"), result.filePath, result.err)
+				fmt.Fprintf(os.Stderr, "%s processing file %s: %v\n", ui.Yellow("Warning:"), result.filePath, result.err)
+				if pathExistedInOld {
+					idx.forgetDocument(oldDoc)
+				}
 				continue
 			}
 
-			var docID int
-			oldDoc, pathExistedInOld := oldDocsByPath[result.filePath]
+			doc := Document{Path: result.filePath, LastModified: result.lastModified, Size: result.size, Source: SourceFile, Root: result.root, Encoding: result.encoding}
 			if pathExistedInOld {
-				docID = oldDoc.ID
-				newIdx.Docs[docID] = Document{ID: docID, Path: result.filePath, TotalWords: result.totalWords, LastModified: result.lastModified}
+				doc.ID = oldDoc.ID
 			} else {
-				docID = newIdx.NextDocID
-				newIdx.Docs[docID] = Document{ID: docID, Path: result.filePath, TotalWords: result.totalWords, LastModified: result.lastModified}
-				newIdx.NextDocID++
+				doc.ID = idx.NextDocID
+				idx.NextDocID++
 			}
-
-			addTokensToInvertedIndex(newIdx, docID, result.tokens)
+			idx.putDocument(doc, result.tokens, result.offsets)
+			idx.storeContent(doc, result.text)
 		}
 	}()
 
@@ -166,35 +228,52 @@ func BuildIndex(rootDirPath string, oldIdx *InvertedIndex) (*InvertedIndex, erro
 	close(results)
 	resultWg.Wait()
 
-	fmt.Println(ui.Green("Index update process completed."))
-	return newIdx, nil
+	printSkippedFiles(skipped)
+	fmt.Fprintln(os.Stderr, ui.Green("Index update process completed."))
+	return idx, nil
+}
+
+// printSkippedFiles はインデックス対象から外したファイルを理由とともに表示します。
+func printSkippedFiles(skipped []SkippedFile) {
+	if len(skipped) == 0 {
+		return
+	}
+	sort.Slice(skipped, func(i, j int) bool { return skipped[i].Path < skipped[j].Path })
+	fmt.Fprintf(os.Stderr, "%s Skipped %d file(s):\n", ui.Yellow("!"), len(skipped))
+	for _, s := range skipped {
+		fmt.Fprintf(os.Stderr, "   %s: %s\n", s.Path, ui.Dim(s.Reason))
+	}
+}
+
+// docInRoots はファイルのドキュメントが指定したルートのいずれかの配下にあるかを返します。
+// Rootを持たない古いインデックスのドキュメントもパスで判定できます。
+func docInRoots(doc Document, roots []string) bool {
+	for _, root := range roots {
+		if doc.Root == root {
+			return true
+		}
+		rel, err := filepath.Rel(root, doc.Path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return true
+		}
+	}
+	return false
 }
 
-func addTokensToInvertedIndex(idx *InvertedIndex, docID int, tokens []string) {
+func addTokensToInvertedIndex(idx *InvertedIndex, docID int, tokens []string, offsets []int) {
 	tokenPositionsInDoc := make(map[string][]int)
+	tokenOffsetsInDoc := make(map[string][]int)
 	for i, token := range tokens {
 		if token == "" {
 			continue
 		}
 		tokenPositionsInDoc[token] = append(tokenPositionsInDoc[token], i)
+		if offsets != nil {
+			tokenOffsetsInDoc[token] = append(tokenOffsetsInDoc[token], offsets[i])
+		}
 	}
 
 	for token, positions := range tokenPositionsInDoc {
-		frequency := len(positions)
-		postingsList := idx.Index[token]
-		foundPostingForDoc := false
-		for i, p := range postingsList {
-			if p.DocID == docID {
-				postingsList[i].Positions = positions
-				postingsList[i].Frequency = frequency
-				foundPostingForDoc = true
-				break
-			}
-		}
-
-		if !foundPostingForDoc {
-			newPosting := Posting{DocID: docID, Positions: positions, Frequency: frequency}
-			idx.Index[token] = append(postingsList, newPosting)
-		}
+		idx.Index[token] = insertPosting(idx.Index[token], Posting{DocID: docID, Positions: positions, Offsets: tokenOffsetsInDoc[token], Frequency: len(positions)})
 	}
 }
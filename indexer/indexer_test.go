@@ -0,0 +1,121 @@
+package indexer
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBuildIndexKeepsDocsOfOtherRoots(t *testing.T) {
+	base := t.TempDir()
+	notes := filepath.Join(base, "notes")
+	wiki := filepath.Join(base, "wiki")
+	writeFile(t, filepath.Join(notes, "a.txt"), "alpha")
+	writeFile(t, filepath.Join(wiki, "b.md"), "beta")
+
+	idx, err := BuildIndex([]string{notes, wiki}, nil, BuildOptions{})
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if len(idx.Docs) != 2 {
+		t.Fatalf("len(Docs) = %d, want 2", len(idx.Docs))
+	}
+	if doc, _ := idx.FindDocument(filepath.Join(wiki, "b.md")); doc.Root != wiki {
+		t.Errorf("Root = %q, want %q", doc.Root, wiki)
+	}
+
+	if err := os.Remove(filepath.Join(notes, "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(notes, "c.txt"), "gamma")
+	idx, err = BuildIndex([]string{notes}, idx, BuildOptions{})
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if _, ok := idx.FindDocument(filepath.Join(wiki, "b.md")); !ok {
+		t.Error("document of a root that was not rescanned was removed")
+	}
+	if _, ok := idx.FindDocument(filepath.Join(notes, "a.txt")); ok {
+		t.Error("deleted file in the rescanned root is still indexed")
+	}
+	if _, ok := idx.Index["gamma"]; !ok {
+		t.Error("new file in the rescanned root was not indexed")
+	}
+}
+
+func TestBuildIndexSkipsBinaryAndLargeFiles(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "ok.txt"), "plain text")
+	writeFile(t, filepath.Join(dir, "nul.txt"), "looks\x00binary")
+	writeFile(t, filepath.Join(dir, "garbage.md"), "\xff\xfe\xfd\xfc\xfb\xfa")
+	writeFile(t, filepath.Join(dir, "big.txt"), strings.Repeat("word ", 100))
+
+	idx, err := BuildIndex([]string{dir}, nil, BuildOptions{MaxFileSize: 100})
+	if err != nil {
+		t.Fatalf("BuildIndex() error = %v", err)
+	}
+	if len(idx.Docs) != 1 {
+		t.Fatalf("len(Docs) = %d, want only ok.txt indexed: %+v", len(idx.Docs), idx.Docs)
+	}
+	if _, ok := idx.FindDocument(filepath.Join(dir, "ok.txt")); !ok {
+		t.Error("ok.txt was not indexed")
+	}
+}
+
+func TestBuildIndexStoresContentWhenEnabled(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "a.txt")
+	writeFile(t, path, "first version")
+
+	idx, err := BuildIndex([]string{dir}, nil, BuildOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if doc, _ := idx.FindDocument(path); doc.ContentStored || len(idx.Stored) != 0 {
+		t.Fatalf("content stored without StoreContent: %+v", idx.Stored)
+	}
+
+	// 有効にすると、変更のないファイルも本文を保存するために処理し直す
+	idx.StoreContent = true
+	if idx, err = BuildIndex([]string{dir}, idx, BuildOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	doc, _ := idx.FindDocument(path)
+	if !doc.ContentStored {
+		t.Error("ContentStored = false after enabling StoreContent")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if content, err := idx.Content(doc); err != nil || content != "first version" {
+		t.Errorf("Content() = %q, %v; want the stored text", content, err)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := map[string]int64{"0": 0, "512": 512, "10k": 10 << 10, "1.5M": 3 << 19, "2GB": 2 << 30, "10.0MiB": 10 << 20}
+	for in, want := range tests {
+		got, err := ParseSize(in)
+		if err != nil || got != want {
+			t.Errorf("ParseSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseSize("ten"); err == nil {
+		t.Error("ParseSize(\"ten\") returned no error")
+	}
+	// -max-sizeの既定値はFormatSizeで表示するので、そのまま読み戻せる必要がある
+	if got, err := ParseSize(FormatSize(DefaultMaxFileSize)); err != nil || got != DefaultMaxFileSize {
+		t.Errorf("ParseSize(FormatSize(DefaultMaxFileSize)) = %d, %v; want %d", got, err, DefaultMaxFileSize)
+	}
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,100 @@
+package indexer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// IngestStats はファイル以外の入力を取り込んだ結果の件数です。
+type IngestStats struct {
+	Added   int
+	Updated int
+}
+
+// IndexText はrから読み込んだテキストをidという識別子のドキュメントとして登録します。
+// 同じ識別子のドキュメントが既にあれば内容を置き換えます。
+func IndexText(idx *InvertedIndex, id string, source string, r io.Reader) (IngestStats, error) {
+	var stats IngestStats
+	if id == "" {
+		return stats, fmt.Errorf("document id must not be empty")
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return stats, fmt.Errorf("failed to read %s input for %q: %w", source, id, err)
+	}
+	doc := Document{Path: id, LastModified: time.Now(), Source: source}
+	_, updated, err := idx.PutDocument(doc, string(content))
+	if err != nil {
+		return stats, err
+	}
+	stats.count(updated)
+	return stats, nil
+}
+
+// IndexJSONL はJSON Lines形式の入力を1行1ドキュメントとして登録します。
+// 各行は文字列の"id"と"text"を必須とし、それ以外のフィールドはメタデータとして保存します。
+// 文字列以外のメタデータの値はJSON表現のまま保存されます。
+func IndexJSONL(idx *InvertedIndex, r io.Reader) (IngestStats, error) {
+	var stats IngestStats
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue // 空行 (空白やCRLFの改行だけの行を含む)
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(line, &fields); err != nil {
+			return stats, fmt.Errorf("line %d: invalid JSON: %w", lineNo, err)
+		}
+		var id, text string
+		if err := json.Unmarshal(fields["id"], &id); err != nil || id == "" {
+			return stats, fmt.Errorf("line %d: \"id\" must be a non-empty string", lineNo)
+		}
+		if err := json.Unmarshal(fields["text"], &text); err != nil {
+			return stats, fmt.Errorf("line %d: \"text\" must be a string", lineNo)
+		}
+
+		var meta map[string]string
+		for key, raw := range fields {
+			if key == "id" || key == "text" {
+				continue
+			}
+			if meta == nil {
+				meta = make(map[string]string)
+			}
+			var s string
+			if err := json.Unmarshal(raw, &s); err == nil {
+				meta[key] = s
+			} else {
+				meta[key] = string(raw)
+			}
+		}
+
+		doc := Document{Path: id, LastModified: time.Now(), Source: SourceJSONL, Meta: meta}
+		_, updated, err := idx.PutDocument(doc, text)
+		if err != nil {
+			return stats, fmt.Errorf("line %d: %w", lineNo, err)
+		}
+		stats.count(updated)
+	}
+	if err := scanner.Err(); err != nil {
+		return stats, fmt.Errorf("failed to read JSON Lines input: %w", err)
+	}
+	return stats, nil
+}
+
+func (s *IngestStats) count(updated bool) {
+	if updated {
+		s.Updated++
+	} else {
+		s.Added++
+	}
+}
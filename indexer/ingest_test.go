@@ -0,0 +1,56 @@
+package indexer
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIndexJSONL(t *testing.T) {
+	idx := NewInvertedIndex()
+	input := `{"id":"T-1","text":"disk full on build server","team":"infra","priority":2}
+
+{"id":"T-2","text":"build server is slow"}
+{"id":"T-1","text":"disk replaced"}
+` + "  \t\n\r\n"
+	stats, err := IndexJSONL(idx, strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("IndexJSONL() error = %v", err)
+	}
+	if stats.Added != 2 || stats.Updated != 1 {
+		t.Errorf("IndexJSONL() stats = %+v, want 2 added and 1 updated", stats)
+	}
+
+	doc, ok := idx.FindDocument("T-1")
+	if !ok {
+		t.Fatal("document T-1 not found")
+	}
+	if doc.Source != SourceJSONL || doc.IsFile() {
+		t.Errorf("T-1 source = %q, want %q", doc.Source, SourceJSONL)
+	}
+	content, err := idx.Content(doc)
+	if err != nil || content != "disk replaced" {
+		t.Errorf("Content(T-1) = %q, %v; want stored text of the latest record", content, err)
+	}
+	if _, err := IndexJSONL(idx, strings.NewReader(`{"text":"no id"}`)); err == nil {
+		t.Error("IndexJSONL() accepted a record without an id")
+	}
+}
+
+func TestIndexTextDoesNotReplaceFileDocument(t *testing.T) {
+	idx := NewInvertedIndex()
+	if _, err := idx.AddDocument(Document{Path: "/notes/a.txt", Source: SourceFile}, "file text"); err != nil {
+		t.Fatal(err)
+	}
+	_, err := IndexText(idx, "/notes/a.txt", SourceStdin, strings.NewReader("stdin text"))
+	if !errors.Is(err, ErrDocumentExists) {
+		t.Errorf("IndexText() error = %v, want ErrDocumentExists", err)
+	}
+	_, err = IndexJSONL(idx, strings.NewReader(`{"id":"/notes/a.txt","text":"jsonl text"}`))
+	if !errors.Is(err, ErrDocumentExists) {
+		t.Errorf("IndexJSONL() error = %v, want ErrDocumentExists", err)
+	}
+	if doc, _ := idx.FindDocument("/notes/a.txt"); !doc.IsFile() || len(idx.Index["file"]) != 1 {
+		t.Errorf("file document was replaced: %+v", doc)
+	}
+}
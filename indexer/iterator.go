@@ -0,0 +1,94 @@
+package indexer
+
+import (
+	"math"
+	"sort"
+)
+
+// NoMoreDocs は終端に達したPostingIteratorのDocが返す値です。
+const NoMoreDocs = math.MaxInt
+
+// IteratorBlockSize はSliceIteratorがブロックごとの上限を計算する単位です。
+// ファイルのポスティングのブロックと同じ大きさにしています。
+const IteratorBlockSize = 128
+
+// PostingIterator は1単語のポスティングをDocIDの昇順にたどるカーソルです。
+// 作成直後は最初のポスティングを指しています。
+// WANDのような枝刈りのため、ポスティングを展開せずに出現回数の上限を問い合わせられます。
+type PostingIterator interface {
+	// Doc は現在のポスティングのDocIDを返します。終端ではNoMoreDocsを返します。
+	Doc() int
+	// Posting は現在のポスティングを返します。終端では呼び出せません。
+	Posting() Posting
+	// Advance はDocIDがtarget以上の最初のポスティングへ進みます。現在位置より前には戻りません。
+	Advance(target int) error
+	// Len はポスティングの数 (単語を含むドキュメント数) を返します。
+	Len() int
+	// MaxFrequency はリスト全体での出現回数の最大値を返します。
+	MaxFrequency() int
+	// BlockMax はDocIDがtarget以上のポスティングを含む最初のブロックについて、
+	// その最後のDocIDとブロック内の出現回数の最大値を返します。現在位置は変えません。
+	// 該当するブロックが無ければNoMoreDocsと0を返します。
+	BlockMax(target int) (lastDocID, maxFreq int)
+}
+
+// SliceIterator は展開済みのポスティングをたどるPostingIteratorです。
+// 出現回数の上限は作成時にIteratorBlockSize件ごとに計算します。
+type SliceIterator struct {
+	postings  []Posting
+	pos       int
+	maxFreq   int
+	blockLast []int // ブロックごとの最後のDocID
+	blockMax  []int // ブロックごとの出現回数の最大値
+}
+
+// NewSliceIterator はDocIDの昇順に並んだpostingsをたどるSliceIteratorを作ります。
+func NewSliceIterator(postings []Posting) *SliceIterator {
+	it := &SliceIterator{postings: postings}
+	for start := 0; start < len(postings); start += IteratorBlockSize {
+		end := min(start+IteratorBlockSize, len(postings))
+		blockMax := 0
+		for _, p := range postings[start:end] {
+			blockMax = max(blockMax, p.Frequency)
+		}
+		it.blockLast = append(it.blockLast, postings[end-1].DocID)
+		it.blockMax = append(it.blockMax, blockMax)
+		it.maxFreq = max(it.maxFreq, blockMax)
+	}
+	return it
+}
+
+func (it *SliceIterator) Doc() int {
+	if it.pos >= len(it.postings) {
+		return NoMoreDocs
+	}
+	return it.postings[it.pos].DocID
+}
+
+func (it *SliceIterator) Posting() Posting { return it.postings[it.pos] }
+
+func (it *SliceIterator) Advance(target int) error {
+	if it.Doc() >= target {
+		return nil
+	}
+	rest := it.postings[it.pos:]
+	it.pos += sort.Search(len(rest), func(i int) bool { return rest[i].DocID >= target })
+	return nil
+}
+
+func (it *SliceIterator) Len() int { return len(it.postings) }
+
+func (it *SliceIterator) MaxFrequency() int { return it.maxFreq }
+
+func (it *SliceIterator) BlockMax(target int) (lastDocID, maxFreq int) {
+	b := sort.Search(len(it.blockLast), func(i int) bool { return it.blockLast[i] >= target })
+	if b == len(it.blockLast) {
+		return NoMoreDocs, 0
+	}
+	return it.blockLast[b], it.blockMax[b]
+}
+
+// Iterator は単語のポスティングをたどるPostingIteratorを返します。単語がなければ空のイテレータを返します。
+func (idx *InvertedIndex) Iterator(term string) (PostingIterator, error) {
+	return NewSliceIterator(idx.Index[term]), nil
+}
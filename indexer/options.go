@@ -0,0 +1,83 @@
+package indexer
+
+import (
+	"fmt"
+	"gmi/charset"
+	"strconv"
+	"strings"
+)
+
+// DefaultMaxFileSize はBuildOptions.MaxFileSizeの既定値 (10MiB) です。
+const DefaultMaxFileSize = 10 << 20
+
+// binarySniffLen はNULバイトによるバイナリ判定に使う先頭の文字数です。
+const binarySniffLen = 8000
+
+// BuildOptions はBuildIndexの動作を調整するオプションです。
+type BuildOptions struct {
+	MaxFileSize int64 // これより大きいファイルは読み込まずにスキップする (0以下で無制限)
+}
+
+// SkippedFile はインデックス対象から外したファイルとその理由です。
+type SkippedFile struct {
+	Path   string
+	Reason string
+}
+
+// decodeText はファイルの文字コードを判定してUTF-8のテキストに変換します。
+// 文字コードを判定できない場合や変換後にNULバイトを含む場合は、バイナリとしてスキップ理由を返します。
+func decodeText(content []byte) (text string, encoding string, skipReason string) {
+	encoding = charset.Detect(content)
+	if encoding == "" {
+		return "", "", fmt.Sprintf("binary content (%.0f%% invalid UTF-8)", charset.InvalidUTF8Fraction(content)*100)
+	}
+	text, err := charset.Decode(content, encoding)
+	if err != nil {
+		return "", "", err.Error()
+	}
+	sample := text
+	if len(sample) > binarySniffLen {
+		sample = sample[:binarySniffLen]
+	}
+	if strings.IndexByte(sample, 0) >= 0 {
+		return "", "", "binary content (NUL byte)"
+	}
+	return text, encoding, ""
+}
+
+// ParseSize は"10M"や"512k"のようなサイズ表記をバイト数に変換します。
+// 接尾辞はk, m, g (1024単位、大文字小文字を区別せず、"KB"や"KiB"の形も可) に対応します。
+func ParseSize(s string) (int64, error) {
+	trimmed := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(s)), "b")
+	trimmed = strings.TrimSuffix(trimmed, "i")
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(trimmed, "k"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(trimmed, "m"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(trimmed, "g"):
+		multiplier = 1 << 30
+	}
+	if multiplier > 1 {
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	n, err := strconv.ParseFloat(trimmed, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(multiplier)), nil
+}
+
+// FormatSize はバイト数を人が読みやすい表記に変換します。
+func FormatSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
@@ -0,0 +1,70 @@
+package indexer
+
+import (
+	"gmi/charset"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Reader は検索に必要なインデックスへの読み取り専用のアクセスを表します。
+// メモリ上のInvertedIndexのほか、ファイルから必要な部分だけを読み込む実装があります。
+type Reader interface {
+	// Postings は単語のポスティングをDocIDの昇順で返します。単語がなければnilを返します。
+	Postings(term string) ([]Posting, error)
+	// Document はドキュメントIDに対応するドキュメントを返します。
+	Document(id int) (Document, bool)
+	// NumDocs はインデックス内のドキュメント数を返します。
+	NumDocs() int
+	// Content はスニペット生成に使うドキュメントの本文を返します。
+	Content(doc Document) (string, error)
+	// Terms はprefixで始まる単語とそれを含むドキュメント数を単語の昇順で返します。
+	Terms(prefix string) ([]TermStat, error)
+	// Iterator は単語のポスティングを必要な分だけ展開しながらたどるイテレータを返します。
+	// 単語がなければ空のイテレータを返します。
+	Iterator(term string) (PostingIterator, error)
+}
+
+// TermStat は単語とそれを含むドキュメント数です。
+type TermStat struct {
+	Term    string
+	DocFreq int
+}
+
+// Postings は単語のポスティングを返します。
+func (idx *InvertedIndex) Postings(term string) ([]Posting, error) {
+	return idx.Index[term], nil
+}
+
+// Document はドキュメントIDに対応するドキュメントを返します。
+func (idx *InvertedIndex) Document(id int) (Document, bool) {
+	doc, ok := idx.Docs[id]
+	return doc, ok
+}
+
+// NumDocs はインデックス内のドキュメント数を返します。
+func (idx *InvertedIndex) NumDocs() int {
+	return len(idx.Docs)
+}
+
+// Terms はprefixで始まる単語とそれを含むドキュメント数を返します。
+func (idx *InvertedIndex) Terms(prefix string) ([]TermStat, error) {
+	var terms []TermStat
+	for term, postings := range idx.Index {
+		if strings.HasPrefix(term, prefix) {
+			terms = append(terms, TermStat{Term: term, DocFreq: len(postings)})
+		}
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i].Term < terms[j].Term })
+	return terms, nil
+}
+
+// ReadFileContent はファイルのドキュメントを読み直し、
+// インデックス作成時に検出した文字コードからUTF-8に変換します。
+func ReadFileContent(doc Document) (string, error) {
+	content, err := os.ReadFile(doc.Path)
+	if err != nil {
+		return "", err
+	}
+	return charset.Decode(content, doc.Encoding)
+}
@@ -1,13 +1,41 @@
 package indexer
 
-import "time"
+import (
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// ドキュメントの取り込み元を表す値です。
+const (
+	SourceFile  = "file"  // ディスク上のファイル (Pathはファイルパス)
+	SourceStdin = "stdin" // 標準入力から取り込んだテキスト
+	SourceJSONL = "jsonl" // JSON Linesから取り込んだテキスト
+)
 
 // Document は検索対象のドキュメントを表します。
 type Document struct {
-	ID           int       // ドキュメントの一意なID
-	Path         string    // ドキュメントのファイルパス
-	TotalWords   int       // ドキュメント内の総単語数(トークン数)
-	LastModified time.Time // ファイルの最終更新日時
+	ID            int               // ドキュメントの一意なID
+	Path          string            // ドキュメントのファイルパス (ファイル以外では任意の識別子)
+	TotalWords    int               // ドキュメント内の総単語数(トークン数)
+	LastModified  time.Time         // ファイルの最終更新日時
+	Size          int64             // ファイルのバイト数 (ファイル以外では本文のバイト数)
+	Ext           string            // パスの拡張子 (先頭の"."を除いた小文字、なければ空)
+	Source        string            // 取り込み元 (空の場合はSourceFileとして扱う)
+	Root          string            // ファイルを見つけたルートディレクトリ (ファイル以外では空)
+	Encoding      string            // 検出したファイルの文字コード (空の場合はUTF-8)
+	Meta          map[string]string // 取り込み時に付与された任意のメタデータ
+	ContentStored bool              // 本文がインデックスに保存されているか
+}
+
+// IsFile はドキュメントがディスク上のファイルから取り込まれたかどうかを返します。
+func (d Document) IsFile() bool {
+	return d.Source == "" || d.Source == SourceFile
+}
+
+// FileExt はパスの拡張子を、先頭の"."を除いた小文字で返します。Document.Extの値です。
+func FileExt(path string) string {
+	return strings.ToLower(strings.TrimPrefix(filepath.Ext(path), "."))
 }
 
 // Posting は転置インデックスのポスティングリストの要素です。
@@ -15,13 +43,21 @@ type Posting struct {
 	DocID     int   // ドキュメントID
 	Frequency int   // 単語ドキュメント内での出現回数
 	Positions []int // 単語の出現位置 (ドキュメント内のトークンindex)
+	Offsets   []int // 出現位置ごとの、本文中のバイトオフセット (記録していない古いインデックスではnil)
 }
 
 // InvertedIndex は転置インデックス全体を表します。
 type InvertedIndex struct {
 	Index     map[string][]Posting
 	Docs      map[int]Document // ドキュメントIDからドキュメント情報へのマップ
+	Stored    map[int]string   // ファイル以外のドキュメントと、StoreContentが有効な場合はファイルの本文 (スニペット生成用)
 	NextDocID int              // 次に割り当てるドキュメントID
+
+	// StoreContent が有効な場合、ファイルの本文もインデックスに保存します。
+	// スニペットはファイルを読み直さずに保存した本文から作られます。
+	StoreContent bool
+
+	byPath map[string]int // パスからドキュメントIDへの索引 (必要になった時点で構築)
 }
 
 // NewInvertedIndex は新しいInvertedIndexのインスタンスを作成します。
@@ -29,6 +65,7 @@ func NewInvertedIndex() *InvertedIndex {
 	return &InvertedIndex{
 		Index:     make(map[string][]Posting),
 		Docs:      make(map[int]Document),
+		Stored:    make(map[int]string),
 		NextDocID: 0,
 	}
 }
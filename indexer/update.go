@@ -0,0 +1,186 @@
+package indexer
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"gmi/tokenizer"
+	"sort"
+)
+
+var (
+	// ErrDocumentExists は同じパスのドキュメントが既に登録されている場合に返されます。
+	ErrDocumentExists = errors.New("document already exists")
+	// ErrDocumentNotFound は指定したパスのドキュメントが登録されていない場合に返されます。
+	ErrDocumentNotFound = errors.New("document not found")
+)
+
+// FindDocument はパスに対応するドキュメントを返します。
+func (idx *InvertedIndex) FindDocument(path string) (Document, bool) {
+	if idx.byPath == nil {
+		idx.byPath = make(map[string]int, len(idx.Docs))
+		for id, doc := range idx.Docs {
+			idx.byPath[doc.Path] = id
+		}
+	}
+	id, ok := idx.byPath[path]
+	if !ok {
+		return Document{}, false
+	}
+	doc, ok := idx.Docs[id]
+	return doc, ok
+}
+
+// AddDocument はcontentをトークン化し、新しいドキュメントとしてインデックスに追加します。
+// doc.IDとdoc.TotalWordsは無視され、割り当てたドキュメントIDを返します。doc.Sizeが0ならcontentのバイト数にします。
+// Pathはファイルパスである必要はなく、ドキュメントを識別する任意の文字列を使えます。
+// ファイル以外のドキュメントはスニペット生成のためにcontentをインデックス内に保存します。
+func (idx *InvertedIndex) AddDocument(doc Document, content string) (int, error) {
+	if _, exists := idx.FindDocument(doc.Path); exists {
+		return 0, fmt.Errorf("%w: %s", ErrDocumentExists, doc.Path)
+	}
+	doc.ID = idx.NextDocID
+	idx.NextDocID++
+	if doc.Size == 0 {
+		doc.Size = int64(len(content))
+	}
+	tokens, offsets := tokenizer.TokenizeWithOffsets(content)
+	idx.putDocument(doc, tokens, offsets)
+	idx.storeContent(doc, content)
+	return doc.ID, nil
+}
+
+// UpdateDocument は同じパスを持つ既存ドキュメントの内容を置き換えます。
+// ドキュメントIDは維持され、古いポスティングは全て削除されます。
+func (idx *InvertedIndex) UpdateDocument(doc Document, content string) (int, error) {
+	old, exists := idx.FindDocument(doc.Path)
+	if !exists {
+		return 0, fmt.Errorf("%w: %s", ErrDocumentNotFound, doc.Path)
+	}
+	doc.ID = old.ID
+	if doc.Size == 0 {
+		doc.Size = int64(len(content))
+	}
+	idx.removePostings(map[int]bool{doc.ID: true})
+	delete(idx.Stored, doc.ID)
+	tokens, offsets := tokenizer.TokenizeWithOffsets(content)
+	idx.putDocument(doc, tokens, offsets)
+	idx.storeContent(doc, content)
+	return doc.ID, nil
+}
+
+// PutDocument はパスが登録済みならUpdateDocumentを、未登録ならAddDocumentを行います。
+// 2番目の戻り値は既存ドキュメントを更新した場合にtrueになります。
+// ファイルのドキュメントとファイル以外のドキュメントは互いに置き換えず、ErrDocumentExistsを返します。
+func (idx *InvertedIndex) PutDocument(doc Document, content string) (int, bool, error) {
+	if old, exists := idx.FindDocument(doc.Path); exists {
+		if old.IsFile() != doc.IsFile() {
+			return 0, false, fmt.Errorf("%w: %q is already indexed as a %s document", ErrDocumentExists, doc.Path, cmp.Or(old.Source, SourceFile))
+		}
+		id, err := idx.UpdateDocument(doc, content)
+		return id, true, err
+	}
+	id, err := idx.AddDocument(doc, content)
+	return id, false, err
+}
+
+// DeleteDocument はパスに対応するドキュメントとそのポスティングを削除します。
+func (idx *InvertedIndex) DeleteDocument(path string) error {
+	doc, exists := idx.FindDocument(path)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrDocumentNotFound, path)
+	}
+	idx.removePostings(map[int]bool{doc.ID: true})
+	idx.forgetDocument(doc)
+	return nil
+}
+
+// Content はドキュメントの本文を返します。
+// インデックス内に保存された本文があればそれを使い、なければファイルを読み直します。
+func (idx *InvertedIndex) Content(doc Document) (string, error) {
+	if content, ok := idx.Stored[doc.ID]; ok {
+		return content, nil
+	}
+	if !doc.IsFile() {
+		return "", fmt.Errorf("no stored content for %s document %q", doc.Source, doc.Path)
+	}
+	return ReadFileContent(doc)
+}
+
+// storeContent はファイル以外のドキュメントの本文と、StoreContentが有効な場合はファイルの本文を
+// インデックスに保存します。putDocumentの後に呼び出します。
+func (idx *InvertedIndex) storeContent(doc Document, content string) {
+	if doc.IsFile() && !idx.StoreContent {
+		return
+	}
+	if idx.Stored == nil {
+		idx.Stored = make(map[int]string)
+	}
+	idx.Stored[doc.ID] = content
+	doc = idx.Docs[doc.ID]
+	doc.ContentStored = true
+	idx.Docs[doc.ID] = doc
+}
+
+// putDocument はトークン化済みのドキュメントをDocsとポスティングに登録します。
+// offsetsは各単語のバイトオフセットで、nilならポスティングに記録しません。
+// doc.IDのポスティングが既に存在しないことを前提とします。
+func (idx *InvertedIndex) putDocument(doc Document, tokens []string, offsets []int) {
+	doc.TotalWords = 0
+	doc.ContentStored = false
+	doc.Ext = FileExt(doc.Path)
+	for _, t := range tokens {
+		if t != "" {
+			doc.TotalWords++
+		}
+	}
+	idx.Docs[doc.ID] = doc
+	if idx.byPath != nil {
+		idx.byPath[doc.Path] = doc.ID
+	}
+	addTokensToInvertedIndex(idx, doc.ID, tokens, offsets)
+}
+
+// forgetDocument はドキュメント情報と保存済みの本文を削除します。ポスティングは対象外です。
+func (idx *InvertedIndex) forgetDocument(doc Document) {
+	delete(idx.Docs, doc.ID)
+	delete(idx.Stored, doc.ID)
+	if idx.byPath != nil {
+		delete(idx.byPath, doc.Path)
+	}
+}
+
+// removePostings は指定したドキュメントIDのポスティングを全ての単語から取り除きます。
+// 複数のドキュメントを一度に削除できるよう、インデックスの走査は1回だけ行います。
+func (idx *InvertedIndex) removePostings(docIDs map[int]bool) {
+	if len(docIDs) == 0 {
+		return
+	}
+	for token, postings := range idx.Index {
+		kept := postings[:0]
+		for _, p := range postings {
+			if !docIDs[p.DocID] {
+				kept = append(kept, p)
+			}
+		}
+		if len(kept) == 0 {
+			delete(idx.Index, token)
+		} else {
+			idx.Index[token] = kept
+		}
+	}
+}
+
+// insertPosting はDocIDの昇順を保つようにポスティングを挿入します。
+// 同じDocIDのポスティングが既にあれば置き換えます。
+func insertPosting(postings []Posting, p Posting) []Posting {
+	i := sort.Search(len(postings), func(i int) bool { return postings[i].DocID >= p.DocID })
+	if i < len(postings) && postings[i].DocID == p.DocID {
+		postings[i] = p
+		return postings
+	}
+	postings = append(postings, Posting{})
+	copy(postings[i+1:], postings[i:])
+	postings[i] = p
+	return postings
+}
@@ -0,0 +1,66 @@
+package indexer
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestDocumentLifecycle(t *testing.T) {
+	idx := NewInvertedIndex()
+
+	id, err := idx.AddDocument(Document{Path: "ticket-1"}, "Printer is on fire, printer smokes")
+	if err != nil {
+		t.Fatalf("AddDocument() error = %v", err)
+	}
+	if got := idx.Docs[id].TotalWords; got != 6 {
+		t.Errorf("TotalWords = %d, want 6", got)
+	}
+	if got := idx.Index["printer"]; len(got) != 1 || got[0].Frequency != 2 {
+		t.Errorf("postings for 'printer' = %+v, want one posting with frequency 2", got)
+	}
+	if _, err := idx.AddDocument(Document{Path: "ticket-1"}, "duplicate"); !errors.Is(err, ErrDocumentExists) {
+		t.Errorf("AddDocument() on existing path error = %v, want ErrDocumentExists", err)
+	}
+
+	updatedID, err := idx.UpdateDocument(Document{Path: "ticket-1"}, "fixed")
+	if err != nil {
+		t.Fatalf("UpdateDocument() error = %v", err)
+	}
+	if updatedID != id {
+		t.Errorf("UpdateDocument() id = %d, want %d", updatedID, id)
+	}
+	if _, ok := idx.Index["printer"]; ok {
+		t.Errorf("stale term 'printer' still indexed after update")
+	}
+	if got := idx.Index["fixed"]; len(got) != 1 || got[0].DocID != id {
+		t.Errorf("postings for 'fixed' = %+v, want one posting for doc %d", got, id)
+	}
+
+	if err := idx.DeleteDocument("ticket-1"); err != nil {
+		t.Fatalf("DeleteDocument() error = %v", err)
+	}
+	if len(idx.Docs) != 0 || len(idx.Index) != 0 {
+		t.Errorf("index not empty after delete: docs=%d terms=%d", len(idx.Docs), len(idx.Index))
+	}
+	if err := idx.DeleteDocument("ticket-1"); !errors.Is(err, ErrDocumentNotFound) {
+		t.Errorf("DeleteDocument() on missing path error = %v, want ErrDocumentNotFound", err)
+	}
+}
+
+func TestPostingsStaySortedByDocID(t *testing.T) {
+	idx := NewInvertedIndex()
+	for _, path := range []string{"a", "b", "c"} {
+		if _, err := idx.AddDocument(Document{Path: path}, "shared"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := idx.UpdateDocument(Document{Path: "a"}, "shared again"); err != nil {
+		t.Fatal(err)
+	}
+	postings := idx.Index["shared"]
+	for i := 1; i < len(postings); i++ {
+		if postings[i-1].DocID >= postings[i].DocID {
+			t.Fatalf("postings not sorted by DocID: %+v", postings)
+		}
+	}
+}
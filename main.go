@@ -1,15 +1,28 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"gmi/indexer"
 	"gmi/searcher"
+	"gmi/segment"
+	"gmi/server"
 	"gmi/store"
 	"gmi/ui"
+	"net/http"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"slices"
 	"sort"
 	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/term"
 )
 
 func main() {
@@ -25,8 +38,22 @@ func main() {
 		handleIndexCommand()
 	case "search":
 		handleSearchCommand()
+	case "serve":
+		handleServeCommand()
+	case "shell":
+		handleShellCommand()
+	case "tui":
+		handleTUICommand()
+	case "check":
+		handleCheckCommand()
+	case "export":
+		handleExportCommand()
+	case "import":
+		handleImportCommand()
+	case "merge":
+		handleMergeCommand()
 	default:
-		fmt.Printf("%s Unknown command: %s\n", ui.Yellow("!"), ui.Red(command))
+		fmt.Fprintf(os.Stderr, "%s Unknown command: %s\n", ui.Yellow("!"), ui.Red(command))
 		printUsage()
 		os.Exit(1)
 	}
@@ -35,119 +62,621 @@ func main() {
 func printUsage() {
 	fmt.Println(ui.Bold("Usage:"), "go_my_index <command> [arguments]")
 	fmt.Println(ui.Bold("Commands:"))
-	fmt.Println("  ", ui.Cyan("index"), "-dir <target_directory> [-out <index_file_path>]")
-	fmt.Println("  ", ui.Cyan("search"), "-index <index_file_path> -q <query> [-mode <and|or>]")
+	fmt.Println("  ", ui.Cyan("index"), "-dir <target_directory> [-dir <another_directory> ...] [-out <index_file_path>] [-max-size <size>] [-segments] [-store-content] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("index"), "-stdin -id <name> | -jsonl <file|-> [-out <index_file_path>] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("search"), "-index <index_file_path> -q <query> [-mode <and|or>] [-limit <n>] [-offset <n>] [-format <text|json|jsonl|tsv>] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("serve"), "-index <index_file_path> [-addr <host:port>] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("shell"), "-index <index_file_path> [-history <file>] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("tui"), "-index <index_file_path> [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("check"), "-index <index_file_path> [-repair] [-files=false] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("export"), "-index <index_file_path> [-format jsonl] [-out <file|->] [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("import"), "-in <file|-> -out <index_file_path> [-lock-timeout <duration>]")
+	fmt.Println("  ", ui.Cyan("merge"), "-index <segment_directory> [-lock-timeout <duration>]")
+}
+
+// openBackend はインデックスのパスに合った保存方法を返します。
+// マニフェストのあるディレクトリか、segmentedが指定された場合はセグメントディレクトリとして扱います。
+func openBackend(path string, segmented bool) store.Backend {
+	if segmented || segment.IsSegmented(path) {
+		return segment.NewBackend(path)
+	}
+	return store.NewFileBackend(path)
+}
+
+// stringListFlag は繰り返し指定できる文字列フラグです。
+type stringListFlag []string
+
+func (f *stringListFlag) String() string { return strings.Join(*f, ",") }
+
+func (f *stringListFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
 }
 
 func handleIndexCommand() {
 	indexCmd := flag.NewFlagSet("index", flag.ExitOnError)
-	targetDir := indexCmd.String("dir", "", "Directory to index (required)")
+	var targetDirs stringListFlag
+	indexCmd.Var(&targetDirs, "dir", "Directory to index (repeatable)")
 	indexPath := indexCmd.String("out", "myindex.idx", "Path to save/load the index file")
+	fromStdin := indexCmd.Bool("stdin", false, "Index text read from standard input as a single document")
+	stdinID := indexCmd.String("id", "", "Document identifier for -stdin (required with -stdin)")
+	jsonlPath := indexCmd.String("jsonl", "", "Index JSON Lines records with 'id' and 'text' fields ('-' for stdin)")
+	segmented := indexCmd.Bool("segments", false, "Treat -out as a directory of immutable segments and write only what changed")
+	lockTimeout := indexCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait for another gmi process holding the index lock")
+	storeContent := indexCmd.Bool("store-content", false, "Store compressed file contents in the index so snippets don't reread files")
+	maxSize := indexCmd.String("max-size", indexer.FormatSize(indexer.DefaultMaxFileSize), "Skip files larger than this size (e.g. 512k, 10M; 0 for no limit)")
 	indexCmd.Parse(os.Args[2:])
 
-	if *targetDir == "" {
-		fmt.Println(ui.Red("Error:"), "-dir flag is required for index command.")
+	if len(targetDirs) == 0 && !*fromStdin && *jsonlPath == "" {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "one of -dir, -stdin or -jsonl is required for index command.")
+		indexCmd.Usage()
+		os.Exit(1)
+	}
+	if *fromStdin && *stdinID == "" {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-id flag is required when using -stdin.")
+		indexCmd.Usage()
+		os.Exit(1)
+	}
+	if *fromStdin && *jsonlPath == "-" {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-stdin and -jsonl - cannot both read standard input.")
+		os.Exit(1)
+	}
+	maxFileSize, err := indexer.ParseSize(*maxSize)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), err)
 		indexCmd.Usage()
 		os.Exit(1)
 	}
 
-	fmt.Printf("%s Index command: targetDir='%s', indexPath='%s'\n", ui.Cyan("▶"), *targetDir, *indexPath)
+	fmt.Fprintf(os.Stderr, "%s Index command: targetDirs='%s', indexPath='%s'\n", ui.Cyan("▶"), targetDirs.String(), *indexPath)
 
-	oldIdx, err := store.LoadIndex(*indexPath)
+	// 読み込みから保存までの間、他のindexや検索が途中の状態を見ないように排他ロックを持つ
+	lock, err := store.LockExclusive(*indexPath, *lockTimeout)
 	if err != nil {
-		if !os.IsNotExist(err) {
-			fmt.Printf("%s Error loading existing index: %v. A new index will be built.\n", ui.Yellow("Warning:"), err)
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	// 各入力を順にインデックスへ反映する。単一ファイルでもセグメントでも同じ処理を使う
+	applySources := func(idx *indexer.InvertedIndex) error {
+		if *storeContent {
+			idx.StoreContent = true // 一度有効にすると以降の更新でも本文を保存する
+		}
+		if len(targetDirs) > 0 {
+			if _, err := indexer.BuildIndex(targetDirs, idx, indexer.BuildOptions{MaxFileSize: maxFileSize}); err != nil {
+				return fmt.Errorf("building/updating index: %w", err)
+			}
 		}
-		if oldIdx == nil {
-			oldIdx = indexer.NewInvertedIndex()
+		if *fromStdin {
+			stats, err := indexer.IndexText(idx, *stdinID, indexer.SourceStdin, os.Stdin)
+			if err != nil {
+				return fmt.Errorf("indexing standard input: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "%s Indexed standard input as '%s' (added: %d, updated: %d).\n", ui.Green("+"), *stdinID, stats.Added, stats.Updated)
+		}
+		if *jsonlPath != "" {
+			input := os.Stdin
+			if *jsonlPath != "-" {
+				file, err := os.Open(*jsonlPath)
+				if err != nil {
+					return fmt.Errorf("opening JSON Lines input: %w", err)
+				}
+				defer file.Close()
+				input = file
+			}
+			stats, err := indexer.IndexJSONL(idx, input)
+			if err != nil {
+				return fmt.Errorf("indexing JSON Lines input: %w", err)
+			}
+			fmt.Fprintf(os.Stderr, "%s Indexed JSON Lines records (added: %d, updated: %d).\n", ui.Green("+"), stats.Added, stats.Updated)
 		}
+		return nil
 	}
 
-	newIdx, buildErr := indexer.BuildIndex(*targetDir, oldIdx)
-	if buildErr != nil {
-		fmt.Printf("%s %v\n", ui.Red("Error building/updating index:"), buildErr)
+	backend := openBackend(*indexPath, *segmented)
+	if fb, ok := backend.(*store.FileBackend); ok && len(targetDirs) > 0 && !*fromStdin && *jsonlPath == "" {
+		// ディレクトリだけから作る場合は、読み込めない既存のファイルを作り直してよい
+		fb.RebuildOnLoadError()
+	}
+	err = backend.Update(applySources)
+	if errors.Is(err, store.ErrUnsupportedVersion) {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		fmt.Fprintln(os.Stderr, "Refusing to overwrite an index written by a newer version of gmi. Upgrade gmi or choose another -out path.")
 		os.Exit(1)
 	}
-
-	saveErr := store.SaveIndex(newIdx, *indexPath)
-	if saveErr != nil {
-		fmt.Printf("%s %v\n", ui.Red("Error saving index:"), saveErr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
 		os.Exit(1)
 	}
+	startBackgroundMerge(backend, *indexPath, *lockTimeout)
 	fmt.Println(ui.Green("Index built/updated and saved successfully."))
 }
 
+// startBackgroundMerge はセグメントディレクトリに併合すべきセグメントがあれば、別のプロセスでgmi mergeを始めます。
+// 併合の終わりを待たずに戻り、併合はこのプロセスがロックを解放した後に進みます。
+func startBackgroundMerge(backend store.Backend, indexPath string, lockTimeout time.Duration) {
+	segmented, ok := backend.(*segment.Backend)
+	if !ok {
+		return
+	}
+	pending, err := segmented.PendingMerges()
+	if err != nil || !pending {
+		return
+	}
+	exe, err := os.Executable()
+	if err == nil {
+		cmd := exec.Command(exe, "merge", "-index", indexPath, "-lock-timeout", lockTimeout.String())
+		if err = cmd.Start(); err == nil {
+			fmt.Fprintf(os.Stderr, "%s Merging segments in the background (pid %d).\n", ui.Cyan("▶"), cmd.Process.Pid)
+			cmd.Process.Release()
+			return
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%s could not start merging segments: %v. Run 'gmi merge -index %s' later.\n", ui.Yellow("Warning:"), err, indexPath)
+}
+
 func handleSearchCommand() {
 	searchCmd := flag.NewFlagSet("search", flag.ExitOnError)
 	indexPath := searchCmd.String("index", "myindex.idx", "Path to the index file")
 	query := searchCmd.String("q", "", "Search query (required)")
 	mode := searchCmd.String("mode", "and", "Search mode: 'and' or 'or' (default: 'and')")
+	lockTimeout := searchCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait while another gmi process is writing the index")
+	format := searchCmd.String("format", "text", "Output format: text, json, jsonl or tsv")
+	limit := searchCmd.Int("limit", 0, "Maximum number of results to show (0 for all)")
+	offset := searchCmd.Int("offset", 0, "Number of top results to skip")
+	sortSpec := searchCmd.String("sort", "score", "Sort results by "+strings.Join(searcher.SortFields, ", ")+", optionally with :asc or :desc (e.g. mtime:asc)")
+	lines := searchCmd.Bool("lines", false, "Print each matching line as path:line:col: text, like grep")
+	contextLines := searchCmd.Int("C", 0, "With -lines, show this many lines of context around each match")
+	afterLines := searchCmd.Int("A", 0, "With -lines, show this many lines after each match (overrides -C)")
+	beforeLines := searchCmd.Int("B", 0, "With -lines, show this many lines before each match (overrides -C)")
+	facetSpec := searchCmd.String("facets", "", "Comma-separated facets to count over all matches: "+strings.Join(searcher.FacetNames, ", "))
 	searchCmd.Parse(os.Args[2:])
 
 	if *query == "" {
-		fmt.Println(ui.Red("Error:"), "-q flag is required for search command.")
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-q flag is required for search command.")
 		searchCmd.Usage()
 		os.Exit(1)
 	}
 	normalizedMode := strings.ToLower(*mode)
 	if normalizedMode != "and" && normalizedMode != "or" {
-		fmt.Println(ui.Red("Error:"), "Invalid search mode. Must be 'and' or 'or'.")
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "Invalid search mode. Must be 'and' or 'or'.")
 		searchCmd.Usage()
 		os.Exit(1)
 	}
+	if *limit < 0 || *offset < 0 {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-limit and -offset must not be negative.")
+		searchCmd.Usage()
+		os.Exit(1)
+	}
+	if *offset > searcher.MaxOffset {
+		fmt.Fprintf(os.Stderr, "%s -offset must not exceed %d.\n", ui.Red("Error:"), searcher.MaxOffset)
+		os.Exit(1)
+	}
+	if _, _, err := searcher.ParseFilters(*query); err != nil {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	sortOrder, err := searcher.ParseSort(*sortSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), err)
+		searchCmd.Usage()
+		os.Exit(1)
+	}
+	facets, err := searcher.ParseFacets(*facetSpec)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), err)
+		searchCmd.Usage()
+		os.Exit(1)
+	}
+	outputFormat := strings.ToLower(*format)
+	if !slices.Contains(searchOutputFormats, outputFormat) {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "Invalid output format. Must be one of:", strings.Join(searchOutputFormats, ", "))
+		searchCmd.Usage()
+		os.Exit(1)
+	}
+	if len(facets) > 0 && outputFormat != "text" && outputFormat != "json" {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-facets can only be used with -format text or json.")
+		os.Exit(1)
+	}
+	if *contextLines < 0 || *afterLines < 0 || *beforeLines < 0 {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-A, -B and -C must not be negative.")
+		os.Exit(1)
+	}
+	if !*lines && (*contextLines > 0 || *afterLines > 0 || *beforeLines > 0) {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-A, -B and -C can only be used with -lines.")
+		os.Exit(1)
+	}
+	if *lines && (outputFormat != "text" || len(facets) > 0) {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "-lines can't be combined with -facets or a -format other than text.")
+		os.Exit(1)
+	}
+	// -Aと-Bは-Cより優先する。明示された-A 0や-B 0も-Cを打ち消すので、値ではなく指定の有無で判断する
+	before, after := *contextLines, *contextLines
+	searchCmd.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "A":
+			after = *afterLines
+		case "B":
+			before = *beforeLines
+		}
+	})
+
+	fmt.Fprintf(os.Stderr, "%s Search command: indexPath='%s', query='%s', mode='%s'\n", ui.Cyan("▶"), *indexPath, *query, normalizedMode)
+	lock, err := store.LockShared(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
 
-	fmt.Printf("%s Search command: indexPath='%s', query='%s', mode='%s'\n", ui.Cyan("▶"), *indexPath, *query, normalizedMode)
-	idx, err := store.LoadIndex(*indexPath)
+	idx, err := openBackend(*indexPath, false).Open()
 	if err != nil {
-		fmt.Printf("%s %v\n", ui.Red("Error loading index for search:"), err)
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for search:"), err)
+		switch {
+		case errors.Is(err, store.ErrCorruptIndex):
+			fmt.Fprintln(os.Stderr, "The index file is damaged. Rebuild it with the 'index' command.")
+		case errors.Is(err, store.ErrUnsupportedVersion):
+			fmt.Fprintln(os.Stderr, "The index was written by a newer version of gmi. Upgrade gmi to search it.")
+		}
 		os.Exit(1)
 	}
-	if len(idx.Docs) == 0 && idx.NextDocID == 0 {
-		fmt.Println(ui.Yellow("The index is empty or not found. Please build the index first using the 'index' command."))
+	defer idx.Close()
+	page := searchPage{query: *query, mode: normalizedMode, offset: *offset, limit: *limit, totalExact: true}
+	if sortOrder != (searcher.SortOrder{Field: "score"}) {
+		page.sort = sortOrder.String()
+	}
+	if idx.NumDocs() == 0 {
+		fmt.Fprintln(os.Stderr, ui.Yellow("The index is empty or not found. Please build the index first using the 'index' command."))
+		if outputFormat == "text" {
+			return
+		}
+	} else {
+		found := searcher.SearchPage(idx, *query, normalizedMode, searcher.SearchOptions{Limit: *limit, Offset: *offset, Facets: facets, Sort: sortOrder, Log: os.Stderr})
+		if found.Err != nil {
+			// エラーはSearchPageが標準エラー出力に書き出している。一致なしと区別できるよう失敗で終わる
+			os.Exit(1)
+		}
+		page.results, page.total, page.totalExact, page.facets = found.Results, found.Total, found.TotalExact, found.Facets
+	}
+
+	if outputFormat != "text" {
+		if err := writeSearchResults(os.Stdout, outputFormat, page); err != nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error writing results:"), err)
+			os.Exit(1)
+		}
 		return
 	}
+	if *lines {
+		printMatchLines(os.Stdout, idx, page.results, before, after, term.IsTerminal(int(os.Stdout.Fd())))
+		return
+	}
+	printSearchResults(os.Stdout, page)
+}
+
+func handleServeCommand() {
+	serveCmd := flag.NewFlagSet("serve", flag.ExitOnError)
+	indexPath := serveCmd.String("index", "myindex.idx", "Path to the index file or segment directory")
+	addr := serveCmd.String("addr", "localhost:8080", "Address to listen on")
+	lockTimeout := serveCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait while another gmi process is writing the index")
+	serveCmd.Parse(os.Args[2:])
+
+	// 開いている間だけ共有ロックを持つ。開いた後はメモリマップが古い版を指し続けるので、
+	// サーバーの動作中もindexで更新でき、再起動すると新しい版が読み込まれる
+	lock, err := store.LockShared(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	idx, err := openBackend(*indexPath, false).Open()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for serving:"), err)
+		os.Exit(1)
+	}
 
-	searchResults := searcher.Search(idx, *query, normalizedMode)
+	srv := &http.Server{Addr: *addr, Handler: server.New(idx, *indexPath), ReadHeaderTimeout: 10 * time.Second}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	// ListenAndServeはShutdownが始まるとすぐに戻るので、処理中のリクエストが終わるのを待ってからインデックスを閉じる
+	drained := make(chan error, 1)
+	go func() {
+		<-stop
+		fmt.Fprintln(os.Stderr, "Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		drained <- srv.Shutdown(ctx)
+	}()
 
-	if len(searchResults) == 0 {
-		fmt.Println(ui.Yellow("No documents found matching your query."))
+	fmt.Fprintf(os.Stderr, "%s Serving %d document(s) from %s on http://%s\n", ui.Green("✔"), idx.NumDocs(), *indexPath, *addr)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		idx.Close()
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	if err := <-drained; err != nil {
+		// まだ動いているハンドラがメモリマップを読んでいるかもしれないので、インデックスは閉じずに終了する
+		fmt.Fprintf(os.Stderr, "%s some requests did not finish before shutdown: %v\n", ui.Yellow("Warning:"), err)
 		return
 	}
+	idx.Close()
+}
 
-	fmt.Printf("%s Found %d document(s) matching query (mode: %s):\n", ui.Green("✔"), len(searchResults), normalizedMode)
-	for i, res := range searchResults {
-		fmt.Printf("%d. File: %s (DocID: %d, Score: %.4f)\n", i+1, res.Document.Path, res.Document.ID, res.Score)
+func handleShellCommand() {
+	shellCmd := flag.NewFlagSet("shell", flag.ExitOnError)
+	indexPath := shellCmd.String("index", "myindex.idx", "Path to the index file or segment directory")
+	historyPath := shellCmd.String("history", defaultHistoryPath(), "File to keep the query history in (empty to disable)")
+	lockTimeout := shellCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait while another gmi process is writing the index")
+	shellCmd.Parse(os.Args[2:])
 
-		var termDetails []string
-		foundTermsInDoc := []string{}
-		for term := range res.QueryTermPositions {
-			foundTermsInDoc = append(foundTermsInDoc, term)
-		}
-		sort.Strings(foundTermsInDoc)
+	// serveと同じく、開いている間だけ共有ロックを持つ
+	lock, err := store.LockShared(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	idx, err := openBackend(*indexPath, false).Open()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for shell:"), err)
+		os.Exit(1)
+	}
+	defer idx.Close()
 
-		for _, term := range foundTermsInDoc {
-			positions := res.QueryTermPositions[term]
-			displayPositions := positions
-			if len(displayPositions) > 3 {
-				displayPositions = displayPositions[:3]
-			}
-			termDetails = append(termDetails, fmt.Sprintf("'%s' at %v", term, displayPositions))
-		}
-		if len(termDetails) > 0 {
-			fmt.Printf("   Terms: %s (TotalWordsInDoc: %d)\n", strings.Join(termDetails, "; "), res.Document.TotalWords)
-		} else {
-			fmt.Printf("   (No specific term positions for this combined result, TotalWordsInDoc: %d)\n", res.Document.TotalWords)
+	if err := newShell(idx, *indexPath, os.Stdout).run(*historyPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+}
+
+func handleTUICommand() {
+	tuiCmd := flag.NewFlagSet("tui", flag.ExitOnError)
+	indexPath := tuiCmd.String("index", "myindex.idx", "Path to the index file or segment directory")
+	lockTimeout := tuiCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait while another gmi process is writing the index")
+	tuiCmd.Parse(os.Args[2:])
+
+	lock, err := store.LockShared(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	idx, err := openBackend(*indexPath, false).Open()
+	lock.Unlock()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for tui:"), err)
+		os.Exit(1)
+	}
+	defer idx.Close()
+
+	if err := runTUI(idx); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+}
+
+// defaultHistoryPath はホームディレクトリの.gmi_historyを返します。ホームが分からなければ履歴を保存しません。
+func defaultHistoryPath() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".gmi_history")
+}
+
+func handleCheckCommand() {
+	checkCmd := flag.NewFlagSet("check", flag.ExitOnError)
+	indexPath := checkCmd.String("index", "myindex.idx", "Path to the index file or segment directory")
+	repair := checkCmd.Bool("repair", false, "Drop dangling postings and stale documents, fix what can be fixed, and rewrite the index")
+	checkFiles := checkCmd.Bool("files", true, "Also check that indexed files still exist on disk")
+	lockTimeout := checkCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait for another gmi process holding the index lock")
+	checkCmd.Parse(os.Args[2:])
+
+	if _, err := os.Stat(*indexPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	var lock *store.Lock
+	var err error
+	if *repair {
+		lock, err = store.LockExclusive(*indexPath, *lockTimeout)
+	} else {
+		lock, err = store.LockShared(*indexPath, *lockTimeout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	fmt.Fprintf(os.Stderr, "%s Check command: indexPath='%s', repair=%v\n", ui.Cyan("▶"), *indexPath, *repair)
+	backend := openBackend(*indexPath, false)
+	opts := indexer.CheckOptions{CheckFiles: *checkFiles}
+	problems, err := checkBackend(backend, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for check:"), err)
+		os.Exit(1)
+	}
+	if len(problems) == 0 {
+		fmt.Println(ui.Green("Index is consistent."))
+		return
+	}
+	printProblems(problems)
+	if !*repair {
+		fmt.Println("Run with -repair to fix these problems.")
+		os.Exit(1)
+	}
+
+	var repaired []indexer.Problem
+	err = backend.Update(func(idx *indexer.InvertedIndex) error {
+		repaired = indexer.RepairIndex(idx, opts)
+		return nil
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error repairing index:"), err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s Repaired %d problem(s).\n", ui.Green("✔"), len(repaired))
+	startBackgroundMerge(backend, *indexPath, *lockTimeout)
+
+	remaining, err := checkBackend(backend, opts)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for check:"), err)
+		os.Exit(1)
+	}
+	if len(remaining) > 0 {
+		// セグメントは書き換えないため、ポスティングの不整合はセグメントの併合か再構築でしか直らない
+		fmt.Printf("%s %d problem(s) could not be repaired in place; rebuild the index with the 'index' command.\n", ui.Yellow("Warning:"), len(remaining))
+		printProblems(remaining)
+		os.Exit(1)
+	}
+	fmt.Println(ui.Green("Index is consistent."))
+}
+
+// checkBackend はインデックス全体を読み込んで検査します。
+func checkBackend(backend store.Backend, opts indexer.CheckOptions) ([]indexer.Problem, error) {
+	idx, err := backend.Load()
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s Checking %d document(s) and %d term(s)...\n", ui.Cyan("▶"), len(idx.Docs), len(idx.Index))
+	return indexer.CheckIndex(idx, opts), nil
+}
+
+// printProblems は検査で見つかった問題を種類ごとの件数とともに表示します。
+func printProblems(problems []indexer.Problem) {
+	counts := make(map[string]int)
+	for _, p := range problems {
+		counts[p.Kind]++
+		fmt.Printf("   %s %s\n", ui.Yellow("!"), p)
+	}
+	kinds := make([]string, 0, len(counts))
+	for kind := range counts {
+		kinds = append(kinds, kind)
+	}
+	sort.Strings(kinds)
+	fmt.Printf("%s Found %d problem(s):", ui.Red("✘"), len(problems))
+	for _, kind := range kinds {
+		fmt.Printf(" %s=%d", kind, counts[kind])
+	}
+	fmt.Println()
+}
+
+func handleExportCommand() {
+	exportCmd := flag.NewFlagSet("export", flag.ExitOnError)
+	indexPath := exportCmd.String("index", "myindex.idx", "Path to the index file or segment directory")
+	format := exportCmd.String("format", "jsonl", "Export format (only 'jsonl' is supported)")
+	outPath := exportCmd.String("out", "-", "File to write the export to ('-' for stdout)")
+	lockTimeout := exportCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait while another gmi process is writing the index")
+	exportCmd.Parse(os.Args[2:])
+
+	if strings.ToLower(*format) != "jsonl" {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "unsupported export format:", *format)
+		exportCmd.Usage()
+		os.Exit(1)
+	}
+	if _, err := os.Stat(*indexPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+
+	output := os.Stdout
+	if *outPath != "-" {
+		file, err := os.Create(*outPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+			os.Exit(1)
 		}
+		defer file.Close()
+		output = file
+	}
 
-		if len(res.Snippets) > 0 {
-			for _, snippet := range res.Snippets {
-				fmt.Printf("   %s %s\n", ui.Cyan("Snippet:"), snippet)
-			}
-		} else {
-			fmt.Println("   ", ui.Dim("Snippet: [Not available]"))
+	lock, err := store.LockShared(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+
+	idx, err := openBackend(*indexPath, false).Load()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error loading index for export:"), err)
+		os.Exit(1)
+	}
+	if err := store.ExportJSONL(idx, output); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error exporting index:"), err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "%s Exported %d document(s) and %d term(s).\n", ui.Green("✔"), len(idx.Docs), len(idx.Index))
+}
+
+func handleImportCommand() {
+	importCmd := flag.NewFlagSet("import", flag.ExitOnError)
+	inPath := importCmd.String("in", "-", "JSON Lines export to import ('-' for stdin)")
+	indexPath := importCmd.String("out", "myindex.idx", "Path to write the rebuilt index file")
+	lockTimeout := importCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait for another gmi process holding the index lock")
+	importCmd.Parse(os.Args[2:])
+
+	if segment.IsSegmented(*indexPath) {
+		fmt.Fprintln(os.Stderr, ui.Red("Error:"), "import writes a single index file; -out must not be a segment directory.")
+		os.Exit(1)
+	}
+	input := os.Stdin
+	if *inPath != "-" {
+		file, err := os.Open(*inPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+			os.Exit(1)
 		}
-		if i < len(searchResults)-1 {
-			fmt.Println("   ---")
+		defer file.Close()
+		input = file
+	}
+
+	fmt.Fprintf(os.Stderr, "%s Import command: in='%s', indexPath='%s'\n", ui.Cyan("▶"), *inPath, *indexPath)
+	idx, err := store.ImportJSONL(input)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error importing export:"), err)
+		os.Exit(1)
+	}
+
+	lock, err := store.LockExclusive(*indexPath, *lockTimeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error:"), err)
+		os.Exit(1)
+	}
+	defer lock.Unlock()
+	if err := store.SaveIndex(idx, *indexPath); err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error saving index:"), err)
+		os.Exit(1)
+	}
+	fmt.Printf("%s Imported %d document(s) and %d term(s).\n", ui.Green("✔"), len(idx.Docs), len(idx.Index))
+}
+
+func handleMergeCommand() {
+	mergeCmd := flag.NewFlagSet("merge", flag.ExitOnError)
+	indexPath := mergeCmd.String("index", "myindex", "Path to the segment directory")
+	lockTimeout := mergeCmd.Duration("lock-timeout", store.DefaultLockTimeout, "How long to wait for another gmi process holding the index lock")
+	mergeCmd.Parse(os.Args[2:])
+
+	if !segment.IsSegmented(*indexPath) {
+		fmt.Fprintf(os.Stderr, "%s %s is not a segment directory.\n", ui.Red("Error:"), *indexPath)
+		os.Exit(1)
+	}
+	// 併合するセグメントの読み書きの間はロックを持たず、マニフェストを読み書きする間だけ排他ロックを取る
+	lock := func() (func(), error) {
+		l, err := store.LockExclusive(*indexPath, *lockTimeout)
+		if err != nil {
+			return nil, err
 		}
+		return func() { l.Unlock() }, nil
+	}
+	stats, err := segment.NewBackend(*indexPath).Merge(lock)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s %v\n", ui.Red("Error merging segments:"), err)
+		os.Exit(1)
+	}
+	if stats.Merges == 0 {
+		fmt.Fprintln(os.Stderr, "No segments to merge.")
+		return
 	}
+	fmt.Printf("%s Merged %d segment(s) into %d.\n", ui.Green("✔"), stats.MergedSegments, stats.Merges)
 }
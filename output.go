@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gmi/indexer"
+	"gmi/searcher"
+	"gmi/ui"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// searchOutputFormats は-formatに指定できる検索結果の出力形式です。
+var searchOutputFormats = []string{"text", "json", "jsonl", "tsv"}
+
+// searchPage は表示する検索結果の1ページです。
+type searchPage struct {
+	query      string
+	mode       string
+	results    []searcher.SearchResult
+	total      int  // ページ分割前の一致件数
+	totalExact bool // falseならtotalは下限
+	offset     int  // resultsの先頭の順位 - 1
+	limit      int  // 0なら件数の制限なし
+	facets     []searcher.Facet
+	sort       string // スコア順以外に並べた場合の並び順 (例: "mtime:desc")
+}
+
+// jsonSearchResponse はjson形式で出力する検索結果全体です。
+type jsonSearchResponse struct {
+	Query      string           `json:"query"`
+	Mode       string           `json:"mode"`
+	Total      int              `json:"total"`
+	TotalExact bool             `json:"total_exact"`
+	Offset     int              `json:"offset"`
+	Limit      int              `json:"limit"`
+	Results    []searcher.Hit   `json:"results"`
+	Facets     []searcher.Facet `json:"facets,omitempty"`
+}
+
+// printSearchResults は検索結果を人が読むための色付きテキストで書き出します。
+func printSearchResults(w io.Writer, page searchPage) {
+	searchResults := page.results
+	if page.total == 0 {
+		fmt.Fprintln(w, ui.Yellow("No documents found matching your query."))
+		return
+	}
+	if len(searchResults) == 0 {
+		fmt.Fprintf(w, "%s %d document(s) match, but there are none after offset %d.\n", ui.Yellow("!"), page.total, page.offset)
+		printFacets(w, page.facets)
+		return
+	}
+
+	found := strconv.Itoa(page.total)
+	if !page.totalExact {
+		found = "at least " + found
+	}
+	details := "mode: " + page.mode
+	if page.sort != "" {
+		details += ", sort: " + page.sort
+	}
+	if len(searchResults) < page.total || !page.totalExact {
+		fmt.Fprintf(w, "%s Found %s document(s) matching query (%s), showing %d-%d:\n",
+			ui.Green("✔"), found, details, page.offset+1, page.offset+len(searchResults))
+	} else {
+		fmt.Fprintf(w, "%s Found %s document(s) matching query (%s):\n", ui.Green("✔"), found, details)
+	}
+	for i, res := range searchResults {
+		rank := page.offset + i + 1
+		if res.Document.IsFile() {
+			fmt.Fprintf(w, "%d. File: %s (DocID: %d, Score: %.4f)\n", rank, res.Document.Path, res.Document.ID, res.Score)
+		} else {
+			fmt.Fprintf(w, "%d. Doc: %s [%s] (DocID: %d, Score: %.4f)\n", rank, res.Document.Path, res.Document.Source, res.Document.ID, res.Score)
+		}
+
+		var termDetails []string
+		foundTermsInDoc := []string{}
+		for term := range res.QueryTermPositions {
+			foundTermsInDoc = append(foundTermsInDoc, term)
+		}
+		sort.Strings(foundTermsInDoc)
+
+		for _, term := range foundTermsInDoc {
+			positions := res.QueryTermPositions[term]
+			displayPositions := positions
+			if len(displayPositions) > 3 {
+				displayPositions = displayPositions[:3]
+			}
+			termDetails = append(termDetails, fmt.Sprintf("'%s' at %v", term, displayPositions))
+		}
+		if len(termDetails) > 0 {
+			fmt.Fprintf(w, "   Terms: %s (TotalWordsInDoc: %d)\n", strings.Join(termDetails, "; "), res.Document.TotalWords)
+		} else {
+			fmt.Fprintf(w, "   (No specific term positions for this combined result, TotalWordsInDoc: %d)\n", res.Document.TotalWords)
+		}
+
+		if len(res.Snippets) > 0 {
+			for _, snippet := range res.Snippets {
+				fmt.Fprintf(w, "   %s %s\n", ui.Cyan("Snippet:"), snippet.Marked())
+			}
+		} else {
+			fmt.Fprintln(w, "   ", ui.Dim("Snippet: [Not available]"))
+		}
+		if i < len(searchResults)-1 {
+			fmt.Fprintln(w, "   ---")
+		}
+	}
+	printFacets(w, page.facets)
+}
+
+// maxFacetValues はテキスト出力で1つのファセットについて表示する値の数です。
+const maxFacetValues = 10
+
+// printFacets はファセットごとの件数を、多いものから1行にまとめて書き出します。
+func printFacets(w io.Writer, facets []searcher.Facet) {
+	if len(facets) == 0 {
+		return
+	}
+	fmt.Fprintln(w, ui.Cyan("Facets:"))
+	for _, facet := range facets {
+		var parts []string
+		for _, c := range facet.Counts[:min(len(facet.Counts), maxFacetValues)] {
+			parts = append(parts, fmt.Sprintf("%s (%d)", c.Value, c.Count))
+		}
+		if rest := len(facet.Counts) - maxFacetValues; rest > 0 {
+			parts = append(parts, ui.Dim(fmt.Sprintf("and %d more", rest)))
+		}
+		fmt.Fprintf(w, "   %s: %s\n", facet.Name, strings.Join(parts, ", "))
+	}
+}
+
+// printMatchLines は検索結果の一致した行を、grepのように"path:line:col: text"の形で書き出します。
+// 文脈の行は"path-line- text"の形で書き、文脈を表示する場合は離れた行のまとまりの間を"--"で区切ります。
+// colorがtrueなら、パスと行番号と一致した単語に色を付けます。
+func printMatchLines(w io.Writer, idx indexer.Reader, results []searcher.SearchResult, before, after int, color bool) {
+	paint := func(style func(string) string, s string) string {
+		if !color {
+			return s
+		}
+		return style(s)
+	}
+	first := true
+	for _, res := range results {
+		content, err := idx.Content(res.Document)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s could not read %s: %v\n", ui.Yellow("Warning:"), res.Document.Path, err)
+			continue
+		}
+		path := paint(ui.Cyan, res.Document.Path)
+		for _, group := range searcher.MatchLines(content, searcher.MatchSpans(res, content), before, after) {
+			if !first && (before > 0 || after > 0) {
+				fmt.Fprintln(w, "--")
+			}
+			first = false
+			for _, line := range group {
+				if line.Column == 0 {
+					fmt.Fprintf(w, "%s-%s- %s\n", path, paint(ui.Green, strconv.Itoa(line.Number)), line.Text)
+					continue
+				}
+				var text strings.Builder
+				last := 0
+				for _, m := range line.Matches {
+					text.WriteString(line.Text[last:m[0]])
+					text.WriteString(paint(func(s string) string { return ui.Bold(ui.Red(s)) }, line.Text[m[0]:m[1]]))
+					last = m[1]
+				}
+				text.WriteString(line.Text[last:])
+				fmt.Fprintf(w, "%s:%s:%d: %s\n", path, paint(ui.Green, strconv.Itoa(line.Number)), line.Column, text.String())
+			}
+		}
+	}
+}
+
+// writeSearchResults は検索結果を機械可読な形式で書き出します。
+func writeSearchResults(w io.Writer, format string, page searchPage) error {
+	bw := bufio.NewWriter(w)
+	results := page.results
+	switch format {
+	case "json":
+		response := jsonSearchResponse{Query: page.query, Mode: page.mode, Total: page.total, TotalExact: page.totalExact, Offset: page.offset, Limit: page.limit, Results: make([]searcher.Hit, len(results)), Facets: page.facets}
+		for i, res := range results {
+			response.Results[i] = searcher.NewHit(page.offset+i+1, res)
+		}
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(response); err != nil {
+			return err
+		}
+	case "jsonl":
+		enc := json.NewEncoder(bw)
+		enc.SetEscapeHTML(false)
+		for i, res := range results {
+			if err := enc.Encode(searcher.NewHit(page.offset+i+1, res)); err != nil {
+				return err
+			}
+		}
+	case "tsv":
+		fmt.Fprintln(bw, "rank\tscore\tpath\tdoc_id\tsource\tterms\tsnippet")
+		for i, res := range results {
+			r := searcher.NewHit(page.offset+i+1, res)
+			snippet := ""
+			if len(r.Snippets) > 0 {
+				snippet = r.Snippets[0].Text
+			}
+			fmt.Fprintf(bw, "%d\t%s\t%s\t%d\t%s\t%s\t%s\n", r.Rank, strconv.FormatFloat(r.Score, 'f', -1, 64),
+				tsvField(r.Path), r.DocID, r.Source, tsvTerms(r.Terms), tsvField(snippet))
+		}
+	default:
+		return fmt.Errorf("unsupported output format %q", format)
+	}
+	return bw.Flush()
+}
+
+// tsvTerms は単語ごとの出現位置を "go:0,3;index:2" の形にします。
+func tsvTerms(terms map[string][]int) string {
+	names := make([]string, 0, len(terms))
+	for term := range terms {
+		names = append(names, term)
+	}
+	sort.Strings(names)
+	parts := make([]string, len(names))
+	for i, term := range names {
+		positions := make([]string, len(terms[term]))
+		for j, pos := range terms[term] {
+			positions[j] = strconv.Itoa(pos)
+		}
+		parts[i] = term + ":" + strings.Join(positions, ",")
+	}
+	return strings.Join(parts, ";")
+}
+
+// tsvField はタブと改行を空白に置き換え、値が列や行をまたがないようにします。
+func tsvField(s string) string {
+	return strings.NewReplacer("\t", " ", "\r", " ", "\n", " ").Replace(s)
+}
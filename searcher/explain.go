@@ -0,0 +1,34 @@
+package searcher
+
+import (
+	"gmi/indexer"
+	"sort"
+)
+
+// TermScore は検索結果のスコアのうち、1つの単語が寄与した分です。
+type TermScore struct {
+	Term      string
+	Frequency int     // ドキュメント内の出現回数 (TF)
+	DocFreq   int     // 単語を含むドキュメント数
+	IDF       float64 // log(総ドキュメント数 / DocFreq)
+	Score     float64 // Frequency * IDF
+}
+
+// Explain は検索結果resのスコアを単語ごとの内訳に分解します。
+// 内訳の合計はSearchが計算したres.Scoreと一致します。
+func Explain(idx indexer.Reader, res SearchResult) ([]TermScore, error) {
+	totalDocs := idx.NumDocs()
+	scores := make([]TermScore, 0, len(res.QueryTermPositions))
+	for term, positions := range res.QueryTermPositions {
+		postings, err := idx.Postings(term)
+		if err != nil {
+			return nil, err
+		}
+		ts := TermScore{Term: term, Frequency: len(positions), DocFreq: len(postings)}
+		ts.IDF = calculateIDF(totalDocs, ts.DocFreq)
+		ts.Score = float64(ts.Frequency) * ts.IDF
+		scores = append(scores, ts)
+	}
+	sort.Slice(scores, func(i, j int) bool { return scores[i].Term < scores[j].Term })
+	return scores, nil
+}
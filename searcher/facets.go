@@ -0,0 +1,135 @@
+package searcher
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// FacetNames は集計できるファセットの名前です。
+//
+//	dir    ファイルを見つけたディレクトリからのパスの先頭のディレクトリ (直下のファイルは".")
+//	ext    拡張子 (なければ"(none)")
+//	year   最終更新日時の年
+//	month  最終更新日時の年月
+var FacetNames = []string{"dir", "ext", "year", "month"}
+
+// noFacetValue は拡張子のように値を持たないドキュメントを数える項目です。
+const noFacetValue = "(none)"
+
+// FacetCount はファセットの値1つと、その値を持つ一致ドキュメントの数です。
+type FacetCount struct {
+	Value string `json:"value"`
+	Count int    `json:"count"`
+}
+
+// Facet は1つのファセットの集計結果で、Countsは件数の多い順 (同数なら値の順) に並びます。
+type Facet struct {
+	Name   string       `json:"name"`
+	Counts []FacetCount `json:"counts"`
+}
+
+// ParseFacets は"dir,ext,year"のようなカンマ区切りのファセット名を解釈します。
+func ParseFacets(spec string) ([]string, error) {
+	var names []string
+	for _, name := range strings.Split(spec, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !slices.Contains(FacetNames, name) {
+			return nil, fmt.Errorf("unknown facet %q (want one of %s)", name, strings.Join(FacetNames, ", "))
+		}
+		if !slices.Contains(names, name) {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// facetCounter は一致したドキュメントをファセットごとに数えます。
+type facetCounter struct {
+	names  []string
+	counts []map[string]int
+}
+
+func newFacetCounter(names []string) *facetCounter {
+	c := &facetCounter{names: names, counts: make([]map[string]int, len(names))}
+	for i := range c.counts {
+		c.counts[i] = make(map[string]int)
+	}
+	return c
+}
+
+func (c *facetCounter) add(doc indexer.Document) {
+	for i, name := range c.names {
+		c.counts[i][facetValue(name, doc)]++
+	}
+}
+
+// facets は集計結果を要求された順に返します。
+func (c *facetCounter) facets() []Facet {
+	facets := make([]Facet, len(c.names))
+	for i, name := range c.names {
+		counts := make([]FacetCount, 0, len(c.counts[i]))
+		for value, n := range c.counts[i] {
+			counts = append(counts, FacetCount{Value: value, Count: n})
+		}
+		sort.Slice(counts, func(a, b int) bool {
+			if counts[a].Count != counts[b].Count {
+				return counts[a].Count > counts[b].Count
+			}
+			return counts[a].Value < counts[b].Value
+		})
+		facets[i] = Facet{Name: name, Counts: counts}
+	}
+	return facets
+}
+
+// facetValue はドキュメントがファセットnameで属する値を返します。
+func facetValue(name string, doc indexer.Document) string {
+	switch name {
+	case "dir":
+		return topLevelDir(doc)
+	case "ext":
+		ext := doc.Ext
+		if ext == "" {
+			ext = indexer.FileExt(doc.Path)
+		}
+		if ext == "" {
+			return noFacetValue
+		}
+		return ext
+	case "year":
+		if doc.LastModified.IsZero() {
+			return noFacetValue
+		}
+		return doc.LastModified.Format("2006")
+	case "month":
+		if doc.LastModified.IsZero() {
+			return noFacetValue
+		}
+		return doc.LastModified.Format("2006-01")
+	}
+	return noFacetValue
+}
+
+// topLevelDir はドキュメントのパスの先頭のディレクトリを返します。
+// ファイルはそれを見つけたディレクトリからの相対パスで考え、直下にあれば"."を返します。
+func topLevelDir(doc indexer.Document) string {
+	path := doc.Path
+	if doc.Root != "" {
+		if rel, err := filepath.Rel(doc.Root, doc.Path); err == nil {
+			path = rel
+		}
+	}
+	path = strings.TrimLeft(filepath.ToSlash(filepath.Clean(path)), "/")
+	dir, _, found := strings.Cut(path, "/")
+	if !found {
+		return "."
+	}
+	return dir
+}
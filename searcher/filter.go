@@ -0,0 +1,193 @@
+package searcher
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// filterKeys はクエリ中でメタデータの条件として扱う"key:value"のキーです。
+var filterKeys = []string{"path", "ext", "modified", "size"}
+
+// ParseFilters はクエリからpath:, ext:, modified:, size:の条件を取り除き、残りの検索語と、
+// 全ての条件を満たすドキュメントだけを通す関数を返します。条件がなければ関数はnilです。
+//
+//	path:docs/**       パスのグロブ (*は/をまたがず、**はまたぐ)。ルートからの相対パスにも一致させます
+//	ext:md             拡張子 (大文字小文字を区別しない、先頭の"."は省略可)
+//	modified:>2025-01-01  最終更新日時 (>, >=, <, <=, =、日付は2006-01-02またはRFC 3339)
+//	size:<10k          バイト数 (>, >=, <, <=, =、10kのような接尾辞も可)
+//
+// 条件は検索語のスコアには影響しません。解釈できない条件があればエラーを返しますが、残りの検索語は返します。
+func ParseFilters(query string) (string, func(indexer.Document) bool, error) {
+	var words []string
+	var filters []func(indexer.Document) bool
+	var firstErr error
+	for _, word := range strings.Fields(query) {
+		key, value, ok := strings.Cut(word, ":")
+		if !ok || !slices.Contains(filterKeys, strings.ToLower(key)) {
+			words = append(words, word)
+			continue
+		}
+		f, err := parseFilter(strings.ToLower(key), value)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("invalid filter %q: %w", word, err)
+			}
+			continue
+		}
+		filters = append(filters, f)
+	}
+	text := strings.Join(words, " ")
+	if firstErr != nil || len(filters) == 0 {
+		return text, nil, firstErr
+	}
+	return text, func(doc indexer.Document) bool {
+		for _, f := range filters {
+			if !f(doc) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// parseFilter は1つの条件を解釈します。
+func parseFilter(key, value string) (func(indexer.Document) bool, error) {
+	if value == "" {
+		return nil, fmt.Errorf("missing value")
+	}
+	switch key {
+	case "path":
+		re, err := globRegexp(value)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc indexer.Document) bool { return matchPath(re, doc) }, nil
+	case "ext":
+		want := strings.ToLower(strings.TrimPrefix(value, "."))
+		return func(doc indexer.Document) bool {
+			ext := doc.Ext
+			if ext == "" {
+				// サイズと拡張子を持たない以前のインデックスのドキュメント
+				ext = indexer.FileExt(doc.Path)
+			}
+			return ext == want
+		}, nil
+	case "size":
+		op, operand := splitComparison(value)
+		n, err := indexer.ParseSize(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc indexer.Document) bool { return compareRange(op, doc.Size, n, n) }, nil
+	case "modified":
+		op, operand := splitComparison(value)
+		start, end, err := parseTimeRange(operand)
+		if err != nil {
+			return nil, err
+		}
+		return func(doc indexer.Document) bool {
+			return compareRange(op, doc.LastModified.UnixNano(), start.UnixNano(), end.UnixNano())
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown filter key %q", key)
+}
+
+// splitComparison は">=10k"のような値を比較演算子とそれ以外に分けます。演算子がなければ"="です。
+func splitComparison(value string) (op, operand string) {
+	for _, op := range []string{">=", "<=", ">", "<", "="} {
+		if rest, ok := strings.CutPrefix(value, op); ok {
+			return op, rest
+		}
+	}
+	return "=", value
+}
+
+// compareRange は[start, end]の範囲を1つの値とみなしてvを比較します。
+// 日付のように幅のある値では、">"はその範囲より後、"="は範囲内を意味します。
+func compareRange(op string, v, start, end int64) bool {
+	switch op {
+	case ">":
+		return v > end
+	case ">=":
+		return v >= start
+	case "<":
+		return v < start
+	case "<=":
+		return v <= end
+	default:
+		return v >= start && v <= end
+	}
+}
+
+// parseTimeRange は日付 (その日の00:00から23:59:59.999999999まで、ローカル時刻) またはRFC 3339の時刻を解釈します。
+func parseTimeRange(s string) (start, end time.Time, err error) {
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, t, nil
+	}
+	return time.Time{}, time.Time{}, fmt.Errorf("invalid date %q (want YYYY-MM-DD or RFC 3339)", s)
+}
+
+// globRegexp はパスのグロブを正規表現に変換します。*と?は/に一致せず、**は/を含む任意の文字列に一致します。
+func globRegexp(glob string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(glob); i++ {
+		switch c := glob[i]; c {
+		case '*':
+			if i+1 < len(glob) && glob[i+1] == '*' {
+				i++
+				if i+1 < len(glob) && glob[i+1] == '/' {
+					// "**/"は0個以上のディレクトリに一致する
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		default:
+			// 特殊文字までをまとめて書き出し、マルチバイト文字を分断しない
+			end := i + 1
+			for end < len(glob) && glob[end] != '*' && glob[end] != '?' {
+				end++
+			}
+			b.WriteString(regexp.QuoteMeta(glob[i:end]))
+			i = end - 1
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
+
+// matchPath はドキュメントのパス、またはファイルを見つけたルートからの相対パスがグロブに一致するかを返します。
+func matchPath(re *regexp.Regexp, doc indexer.Document) bool {
+	path := filepath.ToSlash(doc.Path)
+	if re.MatchString(path) || re.MatchString(strings.TrimPrefix(path, "./")) {
+		return true
+	}
+	if doc.Root != "" {
+		if rel, err := filepath.Rel(doc.Root, doc.Path); err == nil && re.MatchString(filepath.ToSlash(rel)) {
+			return true
+		}
+	}
+	return false
+}
+
+// allOf は両方の条件を満たすドキュメントだけを通す関数を返します。aはnilでも構いません。
+func allOf(a, b func(indexer.Document) bool) func(indexer.Document) bool {
+	if a == nil {
+		return b
+	}
+	return func(doc indexer.Document) bool { return a(doc) && b(doc) }
+}
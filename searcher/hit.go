@@ -0,0 +1,38 @@
+package searcher
+
+import "gmi/indexer"
+
+// Hit は検索結果1件をJSONで出力するための形です。
+// CLIの-format jsonとHTTPサーバーで同じ形を使います。
+type Hit struct {
+	Rank       int              `json:"rank"`
+	Path       string           `json:"path"`
+	DocID      int              `json:"doc_id"`
+	Source     string           `json:"source"`
+	Score      float64          `json:"score"`
+	TotalWords int              `json:"total_words"`
+	Terms      map[string][]int `json:"terms"` // クエリの単語ごとの出現位置
+	Snippets   []Snippet        `json:"snippets"`
+}
+
+// NewHit は順位rankの検索結果からHitを作ります。
+func NewHit(rank int, res SearchResult) Hit {
+	source := res.Document.Source
+	if source == "" {
+		source = indexer.SourceFile
+	}
+	snippets := res.Snippets
+	if snippets == nil {
+		snippets = []Snippet{}
+	}
+	return Hit{
+		Rank:       rank,
+		Path:       res.Document.Path,
+		DocID:      res.Document.ID,
+		Source:     source,
+		Score:      res.Score,
+		TotalWords: res.Document.TotalWords,
+		Terms:      res.QueryTermPositions,
+		Snippets:   snippets,
+	}
+}
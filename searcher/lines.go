@@ -0,0 +1,112 @@
+package searcher
+
+import (
+	"gmi/tokenizer"
+	"sort"
+	"strings"
+)
+
+// Line は行単位の出力 (gmi search -lines) で表示する本文の1行です。
+type Line struct {
+	Number  int      // 1始まりの行番号
+	Column  int      // 行内で最初に一致した単語の1始まりのバイト位置。一致を含まない文脈の行では0
+	Text    string   // 改行を除いた行の内容
+	Matches [][2]int // Text内で一致した単語のバイトオフセット [開始, 終了)
+}
+
+// MatchSpans は検索結果の単語が本文中に現れる範囲 [開始, 終了) を、開始位置の順に返します。
+// インデックスにバイトオフセットが記録されていない単語は、本文をトークン化し直して位置から求めます。
+// 本文がインデックス作成後に変わった場合に備え、本文の範囲外や単語と一致しない範囲は除きます。
+func MatchSpans(res SearchResult, content string) [][2]int {
+	var spans [][2]int
+	var tokenOffsets []int // トークン化し直した場合の、各単語のバイトオフセット
+	for term, positions := range res.QueryTermPositions {
+		offsets := res.QueryTermOffsets[term]
+		if len(offsets) != len(positions) {
+			if tokenOffsets == nil {
+				_, tokenOffsets = tokenizer.TokenizeWithOffsets(content)
+			}
+			offsets = make([]int, 0, len(positions))
+			for _, pos := range positions {
+				if pos < len(tokenOffsets) {
+					offsets = append(offsets, tokenOffsets[pos])
+				}
+			}
+		}
+		for _, start := range offsets {
+			// 単語は英数字だけなので、小文字にしたバイト長は本文中の長さと同じ
+			end := start + len(term)
+			if start < 0 || end > len(content) || !strings.EqualFold(content[start:end], term) {
+				continue
+			}
+			spans = append(spans, [2]int{start, end})
+		}
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i][0] < spans[j][0] })
+	return spans
+}
+
+// MatchLines はcontentのうちspansを含む行を、その前before行と後after行の文脈とともに返します。
+// 連続する行 (文脈が重なる場合を含む) を1つのグループにまとめ、グループの列を行番号の順に返します。
+func MatchLines(content string, spans [][2]int, before, after int) [][]Line {
+	if len(spans) == 0 {
+		return nil
+	}
+	// 各行の開始位置。本文が改行で終わる場合、その後ろの空の行は数えない
+	starts := []int{0}
+	for i := 0; i < len(content); i++ {
+		if content[i] == '\n' && i+1 < len(content) {
+			starts = append(starts, i+1)
+		}
+	}
+	lineOf := func(offset int) int {
+		return sort.Search(len(starts), func(i int) bool { return starts[i] > offset }) - 1
+	}
+	lineText := func(n int) (start int, text string) {
+		start = starts[n]
+		end := len(content)
+		if n+1 < len(starts) {
+			end = starts[n+1]
+		}
+		return start, strings.TrimRight(content[start:end], "\r\n")
+	}
+
+	var groups [][]Line
+	var group []Line
+	last := -1 // groupに追加した最後の行。後ろの文脈は次の一致の行の手前で止めるので、一致の行は常にlastより後
+	for i := 0; i < len(spans); {
+		n := lineOf(spans[i][0])
+		from := max(n-before, last+1, 0)
+		if group != nil && from > last+1 {
+			groups = append(groups, group)
+			group = nil
+		}
+		for c := from; c < n; c++ {
+			_, text := lineText(c)
+			group = append(group, Line{Number: c + 1, Text: text})
+		}
+		start, text := lineText(n)
+		line := Line{Number: n + 1, Text: text}
+		for ; i < len(spans) && lineOf(spans[i][0]) == n; i++ {
+			s, e := spans[i][0]-start, min(spans[i][1]-start, len(text))
+			if len(line.Matches) > 0 && s < line.Matches[len(line.Matches)-1][1] {
+				continue // 重なった範囲
+			}
+			line.Matches = append(line.Matches, [2]int{s, e})
+		}
+		line.Column = line.Matches[0][0] + 1
+		group = append(group, line)
+		last = n
+		// 後ろの文脈は次の一致の行の手前まで
+		next := len(starts)
+		if i < len(spans) {
+			next = lineOf(spans[i][0])
+		}
+		for c := n + 1; c <= n+after && c < next; c++ {
+			_, text := lineText(c)
+			group = append(group, Line{Number: c + 1, Text: text})
+			last = c
+		}
+	}
+	return append(groups, group)
+}
@@ -1,22 +1,47 @@
 package searcher
 
 import (
+	"container/heap"
+	"errors"
 	"fmt"
 	"gmi/indexer"
 	"gmi/tokenizer"
+	"io"
 	"math"
 	"os"
 	"regexp"
-	"sort"
 	"strings"
+	"unicode/utf8"
 )
 
 // SearchResult は検索結果の1つのアイテムを表します。
 type SearchResult struct {
 	Document           indexer.Document
 	QueryTermPositions map[string][]int // key: 検索クエリのトークン, value: そのトークンの出現位置リスト
+	QueryTermOffsets   map[string][]int // 出現位置ごとの本文中のバイトオフセット (インデックスに記録されていなければnil)
 	Score              float64          // TF-IDFスコア
-	Snippets           []string         // キーワード周辺のスニペット
+	Snippets           []Snippet        // キーワード周辺のスニペット
+}
+
+// Snippet はキーワード周辺の本文の抜粋です。
+type Snippet struct {
+	Text       string   `json:"text"`       // 抜粋 (省略を表す"... "などを含む)
+	Highlights [][2]int `json:"highlights"` // Text内でキーワードに一致した箇所のバイトオフセット [開始, 終了)
+}
+
+// Marked はハイライト箇所を**で囲んだ表示用の文字列を返します。
+func (s Snippet) Marked() string {
+	var b strings.Builder
+	last := 0
+	for _, h := range s.Highlights {
+		b.WriteString(s.Text[last:h[0]])
+		b.WriteString("**")
+		b.WriteString(s.Text[h[0]:h[1]])
+		b.WriteString("**")
+		last = h[1]
+	}
+	b.WriteString(s.Text[last:])
+	return b.String()
 }
 
 const (
@@ -24,24 +49,24 @@ const (
 	maxSnippetsPerDoc   = 2 // 1ドキュメントあたり表示するスニペットの最大数
 )
 
-func generateSnippet(docContent string, keywordToHighlight string, positionsInDoc []int) string {
+func generateSnippet(docContent string, keywordToHighlight string, positionsInDoc []int) Snippet {
 	if len(positionsInDoc) == 0 {
-		return ""
+		return Snippet{}
 	}
 
 	words := strings.Fields(docContent) // strings.Fieldsは空白文字で分割
 	if len(words) == 0 {
-		return ""
+		return Snippet{}
 	}
 
 	re, err := regexp.Compile(`(?i)\b` + regexp.QuoteMeta(keywordToHighlight) + `\b`)
 	if err != nil {
-		return "[Error compiling regex for snippet]"
+		return Snippet{Text: "[Error compiling regex for snippet]"}
 	}
 
 	matches := re.FindAllStringIndex(docContent, -1) // 全てのマッチ位置(バイトオフセット)
 	if len(matches) == 0 {
-		return "[Keyword not found in content for snippet]" // 理論上ここには来ないはず
+		return Snippet{Text: "[Keyword not found in content for snippet]"} // 理論上ここには来ないはず
 	}
 
 	firstMatchStart := matches[0][0]
@@ -55,8 +80,10 @@ func generateSnippet(docContent string, keywordToHighlight string, positionsInDo
 	if endOffset > len(docContent) {
 		endOffset = len(docContent)
 	}
+	// マルチバイト文字の途中で切ると不正なUTF-8になり、JSONでU+FFFDに置き換えられてハイライトの位置がずれる
+	startOffset = runeStart(docContent, startOffset)
+	endOffset = runeStart(docContent, endOffset)
 	rawSnippet := docContent[startOffset:endOffset]
-	highlightedSnippet := re.ReplaceAllString(rawSnippet, `**$0**`)
 
 	prefix := ""
 	if startOffset > 0 {
@@ -67,7 +94,19 @@ func generateSnippet(docContent string, keywordToHighlight string, positionsInDo
 		suffix = " ..."
 	}
 
-	return prefix + highlightedSnippet + suffix
+	snippet := Snippet{Text: prefix + rawSnippet + suffix}
+	for _, m := range re.FindAllStringIndex(rawSnippet, -1) {
+		snippet.Highlights = append(snippet.Highlights, [2]int{len(prefix) + m[0], len(prefix) + m[1]})
+	}
+	return snippet
+}
+
+// runeStart はoffsetがマルチバイト文字の途中なら、その文字の先頭まで戻した位置を返します。
+func runeStart(s string, offset int) int {
+	for offset > 0 && offset < len(s) && !utf8.RuneStart(s[offset]) {
+		offset--
+	}
+	return offset
 }
 
 // calculateIDF calculates the Inverse Document Frequency for a term.
@@ -80,37 +119,123 @@ func calculateIDF(totalDocuments int, docsContainingTerm int) float64 {
 	return math.Log(float64(totalDocuments) / float64(docsContainingTerm))
 }
 
-// Searchは指定されたインデックス内でクエリに一致するドキュメントを検索します
-func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResult {
-	var finalResults []SearchResult
+// SearchOptions は検索結果のうち実際に作るページと、対象にするドキュメントを指定します。
+type SearchOptions struct {
+	Limit  int                             // 返す件数。0なら一致した全件
+	Offset int                             // スコア順で先頭から読み飛ばす件数
+	Filter func(doc indexer.Document) bool // nilでなければ、trueを返したドキュメントだけを対象にする
+	Facets []string                        // 一致した全ドキュメントについて集計するファセット (FacetNames)
+	Sort   SortOrder                       // 結果の並び順。ゼロ値はスコアの高い順
+	Log    io.Writer                       // 検索語などの進捗と警告、エラーを書き出す先。nilなら何も書き出さない
+}
+
+// MaxOffset はSearchOptions.Offsetに指定できる最大値です。CLIやHTTP APIはこれを超えるオフセットを拒否します。
+const MaxOffset = 1_000_000
+
+// keep はヒープに残す件数 (Offset+Limit) を返します。
+// 巨大なOffsetでも溢れないよう、インデックスのドキュメント数を上限にします。
+func (opts SearchOptions) keep(numDocs int) int {
+	if opts.Offset >= numDocs || opts.Limit >= numDocs-opts.Offset {
+		return numDocs
+	}
+	return opts.Offset + opts.Limit
+}
+
+// logf はopts.Logがあればメッセージを書き出します。
+func (opts SearchOptions) logf(format string, args ...any) {
+	if opts.Log != nil {
+		fmt.Fprintf(opts.Log, format, args...)
+	}
+}
+
+// Page はSearchPageが返す検索結果の1ページです。
+type Page struct {
+	Results []SearchResult
+	Total   int // ページ分割前の一致件数
+	// TotalExact がfalseの場合、WANDで上位に入りえないドキュメントを数えずに読み飛ばしたため、
+	// Totalは実際の一致件数の下限です。
+	TotalExact bool
+	Facets     []Facet // SearchOptions.Facetsを指定した場合の、ページ分割前の全一致ドキュメントの集計
+	Err        error   // 検索できなかった場合 (解釈できない条件、ポスティングの読み込みの失敗など) のエラー
+}
+
+// Searchは指定されたインデックス内でクエリに一致するドキュメントを全て検索します
+// 進捗やエラーは標準エラー出力に書き出します。
+func Search(idx indexer.Reader, query string, mode string) []SearchResult {
+	return SearchPage(idx, query, mode, SearchOptions{Log: os.Stderr}).Results
+}
 
-	if idx == nil || idx.Index == nil || idx.Docs == nil {
-		fmt.Println("Error: Index is not properly initialized.")
-		return finalResults
+// SearchPage はクエリに一致するドキュメントのうち、optsで指定したページだけを返します。
+// 上位Offset+Limit件だけをヒープに残し、SearchResultの組み立てとスニペットのための本文の読み込みは
+// 返すページのドキュメントだけで行います。
+//
+// Limitを指定したOR検索ではBlock-Max WAND (wand.go) で枝刈りし、上位に入りえないドキュメントは
+// スコアを計算せず、ポスティングのブロックも展開しません。それ以外では一致した全ドキュメントのスコアを計算します。
+// ポスティングはクエリに含まれる単語の分だけインデックスから読み込みます。
+//
+// クエリ中のpath:やsize:などの条件 (ParseFilters) はopts.Filterと合わせて、スコアの計算とスニペットの生成の前に適用します。
+// ファセットは全ての一致ドキュメントを数える必要があるため、opts.Facetsを指定するとWANDでの枝刈りは行いません。
+// スコア以外の順に並べる場合 (opts.Sort) も同様です。
+//
+// 検索できなかった場合はpage.Errにエラーを設定し、opts.Logにも書き出します。
+func SearchPage(idx indexer.Reader, query string, mode string, opts SearchOptions) (page Page) {
+	page = Page{TotalExact: true}
+	fail := func(err error) Page {
+		opts.logf("Error: %v\n", err)
+		page.Results, page.Total, page.TotalExact, page.Err = nil, 0, true, err
+		return page
+	}
+	var facets *facetCounter
+	if len(opts.Facets) > 0 {
+		facets = newFacetCounter(opts.Facets)
+		defer func() { page.Facets = facets.facets() }()
+	}
+
+	if idx == nil {
+		return fail(errors.New("index is not properly initialized"))
 	}
 
-	queryTokens := tokenizer.Tokenize(query)
+	text, filter, err := ParseFilters(query)
+	if err != nil {
+		return fail(err)
+	}
+	if filter != nil {
+		opts.Filter = allOf(opts.Filter, filter)
+	}
+
+	queryTokens := tokenizer.Tokenize(text)
 	if len(queryTokens) == 0 {
-		fmt.Println("Warning: Empty query after tokenization.")
-		return finalResults
+		opts.logf("Warning: Empty query after tokenization.\n")
+		return page
 	}
 
 	normalizedMode := strings.ToLower(mode)
-	fmt.Printf("Searching for terms (%s): %v\n", normalizedMode, queryTokens)
+	opts.logf("Searching for terms (%s): %v\n", normalizedMode, queryTokens)
+
+	if normalizedMode == "or" && opts.Limit > 0 && facets == nil && opts.Sort.byScore() {
+		ranked, err := searchTopK(idx, queryTokens, opts, &page)
+		if err != nil {
+			return fail(err)
+		}
+		page.Results = buildResults(idx, ranked, opts)
+		return page
+	}
 
-	totalDocsInIndex := len(idx.Docs)
+	totalDocsInIndex := idx.NumDocs()
 	idfScores := make(map[string]float64)
-	uniqueQueryTokens := make(map[string]bool)
+	postingsByToken := make(map[string][]indexer.Posting)
 	for _, token := range queryTokens {
-		uniqueQueryTokens[token] = true
-	}
-	for token := range uniqueQueryTokens {
-		postingsForToken, foundInIndex := idx.Index[token]
-		if foundInIndex {
-			idfScores[token] = calculateIDF(totalDocsInIndex, len(postingsForToken))
-		} else {
-			idfScores[token] = 0
+		if _, loaded := idfScores[token]; loaded {
+			continue
+		}
+		postingsForToken, err := idx.Postings(token)
+		if err != nil {
+			return fail(fmt.Errorf("could not read postings for '%s': %w", token, err))
+		}
+		if len(postingsForToken) > 0 {
+			postingsByToken[token] = postingsForToken
 		}
+		idfScores[token] = calculateIDF(totalDocsInIndex, len(postingsForToken))
 	}
 
 	intermediateResults := make(map[int]map[string]indexer.Posting)
@@ -118,7 +243,7 @@ func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResul
 	switch normalizedMode {
 	case "or":
 		for _, token := range queryTokens {
-			postings, found := idx.Index[token]
+			postings, found := postingsByToken[token]
 			if !found {
 				continue
 			}
@@ -136,10 +261,10 @@ func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResul
 		validQueryTokensForAND := []string{}
 
 		for _, token := range queryTokens {
-			postings, found := idx.Index[token]
+			postings, found := postingsByToken[token]
 			if !found {
-				fmt.Printf("Term '%s' not found in index. Cannot satisfy AND condition.\n", token)
-				return finalResults
+				opts.logf("Term '%s' not found in index. Cannot satisfy AND condition.\n", token)
+				return page
 			}
 			postingLists[token] = postings
 			validQueryTokensForAND = append(validQueryTokensForAND, token)
@@ -149,7 +274,7 @@ func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResul
 			}
 		}
 		if shortestToken == "" {
-			return finalResults
+			return page
 		} // 有効なトークンが一つもなかった
 
 		currentCandidates := make(map[int]map[string]indexer.Posting)
@@ -177,50 +302,78 @@ func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResul
 			}
 			currentCandidates = nextCandidates
 			if len(currentCandidates) == 0 {
-				return finalResults
+				return page
 			}
 		}
 		intermediateResults = currentCandidates
 	default:
-		fmt.Printf("Error: Unsupported search mode '%s'.\n", mode)
-		return finalResults
+		return fail(fmt.Errorf("unsupported search mode '%s'", mode))
 	}
 
 	if len(intermediateResults) == 0 {
-		return finalResults
+		return page
 	}
 
+	// 上位Offset+Limit件だけを、最も順位の低いものが先頭に来るヒープに残す
+	keep := opts.keep(totalDocsInIndex)
+	top := &scoredDocHeap{order: opts.Sort}
 	for docID, termPostingMap := range intermediateResults {
-		doc, docExists := idx.Docs[docID]
+		doc, docExists := idx.Document(docID)
 		if !docExists {
 			continue
 		}
+		if opts.Filter != nil && !opts.Filter(doc) {
+			continue
+		}
+		page.Total++
+		if facets != nil {
+			facets.add(doc)
+		}
 
 		currentDocScore := 0.0
-		queryTermPositionsForThisDoc := make(map[string][]int)
-
 		for queryToken, posting := range termPostingMap {
 			tf := float64(posting.Frequency)
 			idf := idfScores[queryToken]
 			currentDocScore += tf * idf
+		}
+		top.offer(scoredDoc{doc: doc, score: currentDocScore, postings: termPostingMap}, opts.Limit <= 0, keep)
+	}
+
+	page.Results = buildResults(idx, top.ranked(opts.Offset), opts)
+	return page
+}
+
+// buildResults はページに載せるドキュメントのSearchResultを、スニペットを生成して組み立てます。
+func buildResults(idx indexer.Reader, ranked []scoredDoc, opts SearchOptions) []SearchResult {
+	var finalResults []SearchResult
+	for _, candidate := range ranked {
+		doc, termPostingMap := candidate.doc, candidate.postings
+		queryTermPositionsForThisDoc := make(map[string][]int)
+		var queryTermOffsetsForThisDoc map[string][]int
+		for queryToken, posting := range termPostingMap {
 			queryTermPositionsForThisDoc[queryToken] = posting.Positions
+			if posting.Offsets != nil {
+				if queryTermOffsetsForThisDoc == nil {
+					queryTermOffsetsForThisDoc = make(map[string][]int)
+				}
+				queryTermOffsetsForThisDoc[queryToken] = posting.Offsets
+			}
 		}
 
 		// スニペット生成
-		var snippets []string
-		docContentBytes, err := os.ReadFile(doc.Path)
+		var snippets []Snippet
+		docContent, err := idx.Content(doc)
 		if err != nil {
-			fmt.Printf("Warning: Could not read file %s to generate snippet: %v\n", doc.Path, err)
-			snippets = append(snippets, "[Could not load content for snippet]")
+			opts.logf("Warning: Could not load content of %s to generate snippet: %v\n", doc.Path, err)
+			snippets = append(snippets, Snippet{Text: "[Could not load content for snippet]"})
 		} else {
-			docContent := string(docContentBytes)
 			generatedSnippetsCount := 0
 			for term := range termPostingMap {
 				if generatedSnippetsCount >= maxSnippetsPerDoc {
 					break
 				}
 				snippet := generateSnippet(docContent, term, termPostingMap[term].Positions)
-				if snippet != "" {
+				if snippet.Text != "" {
 					snippets = append(snippets, snippet)
 					generatedSnippetsCount++
 				}
@@ -230,21 +383,65 @@ func Search(idx *indexer.InvertedIndex, query string, mode string) []SearchResul
 				if len(docContent) < limit {
 					limit = len(docContent)
 				}
-				snippets = append(snippets, strings.TrimSpace(docContent[:limit])+"...")
+				limit = runeStart(docContent, limit)
+				snippets = append(snippets, Snippet{Text: strings.TrimSpace(docContent[:limit]) + "..."})
 			}
 		}
 
 		finalResults = append(finalResults, SearchResult{
 			Document:           doc,
 			QueryTermPositions: queryTermPositionsForThisDoc,
-			Score:              currentDocScore,
+			QueryTermOffsets:   queryTermOffsetsForThisDoc,
+			Score:              candidate.score,
 			Snippets:           snippets,
 		})
 	}
+	return finalResults
+}
 
-	sort.Slice(finalResults, func(i, j int) bool {
-		return finalResults[i].Score > finalResults[j].Score
-	})
+// scoredDoc はスコアを計算済みで、まだSearchResultにしていない検索結果です。
+type scoredDoc struct {
+	doc      indexer.Document
+	score    float64
+	postings map[string]indexer.Posting
+}
 
-	return finalResults
+// scoredDocHeap はorderで最も順位の低い結果が先頭に来るヒープです (container/heap用)。
+type scoredDocHeap struct {
+	docs  []scoredDoc
+	order SortOrder
+}
+
+func (h *scoredDocHeap) Len() int           { return len(h.docs) }
+func (h *scoredDocHeap) Less(i, j int) bool { return h.order.compare(h.docs[i], h.docs[j]) > 0 }
+func (h *scoredDocHeap) Swap(i, j int)      { h.docs[i], h.docs[j] = h.docs[j], h.docs[i] }
+func (h *scoredDocHeap) Push(x any)         { h.docs = append(h.docs, x.(scoredDoc)) }
+func (h *scoredDocHeap) Pop() any {
+	x := h.docs[len(h.docs)-1]
+	h.docs = h.docs[:len(h.docs)-1]
+	return x
+}
+
+// offer はヒープに空きがあるか、dが最も順位の低い結果より上位ならdを残します。
+// unboundedならkeepに関係なく全て残します。
+func (h *scoredDocHeap) offer(d scoredDoc, unbounded bool, keep int) {
+	if unbounded || h.Len() < keep {
+		heap.Push(h, d)
+	} else if h.Len() > 0 && h.order.compare(d, h.docs[0]) < 0 {
+		h.docs[0] = d
+		heap.Fix(h, 0)
+	}
+}
+
+// ranked はヒープの中身を順位の高い順に並べ、先頭のoffset件を除いて返します。ヒープは空になります。
+func (h *scoredDocHeap) ranked(offset int) []scoredDoc {
+	// ヒープから取り出すと順位の低い順になるので、後ろから詰める
+	ranked := make([]scoredDoc, h.Len())
+	for i := len(ranked) - 1; i >= 0; i-- {
+		ranked[i] = heap.Pop(h).(scoredDoc)
+	}
+	if offset >= len(ranked) {
+		return nil
+	}
+	return ranked[offset:]
 }
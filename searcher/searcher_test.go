@@ -1,6 +1,16 @@
 package searcher
 
-import "testing"
+import (
+	"fmt"
+	"gmi/indexer"
+	"math"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
 
 func Test_generateSnippet(t *testing.T) {
 	tests := []struct {
@@ -9,17 +19,401 @@ func Test_generateSnippet(t *testing.T) {
 		docContent         string
 		keywordToHighlight string
 		positionsInDoc     []int
-		want               string
+		want               Snippet
 	}{
-		// TODO: Add test cases.
+		{
+			name:               "short document",
+			docContent:         "Go is fun. go!",
+			keywordToHighlight: "go",
+			positionsInDoc:     []int{0, 3},
+			want:               Snippet{Text: "Go is fun. go!", Highlights: [][2]int{{0, 2}, {11, 13}}},
+		},
+		{
+			name:               "window with ellipses",
+			docContent:         "aaaaaaaaaa bbbbbbbbbb cccccccccc dddddddddd keyword eeeeeeeeee ffffffffff gggggggggg hhhhhhhhhh",
+			keywordToHighlight: "keyword",
+			positionsInDoc:     []int{4},
+			want: Snippet{
+				Text:       "... aaaaaa bbbbbbbbbb cccccccccc dddddddddd keyword eeeeeeeeee ffffffffff gggggggggg hhhhhh ...",
+				Highlights: [][2]int{{44, 51}},
+			},
+		},
+		{
+			name:               "no positions",
+			docContent:         "anything",
+			keywordToHighlight: "anything",
+			want:               Snippet{},
+		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			got := generateSnippet(tt.docContent, tt.keywordToHighlight, tt.positionsInDoc)
-			// TODO: update the condition below to compare got with tt.want.
-			if true {
-				t.Errorf("generateSnippet() = %v, want %v", got, tt.want)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("generateSnippet() = %+v, want %+v", got, tt.want)
 			}
 		})
 	}
 }
+
+func TestSnippetKeepsMultibyteCharactersWhole(t *testing.T) {
+	content := strings.Repeat("日本語の文章", 5) + " keyword " + strings.Repeat("検索の対象", 5)
+	for shift := 0; shift < 3; shift++ {
+		doc := strings.Repeat("x", shift) + content
+		got := generateSnippet(doc, "keyword", []int{1})
+		if !utf8.ValidString(got.Text) {
+			t.Errorf("shift %d: snippet %q is not valid UTF-8", shift, got.Text)
+		}
+		if len(got.Highlights) != 1 || got.Text[got.Highlights[0][0]:got.Highlights[0][1]] != "keyword" {
+			t.Errorf("shift %d: highlights %v do not point at the keyword in %q", shift, got.Highlights, got.Text)
+		}
+	}
+}
+
+func TestSnippetMarked(t *testing.T) {
+	s := Snippet{Text: "... find me here", Highlights: [][2]int{{9, 11}}}
+	if got, want := s.Marked(), "... find **me** here"; got != want {
+		t.Errorf("Marked() = %q, want %q", got, want)
+	}
+}
+
+func TestExplainSumsToScore(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	for _, text := range []string{"go search go", "go tools", "rust search"} {
+		if _, err := idx.AddDocument(indexer.Document{Path: text, Source: indexer.SourceStdin}, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	results := Search(idx, "go search", "and")
+	if len(results) != 1 {
+		t.Fatalf("Search() returned %d results, want 1", len(results))
+	}
+	scores, err := Explain(idx, results[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(scores) != 2 || scores[0].Term != "go" || scores[0].Frequency != 2 || scores[0].DocFreq != 2 {
+		t.Fatalf("Explain() = %+v", scores)
+	}
+	sum := 0.0
+	for _, ts := range scores {
+		sum += ts.Score
+	}
+	if math.Abs(sum-results[0].Score) > 1e-9 {
+		t.Errorf("sum of term scores = %v, want %v", sum, results[0].Score)
+	}
+}
+
+func TestSearchPageMatchesFullRanking(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	texts := []string{"go", "go go", "go go go", "rust go", "go", "rust", "go go"}
+	for i, text := range texts {
+		source := indexer.SourceStdin
+		if i%2 == 1 {
+			source = indexer.SourceJSONL
+		}
+		if _, err := idx.AddDocument(indexer.Document{Path: string(rune('a' + i)), Source: source}, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := Search(idx, "go rust", "or")
+	if len(all) != len(texts) {
+		t.Fatalf("Search() returned %d results, want %d", len(all), len(texts))
+	}
+	// Offset+Limitが溢れるほど大きなオフセットでも、空のページを返す
+	for _, mode := range []string{"and", "or"} {
+		if found := SearchPage(idx, "go", mode, SearchOptions{Limit: 10, Offset: math.MaxInt}); len(found.Results) != 0 || found.Err != nil {
+			t.Errorf("%s with offset MaxInt = %+v", mode, found)
+		}
+	}
+	for offset := 0; offset <= len(all); offset++ {
+		found := SearchPage(idx, "go rust", "or", SearchOptions{Limit: 3, Offset: offset})
+		page := found.Results
+		if found.Total > len(all) || (found.TotalExact && found.Total != len(all)) {
+			t.Fatalf("offset %d: total = %d (exact: %v), want %d", offset, found.Total, found.TotalExact, len(all))
+		}
+		want := all[offset:min(offset+3, len(all))]
+		if len(page) != len(want) {
+			t.Fatalf("offset %d: got %d results, want %d", offset, len(page), len(want))
+		}
+		for i := range want {
+			if page[i].Document.ID != want[i].Document.ID {
+				t.Errorf("offset %d: result %d is doc %d, want doc %d", offset, i, page[i].Document.ID, want[i].Document.ID)
+			}
+		}
+	}
+	// 同じスコアならドキュメントIDの小さい方が上位
+	if all[len(all)-2].Document.ID != 0 || all[len(all)-1].Document.ID != 4 {
+		t.Errorf("ties not ordered by doc ID: %v, %v", all[len(all)-2].Document.ID, all[len(all)-1].Document.ID)
+	}
+
+	onlyJSONL := func(doc indexer.Document) bool { return doc.Source == indexer.SourceJSONL }
+	found := SearchPage(idx, "go", "and", SearchOptions{Limit: 1, Filter: onlyJSONL})
+	if found.Total != 2 || !found.TotalExact || len(found.Results) != 1 || found.Results[0].Document.Source != indexer.SourceJSONL {
+		t.Errorf("filtered page = %d results of %d, want 1 of 2", len(found.Results), found.Total)
+	}
+}
+
+func TestWANDMatchesExhaustiveRanking(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	for i := 0; i < 2000; i++ {
+		// "common"はほぼ全てのドキュメントに1回、"rare"は一部のドキュメントに何回か現れる
+		text := "common filler"
+		if i%37 == 0 {
+			text += strings.Repeat(" rare", 1+i%5)
+		}
+		if i%500 == 0 {
+			text += strings.Repeat(" common", 3)
+		}
+		if _, err := idx.AddDocument(indexer.Document{Path: fmt.Sprintf("doc%d", i), Source: indexer.SourceStdin}, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	all := Search(idx, "common rare", "or")
+	found := SearchPage(idx, "common rare", "or", SearchOptions{Limit: 10, Offset: 5})
+	if len(found.Results) != 10 {
+		t.Fatalf("SearchPage() returned %d results, want 10", len(found.Results))
+	}
+	for i, res := range found.Results {
+		want := all[5+i]
+		if res.Document.ID != want.Document.ID || math.Abs(res.Score-want.Score) > 1e-9 {
+			t.Errorf("result %d = doc %d (%v), want doc %d (%v)", i, res.Document.ID, res.Score, want.Document.ID, want.Score)
+		}
+	}
+	if found.TotalExact || found.Total >= len(all) {
+		t.Errorf("total = %d (exact: %v), want a lower bound below %d", found.Total, found.TotalExact, len(all))
+	}
+}
+
+func TestSearchWithMetadataFilters(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	day := func(s string) time.Time {
+		d, err := time.ParseInLocation("2006-01-02", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d.Add(12 * time.Hour)
+	}
+	docs := []struct {
+		path     string
+		size     int64
+		modified time.Time
+	}{
+		{"docs/guide.md", 2 << 10, day("2025-03-01")},
+		{"docs/api/ref.MD", 40 << 10, day("2024-12-31")},
+		{"src/main.go", 8 << 10, day("2025-01-01")},
+	}
+	for _, d := range docs {
+		doc := indexer.Document{Path: d.path, Source: indexer.SourceStdin, Size: d.size, LastModified: d.modified}
+		if _, err := idx.AddDocument(doc, "go search"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"go path:docs/**", []string{"docs/api/ref.MD", "docs/guide.md"}},
+		{"go path:docs/*", []string{"docs/guide.md"}},
+		{"go path:**/*.go", []string{"src/main.go"}},
+		{"go ext:md", []string{"docs/api/ref.MD", "docs/guide.md"}},
+		{"go ext:.go", []string{"src/main.go"}},
+		{"go size:<10k", []string{"docs/guide.md", "src/main.go"}},
+		{"go size:>=40k", []string{"docs/api/ref.MD"}},
+		{"go modified:>2025-01-01", []string{"docs/guide.md"}},
+		{"go modified:>=2025-01-01", []string{"docs/guide.md", "src/main.go"}},
+		{"go modified:2025-01-01", []string{"src/main.go"}},
+		{"go ext:md modified:<2025-01-01", []string{"docs/api/ref.MD"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		for _, res := range Search(idx, tt.query, "and") {
+			got = append(got, res.Document.Path)
+			// 条件はスコアに影響しない
+			if want := Search(idx, "go", "and")[0].Score; math.Abs(res.Score-want) > 1e-9 {
+				t.Errorf("%q: score = %v, want %v", tt.query, res.Score, want)
+			}
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.query, got, tt.want)
+		}
+	}
+
+	for _, query := range []string{"go size:<lots", "go modified:>yesterday", "go ext:"} {
+		if _, _, err := ParseFilters(query); err == nil {
+			t.Errorf("ParseFilters(%q) accepted an invalid filter", query)
+		}
+	}
+	if text, filter, err := ParseFilters("see http://example.com now"); err != nil || filter != nil || text != "see http://example.com now" {
+		t.Errorf("ParseFilters() treated a non-filter word as a filter: %q, %v", text, err)
+	}
+}
+
+func TestSearchPageReportsErrorsToLog(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	if _, err := idx.AddDocument(indexer.Document{Path: "a.txt", Source: indexer.SourceStdin}, "go search"); err != nil {
+		t.Fatal(err)
+	}
+	// Logを指定しなければ何も書き出さず、エラーはPage.Errで返す
+	if page := SearchPage(idx, "go size:<lots", "and", SearchOptions{}); page.Err == nil || len(page.Results) != 0 {
+		t.Errorf("invalid filter: Err = %v, %d result(s)", page.Err, len(page.Results))
+	}
+	var log strings.Builder
+	page := SearchPage(idx, "go", "xor", SearchOptions{Log: &log})
+	if page.Err == nil || !strings.Contains(log.String(), "Error: unsupported search mode") {
+		t.Errorf("unsupported mode: Err = %v, log = %q", page.Err, log.String())
+	}
+	log.Reset()
+	if page := SearchPage(idx, "go", "and", SearchOptions{Log: &log}); page.Err != nil || len(page.Results) != 1 || !strings.Contains(log.String(), "Searching for terms") {
+		t.Errorf("search: Err = %v, %d result(s), log = %q", page.Err, len(page.Results), log.String())
+	}
+}
+
+func TestFacetsCountAllMatches(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	files := []struct {
+		path     string
+		modified string
+	}{
+		{"/corpus/docs/a.md", "2024-05-01"},
+		{"/corpus/docs/api/b.md", "2025-02-01"},
+		{"/corpus/src/c.go", "2025-02-10"},
+		{"/corpus/README", "2025-03-01"},
+	}
+	for _, f := range files {
+		modified, err := time.Parse("2006-01-02", f.modified)
+		if err != nil {
+			t.Fatal(err)
+		}
+		doc := indexer.Document{Path: f.path, Root: "/corpus", LastModified: modified, Source: indexer.SourceStdin}
+		if _, err := idx.AddDocument(doc, "topic"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	page := SearchPage(idx, "topic", "or", SearchOptions{Limit: 1, Facets: []string{"dir", "ext", "month"}})
+	if len(page.Results) != 1 || page.Total != 4 || !page.TotalExact {
+		t.Fatalf("page = %d results of %d (exact: %v), want 1 of 4", len(page.Results), page.Total, page.TotalExact)
+	}
+	// 件数の多い順、同数なら値の順
+	want := []Facet{
+		{Name: "dir", Counts: []FacetCount{{"docs", 2}, {".", 1}, {"src", 1}}},
+		{Name: "ext", Counts: []FacetCount{{"md", 2}, {"(none)", 1}, {"go", 1}}},
+		{Name: "month", Counts: []FacetCount{{"2025-02", 2}, {"2024-05", 1}, {"2025-03", 1}}},
+	}
+	if !reflect.DeepEqual(page.Facets, want) {
+		t.Errorf("Facets = %+v, want %+v", page.Facets, want)
+	}
+
+	if _, err := ParseFacets("dir,color"); err == nil {
+		t.Error("ParseFacets() accepted an unknown facet")
+	}
+}
+
+func TestSearchSortOrders(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	docs := []struct {
+		path string
+		text string
+		days int
+	}{
+		{"c.md", "note note", 3},
+		{"a.md", "note", 1},
+		{"d.md", "note note note", 1},
+		{"b.md", "note", 2},
+		{"e.md", "other", 4}, // IDFが0にならないよう、一致しないドキュメントも入れる
+	}
+	for _, d := range docs {
+		doc := indexer.Document{Path: d.path, Source: indexer.SourceStdin, LastModified: base.AddDate(0, 0, d.days)}
+		if _, err := idx.AddDocument(doc, d.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{"score", []string{"d.md", "c.md", "a.md", "b.md"}},
+		{"score:asc", []string{"a.md", "b.md", "c.md", "d.md"}},
+		{"mtime", []string{"c.md", "b.md", "d.md", "a.md"}}, // 同じ日時ならスコアの高い順
+		{"mtime:asc", []string{"d.md", "a.md", "b.md", "c.md"}},
+		{"path", []string{"a.md", "b.md", "c.md", "d.md"}},
+		{"path:desc", []string{"d.md", "c.md", "b.md", "a.md"}},
+		{"size", []string{"d.md", "c.md", "a.md", "b.md"}}, // サイズは本文のバイト数
+	}
+	for _, tt := range tests {
+		order, err := ParseSort(tt.spec)
+		if err != nil {
+			t.Fatalf("ParseSort(%q) error = %v", tt.spec, err)
+		}
+		// ページに分けても、全件を並べた場合と同じ順になる
+		var got []string
+		for offset := 0; offset < 4; offset += 2 {
+			for _, res := range SearchPage(idx, "note", "or", SearchOptions{Limit: 2, Offset: offset, Sort: order}).Results {
+				got = append(got, res.Document.Path)
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("sort %q: got %v, want %v", tt.spec, got, tt.want)
+		}
+	}
+
+	for _, spec := range []string{"name", "mtime:newest"} {
+		if _, err := ParseSort(spec); err == nil {
+			t.Errorf("ParseSort(%q) accepted an invalid order", spec)
+		}
+	}
+}
+
+func TestMatchLinesWithContext(t *testing.T) {
+	content := "one\nGo here\nthree\nfour\nfive\nsix go, go\nseven\n"
+	idx := indexer.NewInvertedIndex()
+	if _, err := idx.AddDocument(indexer.Document{Path: "notes", Source: indexer.SourceStdin}, content); err != nil {
+		t.Fatal(err)
+	}
+	results := Search(idx, "go", "and")
+	if len(results) != 1 || results[0].QueryTermOffsets["go"] == nil {
+		t.Fatalf("Search() = %+v, want one result with offsets", results)
+	}
+	spans := MatchSpans(results[0], content)
+	want := [][2]int{{4, 6}, {32, 34}, {36, 38}}
+	if !reflect.DeepEqual(spans, want) {
+		t.Fatalf("MatchSpans() = %v, want %v", spans, want)
+	}
+	// オフセットを記録していないインデックスでは本文をトークン化し直して同じ範囲を求める
+	withoutOffsets := results[0]
+	withoutOffsets.QueryTermOffsets = nil
+	if got := MatchSpans(withoutOffsets, content); !reflect.DeepEqual(got, want) {
+		t.Errorf("MatchSpans() without offsets = %v, want %v", got, want)
+	}
+
+	number := func(groups [][]Line) [][]int {
+		var got [][]int
+		for _, g := range groups {
+			var ns []int
+			for _, l := range g {
+				ns = append(ns, l.Number)
+			}
+			got = append(got, ns)
+		}
+		return got
+	}
+	if got := number(MatchLines(content, spans, 0, 0)); !reflect.DeepEqual(got, [][]int{{2}, {6}}) {
+		t.Errorf("MatchLines() without context = %v", got)
+	}
+	if got := number(MatchLines(content, spans, 1, 1)); !reflect.DeepEqual(got, [][]int{{1, 2, 3}, {5, 6, 7}}) {
+		t.Errorf("MatchLines(-C 1) = %v", got)
+	}
+	// 文脈が重なる場合は1つのまとまりにする
+	groups := MatchLines(content, spans, 0, 3)
+	if got := number(groups); !reflect.DeepEqual(got, [][]int{{2, 3, 4, 5, 6, 7}}) {
+		t.Errorf("MatchLines(-A 3) = %v", got)
+	}
+	last := groups[0][4]
+	if last.Column != 5 || !reflect.DeepEqual(last.Matches, [][2]int{{4, 6}, {8, 10}}) || groups[0][1].Column != 0 {
+		t.Errorf("line 6 = %+v, line 3 = %+v", last, groups[0][1])
+	}
+}
@@ -0,0 +1,84 @@
+package searcher
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SortFields は検索結果を並べ替えられる項目です。
+//
+//	score  スコア (既定は高い順)
+//	mtime  最終更新日時 (既定は新しい順)
+//	path   パス (既定は昇順)
+//	size   バイト数 (既定は大きい順)
+var SortFields = []string{"score", "mtime", "path", "size"}
+
+// SortOrder は検索結果の並び順です。ゼロ値はスコアの高い順です。
+// 値が同じ結果はスコアの高い順、さらにドキュメントIDの小さい順に並べ、ページをまたいでも順位が変わらないようにします。
+type SortOrder struct {
+	Field     string // SortFieldsのいずれか。空ならscore
+	Ascending bool
+}
+
+// ParseSort は"mtime"や"path:desc"のような並び順を解釈します。方向を省略すると項目ごとの既定の向きになります。
+func ParseSort(spec string) (SortOrder, error) {
+	field, direction, _ := strings.Cut(strings.ToLower(strings.TrimSpace(spec)), ":")
+	if field == "" {
+		field = "score"
+	}
+	if !slices.Contains(SortFields, field) {
+		return SortOrder{}, fmt.Errorf("unknown sort field %q (want one of %s)", field, strings.Join(SortFields, ", "))
+	}
+	order := SortOrder{Field: field, Ascending: field == "path"}
+	switch direction {
+	case "":
+	case "asc":
+		order.Ascending = true
+	case "desc":
+		order.Ascending = false
+	default:
+		return SortOrder{}, fmt.Errorf("unknown sort direction %q (want asc or desc)", direction)
+	}
+	return order, nil
+}
+
+// String はParseSortで解釈できる形で並び順を返します。
+func (s SortOrder) String() string {
+	field := cmp.Or(s.Field, "score")
+	if s.Ascending {
+		return field + ":asc"
+	}
+	return field + ":desc"
+}
+
+// byScore はスコアの高い順 (ゼロ値を含む) ならtrueを返します。WANDで枝刈りできるのはこの場合だけです。
+func (s SortOrder) byScore() bool {
+	return (s.Field == "" || s.Field == "score") && !s.Ascending
+}
+
+// compare はdがoより上位なら負、下位なら正の値を返します。
+func (s SortOrder) compare(d, o scoredDoc) int {
+	var c int
+	switch s.Field {
+	case "mtime":
+		c = d.doc.LastModified.Compare(o.doc.LastModified)
+	case "path":
+		c = strings.Compare(d.doc.Path, o.doc.Path)
+	case "size":
+		c = cmp.Compare(d.doc.Size, o.doc.Size)
+	default:
+		c = cmp.Compare(d.score, o.score)
+	}
+	if !s.Ascending {
+		c = -c
+	}
+	if c == 0 {
+		c = -cmp.Compare(d.score, o.score)
+	}
+	if c == 0 {
+		c = cmp.Compare(d.doc.ID, o.doc.ID)
+	}
+	return c
+}
@@ -0,0 +1,142 @@
+package searcher
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"sort"
+)
+
+// wandTerm はWANDでたどる1単語の状態です。
+type wandTerm struct {
+	token string
+	it    indexer.PostingIterator
+	idf   float64
+	upper float64 // この単語が1つのドキュメントに与えうるスコアの上限 (最大の出現回数 * IDF)
+}
+
+// searchTopK はOR検索の上位Offset+Limit件を、Block-Max WANDで枝刈りしながらスコアの高い順に返します。
+//
+// ドキュメントはDocIDの昇順に処理します。ヒープが埋まった後は、その最下位のスコアを閾値として、
+// 単語ごとのスコアの上限の合計が閾値を超えないドキュメントは調べずに読み飛ばします (WAND)。
+// さらに候補のドキュメントを含むブロックの上限の合計でも判定し、超えなければブロックごと読み飛ばします (Block-Max)。
+// 閾値と同じスコアのドキュメントは、DocIDの大きい後からのものが下位になるので、上限が閾値と等しくても読み飛ばせます。
+//
+// pageには一致件数を数えます。読み飛ばしたドキュメントがあればpage.TotalExactをfalseにします。
+func searchTopK(idx indexer.Reader, tokens []string, opts SearchOptions, page *Page) ([]scoredDoc, error) {
+	totalDocs := idx.NumDocs()
+	var terms []*wandTerm
+	seen := make(map[string]bool)
+	for _, token := range tokens {
+		if seen[token] {
+			continue
+		}
+		seen[token] = true
+		it, err := idx.Iterator(token)
+		if err != nil {
+			return nil, fmt.Errorf("could not read postings for '%s': %w", token, err)
+		}
+		if it.Len() == 0 {
+			continue
+		}
+		idf := calculateIDF(totalDocs, it.Len())
+		terms = append(terms, &wandTerm{token: token, it: it, idf: idf, upper: float64(it.MaxFrequency()) * idf})
+	}
+
+	keep := opts.keep(totalDocs)
+	top := &scoredDocHeap{}
+	// threshold はヒープに入るためにこえる必要のあるスコアです。埋まるまではどのドキュメントも入ります。
+	threshold := func() float64 {
+		if top.Len() < keep || top.Len() == 0 {
+			return -1
+		}
+		return top.docs[0].score
+	}
+	advance := func(t *wandTerm, target int) error {
+		if err := t.it.Advance(target); err != nil {
+			return fmt.Errorf("could not read postings for '%s': %w", t.token, err)
+		}
+		return nil
+	}
+
+	for {
+		sort.Slice(terms, func(i, j int) bool { return terms[i].it.Doc() < terms[j].it.Doc() })
+		for len(terms) > 0 && terms[len(terms)-1].it.Doc() == indexer.NoMoreDocs {
+			terms = terms[:len(terms)-1]
+		}
+		if len(terms) == 0 {
+			break
+		}
+
+		// 上限を先頭から足していき、初めて閾値をこえた単語のドキュメントをピボットにする
+		theta := threshold()
+		pivot, upperSum := -1, 0.0
+		for i, t := range terms {
+			upperSum += t.upper
+			if upperSum > theta {
+				pivot = i
+				break
+			}
+		}
+		if pivot < 0 {
+			// 残りの全単語を含んでも閾値をこえない
+			page.TotalExact = false
+			break
+		}
+		pivotDoc := terms[pivot].it.Doc()
+		for pivot+1 < len(terms) && terms[pivot+1].it.Doc() == pivotDoc {
+			pivot++
+		}
+
+		// ピボット以前の単語について、pivotDocを含むブロックの上限で判定する
+		blockSum, blockEnd := 0.0, indexer.NoMoreDocs
+		for _, t := range terms[:pivot+1] {
+			last, maxFreq := t.it.BlockMax(pivotDoc)
+			blockSum += float64(maxFreq) * t.idf
+			blockEnd = min(blockEnd, last)
+		}
+		if blockSum <= theta {
+			// いずれかのブロックが終わるか、ピボットより後の単語が現れるまでは上位に入りえない
+			target := blockEnd + 1
+			if pivot+1 < len(terms) {
+				target = min(target, terms[pivot+1].it.Doc())
+			}
+			for _, t := range terms[:pivot+1] {
+				if err := advance(t, target); err != nil {
+					return nil, err
+				}
+			}
+			page.TotalExact = false
+			continue
+		}
+
+		if terms[0].it.Doc() != pivotDoc {
+			// pivotDocより前のドキュメントはピボットより前の単語しか含まず、閾値をこえない
+			for _, t := range terms[:pivot] {
+				if err := advance(t, pivotDoc); err != nil {
+					return nil, err
+				}
+			}
+			page.TotalExact = false
+			continue
+		}
+
+		// ピボット以前の単語が全てpivotDocにあるので、スコアを計算する
+		score := 0.0
+		postings := make(map[string]indexer.Posting, pivot+1)
+		for _, t := range terms[:pivot+1] {
+			p := t.it.Posting()
+			score += float64(p.Frequency) * t.idf
+			postings[t.token] = p
+		}
+		if doc, ok := idx.Document(pivotDoc); ok && (opts.Filter == nil || opts.Filter(doc)) {
+			page.Total++
+			top.offer(scoredDoc{doc: doc, score: score, postings: postings}, false, keep)
+		}
+		for _, t := range terms[:pivot+1] {
+			if err := advance(t, pivotDoc+1); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return top.ranked(opts.Offset), nil
+}
@@ -0,0 +1,89 @@
+// go-my-index/segment/backend.go
+package segment
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"gmi/store"
+	"gmi/ui"
+	"os"
+	"sort"
+)
+
+// Backend はインデックスをセグメントディレクトリに保存するstore.Backendです。
+type Backend struct {
+	dir    string
+	policy TieredMergePolicy
+}
+
+// NewBackend はdirのセグメントディレクトリを扱うBackendを作成します。併合にはDefaultMergePolicyを使います。
+func NewBackend(dir string) *Backend {
+	return &Backend{dir: dir, policy: DefaultMergePolicy}
+}
+
+// Open は全セグメントをまとめて検索するReaderを開きます。
+func (b *Backend) Open() (store.ReadCloser, error) {
+	return OpenReader(b.dir)
+}
+
+// Load は全セグメントを1つのInvertedIndexに読み込みます。
+func (b *Backend) Load() (*indexer.InvertedIndex, error) {
+	return Load(b.dir)
+}
+
+// Documents は全セグメントの有効なドキュメントをIDの昇順で返します。
+func (b *Backend) Documents() ([]indexer.Document, error) {
+	lock := dirLock(b.dir)
+	lock.Lock()
+	m, err := readManifest(b.dir)
+	lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	var all []indexer.Document
+	for _, s := range m.Segments {
+		docs, deleted, err := readSegmentDocs(b.dir, s)
+		if err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			if !deleted.Has(doc.ID) {
+				all = append(all, doc)
+			}
+		}
+	}
+	sort.Slice(all, func(i, j int) bool { return all[i].ID < all[j].ID })
+	return all, nil
+}
+
+// Update は変更を新しいセグメントとトゥームストーンとして書き込みます。
+// 併合は待たずに戻るので、必要ならPendingMergesで確かめ、別に実行します (gmi indexは別のプロセスで併合します)。
+func (b *Backend) Update(apply func(idx *indexer.InvertedIndex) error) error {
+	stats, err := Update(b.dir, apply)
+	if err != nil {
+		return fmt.Errorf("updating segmented index: %w", err)
+	}
+	if stats.Segment == "" && stats.Deleted == 0 {
+		fmt.Fprintln(os.Stderr, "No changes; no new segment written.")
+	} else {
+		fmt.Fprintf(os.Stderr, "%s Wrote %d document(s) to %s, marked %d document(s) deleted.\n", ui.Green("✔"), stats.Written, stats.Segment, stats.Deleted)
+	}
+	return nil
+}
+
+// PendingMerges は併合の方針に従って併合すべきセグメントの組があるかを返します。
+func (b *Backend) PendingMerges() (bool, error) {
+	lock := dirLock(b.dir)
+	lock.Lock()
+	m, err := readManifest(b.dir)
+	lock.Unlock()
+	if err != nil {
+		return false, err
+	}
+	return len(b.policy.FindMerges(m.Segments)) > 0, nil
+}
+
+// Merge はMergeWithLockでセグメントを併合します。
+func (b *Backend) Merge(lock func() (unlock func(), err error)) (MergeStats, error) {
+	return MergeWithLock(b.dir, b.policy, lock)
+}
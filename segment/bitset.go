@@ -0,0 +1,74 @@
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/bits"
+)
+
+// Bitset はセグメント内で削除されたドキュメントIDを記録するトゥームストーンです。
+type Bitset struct {
+	words []uint64
+}
+
+// Set はidのビットを立てます。
+func (b *Bitset) Set(id int) {
+	w := id / 64
+	for len(b.words) <= w {
+		b.words = append(b.words, 0)
+	}
+	b.words[w] |= 1 << uint(id%64)
+}
+
+// Has はidのビットが立っているかを返します。
+func (b *Bitset) Has(id int) bool {
+	w := id / 64
+	return b != nil && w < len(b.words) && b.words[w]&(1<<uint(id%64)) != 0
+}
+
+// Count は立っているビットの数を返します。
+func (b *Bitset) Count() int {
+	n := 0
+	for _, w := range b.words {
+		n += bits.OnesCount64(w)
+	}
+	return n
+}
+
+// IDs は立っているビットのidを昇順に返します。
+func (b *Bitset) IDs() []int {
+	if b == nil {
+		return nil
+	}
+	var ids []int
+	for i, w := range b.words {
+		for w != 0 {
+			ids = append(ids, i*64+bits.TrailingZeros64(w))
+			w &= w - 1
+		}
+	}
+	return ids
+}
+
+// WriteTo はビット列をリトルエンディアンの64ビット語の列として書き出します。
+func (b *Bitset) WriteTo(w io.Writer) (int64, error) {
+	buf := make([]byte, 0, len(b.words)*8)
+	for _, word := range b.words {
+		buf = binary.LittleEndian.AppendUint64(buf, word)
+	}
+	n, err := w.Write(buf)
+	return int64(n), err
+}
+
+// parseBitset はWriteToで書き出したビット列を読み込みます。
+func parseBitset(data []byte) (*Bitset, error) {
+	if len(data)%8 != 0 {
+		return nil, fmt.Errorf("tombstone file has invalid length %d", len(data))
+	}
+	b := &Bitset{words: make([]uint64, len(data)/8)}
+	for i := range b.words {
+		b.words[i] = binary.LittleEndian.Uint64(data[i*8:])
+	}
+	return b, nil
+}
@@ -0,0 +1,98 @@
+// go-my-index/segment/iterator.go
+package segment
+
+import "gmi/indexer"
+
+// mergedIterator は各セグメントのイテレータを、削除済みのドキュメントを飛ばしながらDocIDの昇順にまとめてたどります。
+// 併合後のセグメントはドキュメントIDの範囲が他と重なりうるため、常にDocが最小のセグメントを指します。
+// 出現回数の上限は各セグメントのファイルに記録された値から求めるので、ポスティングを全て展開せずに済みます。
+type mergedIterator struct {
+	parts   []iteratorPart
+	cur     int // Docが最小のpartsの添字 (全て終端なら-1)
+	docFreq int
+	maxFreq int
+}
+
+type iteratorPart struct {
+	it      indexer.PostingIterator
+	deleted *Bitset
+}
+
+// newMergedIterator はpartsをまとめたイテレータを作ります。docFreqは削除済みを除いたドキュメント数です。
+func newMergedIterator(parts []iteratorPart, docFreq int) (*mergedIterator, error) {
+	m := &mergedIterator{parts: parts, docFreq: docFreq}
+	for i := range parts {
+		m.maxFreq = max(m.maxFreq, parts[i].it.MaxFrequency())
+		if err := parts[i].skipDeleted(); err != nil {
+			return nil, err
+		}
+	}
+	m.pick()
+	return m, nil
+}
+
+// skipDeleted は削除済みでないポスティングまで進めます。
+func (p *iteratorPart) skipDeleted() error {
+	for doc := p.it.Doc(); doc != indexer.NoMoreDocs && p.deleted.Has(doc); doc = p.it.Doc() {
+		if err := p.it.Advance(doc + 1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pick はDocが最小のセグメントを選びます。
+func (m *mergedIterator) pick() {
+	m.cur = -1
+	best := indexer.NoMoreDocs
+	for i := range m.parts {
+		if doc := m.parts[i].it.Doc(); doc < best {
+			m.cur, best = i, doc
+		}
+	}
+}
+
+func (m *mergedIterator) Doc() int {
+	if m.cur < 0 {
+		return indexer.NoMoreDocs
+	}
+	return m.parts[m.cur].it.Doc()
+}
+
+func (m *mergedIterator) Posting() indexer.Posting { return m.parts[m.cur].it.Posting() }
+
+func (m *mergedIterator) Advance(target int) error {
+	if m.Doc() >= target {
+		return nil
+	}
+	for i := range m.parts {
+		p := &m.parts[i]
+		if p.it.Doc() >= target {
+			continue
+		}
+		if err := p.it.Advance(target); err != nil {
+			return err
+		}
+		if err := p.skipDeleted(); err != nil {
+			return err
+		}
+	}
+	m.pick()
+	return nil
+}
+
+func (m *mergedIterator) Len() int { return m.docFreq }
+
+func (m *mergedIterator) MaxFrequency() int { return m.maxFreq }
+
+// BlockMax は各セグメントのブロックの最後のDocIDのうち最小のものまでを1つのブロックとみなします。
+// その範囲のポスティングは各セグメントでtarget以上を含む最初のブロックに収まるため、それらの最大値が上限になります。
+func (m *mergedIterator) BlockMax(target int) (lastDocID, maxFreq int) {
+	lastDocID = indexer.NoMoreDocs
+	for i := range m.parts {
+		last, freq := m.parts[i].it.BlockMax(target)
+		lastDocID = min(lastDocID, last)
+		maxFreq = max(maxFreq, freq)
+	}
+	return lastDocID, maxFreq
+}
@@ -0,0 +1,97 @@
+package segment
+
+import (
+	"encoding/json"
+	"fmt"
+	"gmi/store"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ManifestName はセグメントディレクトリの構成を記録するファイルの名前です。
+const ManifestName = "manifest.json"
+
+// manifestVersion はマニフェストの形式のバージョンです。
+const manifestVersion = 1
+
+// Manifest はセグメントディレクトリ内の有効なセグメントの一覧です。
+// セグメントファイルとトゥームストーンは書き込み後に変更されず、
+// マニフェストを原子的に置き換えることで新しい状態に切り替わります。
+type Manifest struct {
+	Version      int           `json:"version"`
+	NextDocID    int           `json:"next_doc_id"`
+	NextSegment  int           `json:"next_segment"`
+	Generation   int           `json:"generation"`
+	StoreContent bool          `json:"store_content,omitempty"` // 新しいセグメントにファイルの本文も保存するか
+	Segments     []SegmentInfo `json:"segments"`
+}
+
+// SegmentInfo は1つのセグメントの情報です。
+type SegmentInfo struct {
+	Name       string `json:"name"`                 // セグメントファイル名 (拡張子なし)
+	Docs       int    `json:"docs"`                 // セグメントに書き込んだドキュメント数
+	Deleted    int    `json:"deleted"`              // そのうち削除されたドキュメント数
+	Tombstones string `json:"tombstones,omitempty"` // トゥームストーンのファイル名 (削除がなければ空)
+}
+
+// LiveDocs は削除されていないドキュメント数を返します。
+func (s SegmentInfo) LiveDocs() int {
+	return s.Docs - s.Deleted
+}
+
+func (s SegmentInfo) indexFile() string {
+	return s.Name + ".idx"
+}
+
+// IsSegmented はパスがセグメントディレクトリかどうかを返します。
+func IsSegmented(path string) bool {
+	_, err := os.Stat(filepath.Join(path, ManifestName))
+	return err == nil
+}
+
+// readManifest はマニフェストを読み込みます。ディレクトリやマニフェストがなければ空のものを返します。
+func readManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, ManifestName))
+	if os.IsNotExist(err) {
+		return &Manifest{Version: manifestVersion}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read manifest in %s: %w", dir, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%w: invalid manifest in %s: %v", store.ErrCorruptIndex, dir, err)
+	}
+	if m.Version > manifestVersion {
+		return nil, fmt.Errorf("%w: manifest version %d, this build reads up to version %d", store.ErrUnsupportedVersion, m.Version, manifestVersion)
+	}
+	return &m, nil
+}
+
+// writeManifest はマニフェストを原子的に置き換えます。
+func writeManifest(dir string, m *Manifest) error {
+	m.Version = manifestVersion
+	m.Generation++
+	return store.WriteFileAtomic(filepath.Join(dir, ManifestName), func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(m)
+	})
+}
+
+// readTombstones はセグメントのトゥームストーンを読み込みます。削除がなければnilを返します。
+func readTombstones(dir string, s SegmentInfo) (*Bitset, error) {
+	if s.Tombstones == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(filepath.Join(dir, s.Tombstones))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tombstones of segment %s: %w", s.Name, err)
+	}
+	b, err := parseBitset(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: segment %s: %v", store.ErrCorruptIndex, s.Name, err)
+	}
+	return b, nil
+}
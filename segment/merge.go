@@ -0,0 +1,278 @@
+// go-my-index/segment/merge.go
+package segment
+
+import (
+	"errors"
+	"fmt"
+	"gmi/indexer"
+	"gmi/store"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// TieredMergePolicy は有効なドキュメント数でセグメントを階層に分け、
+// 同じ階層にセグメントが溜まったらまとめて1つに併合する方針です。
+type TieredMergePolicy struct {
+	SegmentsPerTier    int     // 1つの階層にこの数のセグメントが溜まったら併合する
+	TierFactor         int     // 階層ごとのドキュメント数の倍率
+	MaxDeletedFraction float64 // 削除済みの割合がこれを超えたセグメントは単独でも書き直す
+}
+
+// DefaultMergePolicy は既定の併合方針です。
+var DefaultMergePolicy = TieredMergePolicy{SegmentsPerTier: 4, TierFactor: 10, MaxDeletedFraction: 0.5}
+
+// MergeStats はMergeで行った併合の件数です。
+type MergeStats struct {
+	Merges         int // 書き出したセグメントの数
+	MergedSegments int // 併合されて消えたセグメントの数
+}
+
+// FindMerges は併合すべきセグメントの組を返します。
+func (p TieredMergePolicy) FindMerges(segments []SegmentInfo) [][]SegmentInfo {
+	tiers := make(map[int][]SegmentInfo)
+	var merges [][]SegmentInfo
+	for _, s := range segments {
+		if s.Docs > 0 && float64(s.Deleted)/float64(s.Docs) > p.MaxDeletedFraction {
+			merges = append(merges, []SegmentInfo{s})
+			continue
+		}
+		tier := int(math.Log(float64(max(s.LiveDocs(), 1))) / math.Log(float64(p.TierFactor)))
+		tiers[tier] = append(tiers[tier], s)
+	}
+
+	tierKeys := make([]int, 0, len(tiers))
+	for tier := range tiers {
+		tierKeys = append(tierKeys, tier)
+	}
+	sort.Ints(tierKeys)
+	for _, tier := range tierKeys {
+		group := tiers[tier]
+		sort.Slice(group, func(i, j int) bool { return group[i].LiveDocs() < group[j].LiveDocs() })
+		for len(group) >= p.SegmentsPerTier {
+			merges = append(merges, group[:p.SegmentsPerTier])
+			group = group[p.SegmentsPerTier:]
+		}
+	}
+	return merges
+}
+
+// Merge は方針に従ってセグメントを併合します。
+//
+// 併合したセグメントの読み込みと書き出しはロックの外で行い、マニフェストの更新時に
+// 併合元のセグメントが変わっていない(途中でトゥームストーンが追加されていない)ことを確認します。
+// 変わっていた場合はその併合を捨て、次回の併合に任せます。
+func Merge(dir string, policy TieredMergePolicy) (MergeStats, error) {
+	return MergeWithLock(dir, policy, nil)
+}
+
+// MergeWithLock はMergeと同じですが、マニフェストを読み書きする間だけlockでロックを取ります。
+// 別のプロセスで併合する場合に、インデックスを更新する他のプロセスと排他するために使います。
+// lockはロックを解放する関数を返します。
+func MergeWithLock(dir string, policy TieredMergePolicy, lock func() (unlock func(), err error)) (MergeStats, error) {
+	var stats MergeStats
+	unlock, err := lockManifest(dir, lock)
+	if err != nil {
+		return stats, err
+	}
+	m, err := readManifest(dir)
+	unlock()
+	if err != nil {
+		return stats, err
+	}
+
+	for _, group := range policy.FindMerges(m.Segments) {
+		name, err := reserveSegmentName(dir, lock)
+		if err != nil {
+			return stats, err
+		}
+
+		merged, err := mergeSegments(dir, group)
+		if errors.Is(err, fs.ErrNotExist) {
+			// 並行したUpdateが併合元を書き換え、古いトゥームストーンやセグメントを消した。併合元が変わったので捨てる
+			continue
+		}
+		if err != nil {
+			return stats, err
+		}
+		info := SegmentInfo{Name: name, Docs: len(merged.Docs)}
+		if info.Docs > 0 {
+			if err := store.SaveIndex(merged, filepath.Join(dir, info.indexFile())); err != nil {
+				return stats, err
+			}
+		}
+
+		committed, err := commitMerge(dir, group, info, lock)
+		if err != nil {
+			return stats, err
+		}
+		if !committed {
+			removeFiles(dir, []string{info.indexFile()})
+			continue
+		}
+		stats.Merges++
+		stats.MergedSegments += len(group)
+	}
+	return stats, nil
+}
+
+// MergeInBackground はMergeを別のgoroutineで実行し、結果を返すチャネルを返します。
+func MergeInBackground(dir string, policy TieredMergePolicy) <-chan MergeResult {
+	done := make(chan MergeResult, 1)
+	go func() {
+		stats, err := Merge(dir, policy)
+		done <- MergeResult{Stats: stats, Err: err}
+	}()
+	return done
+}
+
+// MergeResult はMergeInBackgroundの結果です。
+type MergeResult struct {
+	Stats MergeStats
+	Err   error
+}
+
+// Load は全セグメントを削除済みのドキュメントを除いて1つのInvertedIndexに読み込みます。
+func Load(dir string) (*indexer.InvertedIndex, error) {
+	lock := dirLock(dir)
+	lock.Lock()
+	m, err := readManifest(dir)
+	lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	idx, err := mergeSegments(dir, m.Segments)
+	if err != nil {
+		return nil, err
+	}
+	idx.NextDocID = max(idx.NextDocID, m.NextDocID)
+	idx.StoreContent = m.StoreContent
+	return idx, nil
+}
+
+// mergeSegments はセグメントを読み込み、削除済みのドキュメントを除いて1つのインデックスにまとめます。
+func mergeSegments(dir string, group []SegmentInfo) (*indexer.InvertedIndex, error) {
+	merged := indexer.NewInvertedIndex()
+	for _, s := range group {
+		path := filepath.Join(dir, s.indexFile())
+		if _, err := os.Stat(path); err != nil {
+			// LoadIndexはファイルがなければ空のインデックスを返すので、先に確かめる
+			return nil, fmt.Errorf("failed to load segment %s for merging: %w", s.Name, err)
+		}
+		idx, err := store.LoadIndex(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load segment %s for merging: %w", s.Name, err)
+		}
+		deleted, err := readTombstones(dir, s)
+		if err != nil {
+			return nil, err
+		}
+		for id, doc := range idx.Docs {
+			if deleted.Has(id) {
+				continue
+			}
+			merged.Docs[id] = doc
+			if content, ok := idx.Stored[id]; ok {
+				merged.Stored[id] = content
+			}
+		}
+		for term, postings := range idx.Index {
+			for _, p := range postings {
+				if !deleted.Has(p.DocID) {
+					merged.Index[term] = append(merged.Index[term], p)
+				}
+			}
+		}
+		merged.NextDocID = max(merged.NextDocID, idx.NextDocID)
+		merged.StoreContent = merged.StoreContent || idx.StoreContent
+	}
+	for _, postings := range merged.Index {
+		sort.Slice(postings, func(i, j int) bool { return postings[i].DocID < postings[j].DocID })
+	}
+	return merged, nil
+}
+
+// commitMerge は併合元のセグメントが変わっていなければ、マニフェストで併合後のセグメントに置き換えます。
+func commitMerge(dir string, group []SegmentInfo, info SegmentInfo, lock func() (func(), error)) (bool, error) {
+	unlock, err := lockManifest(dir, lock)
+	if err != nil {
+		return false, err
+	}
+	defer unlock()
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return false, err
+	}
+	current := make(map[string]SegmentInfo, len(m.Segments))
+	for _, s := range m.Segments {
+		current[s.Name] = s
+	}
+	var obsolete []string
+	replaced := make(map[string]bool, len(group))
+	for _, s := range group {
+		if current[s.Name] != s {
+			return false, nil
+		}
+		replaced[s.Name] = true
+		obsolete = append(obsolete, s.indexFile(), s.Tombstones)
+	}
+
+	segments := make([]SegmentInfo, 0, len(m.Segments))
+	inserted := false
+	for _, s := range m.Segments {
+		if !replaced[s.Name] {
+			segments = append(segments, s)
+		} else if !inserted && info.Docs > 0 {
+			segments = append(segments, info) // 併合元の最初の位置に置いて順序を保つ
+			inserted = true
+		}
+	}
+	m.Segments = segments
+	if err := writeManifest(dir, m); err != nil {
+		return false, err
+	}
+	removeFiles(dir, obsolete)
+	return true, nil
+}
+
+// reserveSegmentName は新しいセグメント名を払い出してマニフェストに記録します。
+// 併合中に並行してUpdateが作るセグメントと名前が重ならないようにするためです。
+func reserveSegmentName(dir string, lock func() (func(), error)) (string, error) {
+	unlock, err := lockManifest(dir, lock)
+	if err != nil {
+		return "", err
+	}
+	defer unlock()
+
+	m, err := readManifest(dir)
+	if err != nil {
+		return "", err
+	}
+	name := fmt.Sprintf("seg_%06d", m.NextSegment)
+	m.NextSegment++
+	if err := writeManifest(dir, m); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+// lockManifest は同じプロセス内のdirLockを取り、lockがあればそれも取ります。戻り値は両方を解放する関数です。
+func lockManifest(dir string, lock func() (func(), error)) (func(), error) {
+	mu := dirLock(dir)
+	mu.Lock()
+	if lock == nil {
+		return mu.Unlock, nil
+	}
+	unlock, err := lock()
+	if err != nil {
+		mu.Unlock()
+		return nil, err
+	}
+	return func() {
+		unlock()
+		mu.Unlock()
+	}, nil
+}
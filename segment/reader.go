@@ -0,0 +1,206 @@
+// go-my-index/segment/reader.go
+package segment
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"gmi/store"
+	"path/filepath"
+	"sort"
+)
+
+// Reader はセグメントディレクトリ全体を1つのインデックスとして検索するためのReaderです。
+// 各セグメントをメモリマップして開き、問い合わせを全セグメントに振り分けて結果をまとめます。
+type Reader struct {
+	segments []openSegment
+	numDocs  int
+}
+
+type openSegment struct {
+	info    SegmentInfo
+	index   *store.MappedIndex
+	deleted *Bitset
+}
+
+// OpenReader はマニフェストに記録された全セグメントを開きます。
+func OpenReader(dir string) (*Reader, error) {
+	m, err := readManifest(dir)
+	if err != nil {
+		return nil, err
+	}
+	r := &Reader{}
+	for _, s := range m.Segments {
+		index, err := store.OpenMapped(filepath.Join(dir, s.indexFile()))
+		if err != nil {
+			r.Close()
+			return nil, fmt.Errorf("failed to open segment %s: %w", s.Name, err)
+		}
+		deleted, err := readTombstones(dir, s)
+		if err != nil {
+			index.Close()
+			r.Close()
+			return nil, err
+		}
+		r.segments = append(r.segments, openSegment{info: s, index: index, deleted: deleted})
+		r.numDocs += s.LiveDocs()
+	}
+	return r, nil
+}
+
+// Segments は開いているセグメントの情報を返します。
+func (r *Reader) Segments() []SegmentInfo {
+	infos := make([]SegmentInfo, len(r.segments))
+	for i, s := range r.segments {
+		infos[i] = s.info
+	}
+	return infos
+}
+
+// Postings は全セグメントから削除済みのドキュメントを除いたポスティングを集めて返します。
+func (r *Reader) Postings(term string) ([]indexer.Posting, error) {
+	var all []indexer.Posting
+	for _, s := range r.segments {
+		postings, err := s.index.Postings(term)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %w", s.info.Name, err)
+		}
+		for _, p := range postings {
+			if !s.deleted.Has(p.DocID) {
+				all = append(all, p)
+			}
+		}
+	}
+	// 併合後のセグメントはドキュメントIDの範囲が重なりうるので並べ直す
+	if !sort.SliceIsSorted(all, func(i, j int) bool { return all[i].DocID < all[j].DocID }) {
+		sort.Slice(all, func(i, j int) bool { return all[i].DocID < all[j].DocID })
+	}
+	return all, nil
+}
+
+// Iterator は全セグメントのイテレータをDocIDの昇順にまとめてたどるイテレータを返します。
+// 各セグメントのポスティングはたどった位置のブロックだけが展開され、削除済みのドキュメントは飛ばされます。
+func (r *Reader) Iterator(term string) (indexer.PostingIterator, error) {
+	var parts []iteratorPart
+	docFreq := 0
+	for i := range r.segments {
+		s := &r.segments[i]
+		it, err := s.index.Iterator(term)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %w", s.info.Name, err)
+		}
+		if it.Len() == 0 {
+			continue
+		}
+		live, err := s.liveDocFreq(term, it.Len())
+		if err != nil {
+			return nil, err
+		}
+		docFreq += live
+		parts = append(parts, iteratorPart{it: it, deleted: s.deleted})
+	}
+	return newMergedIterator(parts, docFreq)
+}
+
+// Document はドキュメントIDを持つ有効なドキュメントを探して返します。
+func (r *Reader) Document(id int) (indexer.Document, bool) {
+	for _, s := range r.segments {
+		if s.deleted.Has(id) {
+			continue
+		}
+		if doc, ok := s.index.Document(id); ok {
+			return doc, true
+		}
+	}
+	return indexer.Document{}, false
+}
+
+// NumDocs は全セグメントの有効なドキュメント数の合計を返します。
+func (r *Reader) NumDocs() int {
+	return r.numDocs
+}
+
+// Terms は全セグメントの単語をまとめて返します。
+// ドキュメント数は削除済みのドキュメントを除いた数で、有効なドキュメントに現れない単語は返しません。
+func (r *Reader) Terms(prefix string) ([]indexer.TermStat, error) {
+	docFreq := make(map[string]int)
+	for i := range r.segments {
+		s := &r.segments[i]
+		terms, err := s.index.Terms(prefix)
+		if err != nil {
+			return nil, fmt.Errorf("segment %s: %w", s.info.Name, err)
+		}
+		for _, t := range terms {
+			n, err := s.liveDocFreq(t.Term, t.DocFreq)
+			if err != nil {
+				return nil, err
+			}
+			if n > 0 {
+				docFreq[t.Term] += n
+			}
+		}
+	}
+	terms := make([]indexer.TermStat, 0, len(docFreq))
+	for term, n := range docFreq {
+		terms = append(terms, indexer.TermStat{Term: term, DocFreq: n})
+	}
+	sort.Slice(terms, func(i, j int) bool { return terms[i].Term < terms[j].Term })
+	return terms, nil
+}
+
+// Content はドキュメントを持つセグメントから本文を返します。
+func (r *Reader) Content(doc indexer.Document) (string, error) {
+	if s := r.owner(doc.ID); s != nil {
+		return s.index.Content(doc)
+	}
+	return "", fmt.Errorf("document %d not found in any segment", doc.ID)
+}
+
+// Close は全セグメントのメモリマップを解除します。
+func (r *Reader) Close() error {
+	var firstErr error
+	for _, s := range r.segments {
+		if err := s.index.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	r.segments = nil
+	return firstErr
+}
+
+// owner はドキュメントIDの有効なドキュメントを持つセグメントを返します。
+func (r *Reader) owner(id int) *openSegment {
+	for i := range r.segments {
+		s := &r.segments[i]
+		if s.deleted.Has(id) {
+			continue
+		}
+		if _, ok := s.index.Document(id); ok {
+			return s
+		}
+	}
+	return nil
+}
+
+// liveDocFreq は単語を含むドキュメントのうち削除されていないものの数を返します。
+// docFreqは単語辞書の値で、削除済みのドキュメントごとにポスティングがあるかを確かめて差し引きます。
+func (s *openSegment) liveDocFreq(term string, docFreq int) (int, error) {
+	if s.info.Deleted == 0 {
+		return docFreq, nil
+	}
+	it, err := s.index.Iterator(term)
+	if err != nil {
+		return 0, fmt.Errorf("segment %s: %w", s.info.Name, err)
+	}
+	for _, id := range s.deleted.IDs() {
+		if err := it.Advance(id); err != nil {
+			return 0, fmt.Errorf("segment %s: %w", s.info.Name, err)
+		}
+		if it.Doc() == indexer.NoMoreDocs {
+			break
+		}
+		if it.Doc() == id {
+			docFreq--
+		}
+	}
+	return docFreq, nil
+}
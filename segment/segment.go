@@ -0,0 +1,40 @@
+// go-my-index/segment/segment.go
+package segment
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"gmi/store"
+	"os"
+	"path/filepath"
+)
+
+// readSegmentDocs はセグメントの全ドキュメントとトゥームストーンを読み込みます。
+func readSegmentDocs(dir string, s SegmentInfo) ([]indexer.Document, *Bitset, error) {
+	m, err := store.OpenMapped(filepath.Join(dir, s.indexFile()))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open segment %s: %w", s.Name, err)
+	}
+	defer m.Close()
+	docs, err := m.Documents()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read documents of segment %s: %w", s.Name, err)
+	}
+	deleted, err := readTombstones(dir, s)
+	if err != nil {
+		return nil, nil, err
+	}
+	return docs, deleted, nil
+}
+
+// removeFiles は不要になったファイルを削除します。削除できなくてもインデックスの整合性には影響しません。
+func removeFiles(dir string, names []string) {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(os.Stderr, "Warning: could not remove obsolete segment file %s: %v\n", name, err)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package segment
+
+import (
+	"gmi/indexer"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func indexNote(id, text string) func(*indexer.InvertedIndex) error {
+	return func(idx *indexer.InvertedIndex) error {
+		_, err := indexer.IndexText(idx, id, indexer.SourceStdin, strings.NewReader(text))
+		return err
+	}
+}
+
+func openReader(t *testing.T, dir string) *Reader {
+	t.Helper()
+	r, err := OpenReader(dir)
+	if err != nil {
+		t.Fatalf("OpenReader() error = %v", err)
+	}
+	t.Cleanup(func() { r.Close() })
+	return r
+}
+
+func TestUpdateWritesSegmentsAndTombstones(t *testing.T) {
+	dir := t.TempDir()
+	for _, note := range []struct{ id, text string }{{"a", "go search"}, {"b", "go index"}} {
+		if _, err := Update(dir, indexNote(note.id, note.text)); err != nil {
+			t.Fatalf("Update(%s) error = %v", note.id, err)
+		}
+	}
+	stats, err := Update(dir, indexNote("a", "rust search"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Written != 1 || stats.Deleted != 1 {
+		t.Errorf("Update() stats = %+v, want 1 written and 1 deleted", stats)
+	}
+
+	r := openReader(t, dir)
+	if len(r.Segments()) != 2 {
+		t.Errorf("Segments() = %+v, want the fully deleted segment dropped", r.Segments())
+	}
+	if r.NumDocs() != 2 {
+		t.Errorf("NumDocs() = %d, want 2", r.NumDocs())
+	}
+	if postings, _ := r.Postings("go"); len(postings) != 1 {
+		t.Errorf("Postings(go) = %+v, want only document b", postings)
+	}
+	postings, _ := r.Postings("rust")
+	if len(postings) != 1 {
+		t.Fatalf("Postings(rust) = %+v, want 1", postings)
+	}
+	doc, ok := r.Document(postings[0].DocID)
+	if !ok || doc.Path != "a" {
+		t.Fatalf("Document(%d) = %+v, %v", postings[0].DocID, doc, ok)
+	}
+	if content, err := r.Content(doc); err != nil || content != "rust search" {
+		t.Errorf("Content(a) = %q, %v", content, err)
+	}
+}
+
+func TestUpdateDeletesDocuments(t *testing.T) {
+	dir := t.TempDir()
+	Update(dir, indexNote("a", "one"))
+	Update(dir, indexNote("b", "two"))
+	stats, err := Update(dir, func(idx *indexer.InvertedIndex) error {
+		return idx.DeleteDocument("a")
+	})
+	if err != nil || stats.Deleted != 1 || stats.Segment != "" {
+		t.Fatalf("Update() = %+v, %v; want only a tombstone", stats, err)
+	}
+	r := openReader(t, dir)
+	if postings, _ := r.Postings("one"); len(postings) != 0 {
+		t.Errorf("Postings(one) = %+v, want none", postings)
+	}
+	if r.NumDocs() != 1 {
+		t.Errorf("NumDocs() = %d, want 1", r.NumDocs())
+	}
+}
+
+func TestMergeCombinesTierAndDropsDeleted(t *testing.T) {
+	dir := t.TempDir()
+	words := []string{"alpha", "beta", "gamma", "delta"}
+	for _, w := range words {
+		if _, err := Update(dir, indexNote(w, w+" common")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	Update(dir, func(idx *indexer.InvertedIndex) error { return idx.DeleteDocument("beta") })
+
+	policy := TieredMergePolicy{SegmentsPerTier: 3, TierFactor: 10, MaxDeletedFraction: 0.5}
+	result := <-MergeInBackground(dir, policy)
+	if result.Err != nil {
+		t.Fatalf("Merge() error = %v", result.Err)
+	}
+	if result.Stats.Merges != 1 || result.Stats.MergedSegments != 3 {
+		t.Errorf("Merge() stats = %+v, want 3 segments merged into 1", result.Stats)
+	}
+
+	r := openReader(t, dir)
+	if len(r.Segments()) != 1 {
+		t.Errorf("Segments() = %+v, want 1", r.Segments())
+	}
+	postings, err := r.Postings("common")
+	if err != nil || len(postings) != 3 {
+		t.Fatalf("Postings(common) = %+v, %v; want 3", postings, err)
+	}
+	for i := 1; i < len(postings); i++ {
+		if postings[i-1].DocID >= postings[i].DocID {
+			t.Errorf("Postings(common) not sorted: %+v", postings)
+		}
+	}
+	if _, err := Update(dir, indexNote("epsilon", "epsilon common")); err != nil {
+		t.Fatalf("Update() after merge error = %v", err)
+	}
+	if r := openReader(t, dir); r.NumDocs() != 4 {
+		t.Errorf("NumDocs() = %d, want 4", r.NumDocs())
+	}
+}
+
+func TestBackendDocumentsSkipsDeleted(t *testing.T) {
+	b := NewBackend(t.TempDir())
+	for _, apply := range []func(*indexer.InvertedIndex) error{
+		indexNote("a", "one"),
+		indexNote("b", "two"),
+		func(idx *indexer.InvertedIndex) error { return idx.DeleteDocument("a") },
+	} {
+		if err := b.Update(apply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	docs, err := b.Documents()
+	if err != nil || len(docs) != 1 || docs[0].Path != "b" {
+		t.Errorf("Documents() = %+v, %v; want only b", docs, err)
+	}
+	idx, err := b.Load()
+	if err != nil || len(idx.Docs) != 1 || len(idx.Index["one"]) != 0 {
+		t.Errorf("Load() = %+v, %v", idx, err)
+	}
+}
+
+func TestUpdateKeepsPostingsWhenOnlyDocumentInfoChanges(t *testing.T) {
+	dir := t.TempDir()
+	Update(dir, indexNote("a", "go search"))
+	Update(dir, indexNote("b", "go index"))
+	// BuildIndexがルートやサイズだけを補う場合と同じく、本文を処理し直さずにドキュメントの情報だけを変える
+	stats, err := Update(dir, func(idx *indexer.InvertedIndex) error {
+		doc, _ := idx.FindDocument("a")
+		doc.Meta = map[string]string{"team": "infra"}
+		idx.Docs[doc.ID] = doc
+		return nil
+	})
+	if err != nil || stats.Written != 1 || stats.Deleted != 1 {
+		t.Fatalf("Update() = %+v, %v; want a to be rewritten", stats, err)
+	}
+
+	r := openReader(t, dir)
+	postings, err := r.Postings("search")
+	if err != nil || len(postings) != 1 {
+		t.Fatalf("Postings(search) = %+v, %v; want the postings of a kept", postings, err)
+	}
+	doc, ok := r.Document(postings[0].DocID)
+	if !ok || doc.Meta["team"] != "infra" {
+		t.Fatalf("Document(a) = %+v, %v; want the new metadata", doc, ok)
+	}
+	if content, err := r.Content(doc); err != nil || content != "go search" {
+		t.Errorf("Content(a) = %q, %v", content, err)
+	}
+	if postings, _ := r.Postings("go"); len(postings) != 2 {
+		t.Errorf("Postings(go) = %+v, want 2", postings)
+	}
+}
+
+func TestMergeAbandonsGroupWhoseTombstonesWereReplaced(t *testing.T) {
+	dir := t.TempDir()
+	Update(dir, func(idx *indexer.InvertedIndex) error {
+		if err := indexNote("alpha", "alpha common")(idx); err != nil {
+			return err
+		}
+		return indexNote("beta", "beta common")(idx)
+	})
+	Update(dir, indexNote("gamma", "gamma common"))
+	Update(dir, func(idx *indexer.InvertedIndex) error { return idx.DeleteDocument("beta") })
+	m, err := readManifest(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 併合がマニフェストを読んだ後で、並行したUpdateが古いトゥームストーンを消した状態
+	for _, s := range m.Segments {
+		if s.Tombstones != "" {
+			os.Remove(filepath.Join(dir, s.Tombstones))
+		}
+	}
+
+	policy := TieredMergePolicy{SegmentsPerTier: 2, TierFactor: 10, MaxDeletedFraction: 0.5}
+	stats, err := Merge(dir, policy)
+	if err != nil {
+		t.Fatalf("Merge() error = %v, want the merge abandoned", err)
+	}
+	if stats.Merges != 0 {
+		t.Errorf("Merge() stats = %+v, want no merges", stats)
+	}
+}
+
+func TestReaderIteratorSkipsDeletedAcrossSegments(t *testing.T) {
+	dir := t.TempDir()
+	Update(dir, func(idx *indexer.InvertedIndex) error {
+		for _, id := range []string{"a", "b", "c"} {
+			if err := indexNote(id, "go "+id)(idx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	Update(dir, indexNote("d", "go d"))
+	Update(dir, func(idx *indexer.InvertedIndex) error { return idx.DeleteDocument("b") })
+	Update(dir, indexNote("c", "rust c"))
+
+	r := openReader(t, dir)
+	want, err := r.Postings("go")
+	if err != nil || len(want) != 2 {
+		t.Fatalf("Postings(go) = %+v, %v; want a and d", want, err)
+	}
+	it, err := r.Iterator("go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Len() != len(want) {
+		t.Errorf("Len() = %d, want %d", it.Len(), len(want))
+	}
+	var got []int
+	for it.Doc() != indexer.NoMoreDocs {
+		got = append(got, it.Posting().DocID)
+		if err := it.Advance(it.Doc() + 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(got) != 2 || got[0] != want[0].DocID || got[1] != want[1].DocID {
+		t.Errorf("Iterator(go) visited %v, want %+v", got, want)
+	}
+
+	terms, err := r.Terms("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	docFreq := make(map[string]int)
+	for _, ts := range terms {
+		docFreq[ts.Term] = ts.DocFreq
+	}
+	if docFreq["go"] != 2 || docFreq["rust"] != 1 {
+		t.Errorf("Terms() doc freqs = %v, want go=2 rust=1", docFreq)
+	}
+	if _, ok := docFreq["b"]; ok || docFreq["a"] != 1 {
+		t.Errorf("Terms() doc freqs = %v, want b (only in a deleted document) left out", docFreq)
+	}
+}
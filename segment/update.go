@@ -0,0 +1,228 @@
+// go-my-index/segment/update.go
+package segment
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"gmi/store"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// UpdateStats はUpdateで書き込んだ変更の件数です。
+type UpdateStats struct {
+	Segment string // 新しく書き込んだセグメント (変更がなければ空)
+	Written int    // 新しいセグメントに書き込んだドキュメント数 (追加・変更)
+	Deleted int    // トゥームストーンを付けたドキュメント数 (削除・変更)
+}
+
+var (
+	dirLocksMu sync.Mutex
+	dirLocks   = make(map[string]*sync.Mutex)
+)
+
+// dirLock は同じプロセス内でマニフェストの更新を直列化するためのロックを返します。
+func dirLock(dir string) *sync.Mutex {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		abs = dir
+	}
+	dirLocksMu.Lock()
+	defer dirLocksMu.Unlock()
+	if dirLocks[abs] == nil {
+		dirLocks[abs] = &sync.Mutex{}
+	}
+	return dirLocks[abs]
+}
+
+// Update はセグメントディレクトリに変更を適用します。
+//
+// applyには、ディレクトリ内の全ての有効なドキュメントの情報だけを持ち、ポスティングを持たない
+// InvertedIndexが渡されます。applyの中でBuildIndexやAddDocumentなどを使って変更すると、
+// 追加・変更されたドキュメントだけが新しい小さなセグメントに書き込まれ、
+// 削除・変更されたドキュメントは元のセグメントのトゥームストーンに記録されます。
+// 既存のセグメントファイルは書き換えられません。
+func Update(dir string, apply func(idx *indexer.InvertedIndex) error) (UpdateStats, error) {
+	var stats UpdateStats
+	lock := dirLock(dir)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return stats, fmt.Errorf("failed to create segment directory %s: %w", dir, err)
+	}
+	m, err := readManifest(dir)
+	if err != nil {
+		return stats, err
+	}
+
+	overlay := indexer.NewInvertedIndex()
+	overlay.NextDocID = m.NextDocID
+	overlay.StoreContent = m.StoreContent
+	owner := make(map[int]int) // ドキュメントID -> m.Segmentsの添字
+	for i, s := range m.Segments {
+		docs, deleted, err := readSegmentDocs(dir, s)
+		if err != nil {
+			return stats, err
+		}
+		for _, doc := range docs {
+			if !deleted.Has(doc.ID) {
+				overlay.Docs[doc.ID] = doc
+				owner[doc.ID] = i
+			}
+		}
+	}
+	before := make(map[int]indexer.Document, len(overlay.Docs))
+	for id, doc := range overlay.Docs {
+		before[id] = doc
+	}
+
+	if err := apply(overlay); err != nil {
+		return stats, err
+	}
+
+	written := indexer.NewInvertedIndex()
+	written.NextDocID = overlay.NextDocID
+	written.Index = overlay.Index
+	written.StoreContent = overlay.StoreContent
+	tombstoned := make(map[int][]int) // m.Segmentsの添字 -> 削除するドキュメントID
+	carried := make(map[int][]int)    // m.Segmentsの添字 -> ポスティングと本文を引き継ぐドキュメントID
+	tokenized := postedDocs(overlay.Index)
+	for id, doc := range overlay.Docs {
+		old, existed := before[id]
+		if existed && reflect.DeepEqual(old, doc) {
+			continue
+		}
+		written.Docs[id] = doc
+		if content, ok := overlay.Stored[id]; ok {
+			written.Stored[id] = content
+		}
+		if existed {
+			tombstoned[owner[id]] = append(tombstoned[owner[id]], id)
+			if !tokenized[id] && old.LastModified.Equal(doc.LastModified) && old.ContentStored == doc.ContentStored {
+				// Rootやサイズなどの情報だけが変わり、本文は処理し直していない
+				carried[owner[id]] = append(carried[owner[id]], id)
+			}
+		}
+	}
+	if err := carryPostings(dir, m.Segments, carried, written); err != nil {
+		return stats, err
+	}
+	for id := range before {
+		if _, ok := overlay.Docs[id]; !ok {
+			tombstoned[owner[id]] = append(tombstoned[owner[id]], id)
+		}
+	}
+	m.NextDocID = overlay.NextDocID
+	settingsChanged := m.StoreContent != overlay.StoreContent
+	m.StoreContent = overlay.StoreContent
+	if len(written.Docs) == 0 && len(tombstoned) == 0 {
+		if m.Generation == 0 || settingsChanged {
+			return stats, writeManifest(dir, m) // 空のセグメントディレクトリとして初期化する
+		}
+		return stats, nil
+	}
+
+	var obsolete []string
+	if len(written.Docs) > 0 {
+		info := SegmentInfo{Name: fmt.Sprintf("seg_%06d", m.NextSegment), Docs: len(written.Docs)}
+		m.NextSegment++
+		if err := store.SaveIndex(written, filepath.Join(dir, info.indexFile())); err != nil {
+			return stats, err
+		}
+		m.Segments = append(m.Segments, info)
+		stats.Segment = info.Name
+		stats.Written = len(written.Docs)
+	}
+	for i, ids := range tombstoned {
+		s := &m.Segments[i]
+		deleted, err := readTombstones(dir, *s)
+		if err != nil {
+			return stats, err
+		}
+		if deleted == nil {
+			deleted = &Bitset{}
+		}
+		for _, id := range ids {
+			deleted.Set(id)
+		}
+		name := fmt.Sprintf("%s.%d.del", s.Name, m.Generation+1)
+		if err := store.WriteFileAtomic(filepath.Join(dir, name), func(w io.Writer) error {
+			_, err := deleted.WriteTo(w)
+			return err
+		}); err != nil {
+			return stats, fmt.Errorf("failed to write tombstones of segment %s: %w", s.Name, err)
+		}
+		if s.Tombstones != "" {
+			obsolete = append(obsolete, s.Tombstones)
+		}
+		s.Tombstones = name
+		s.Deleted = deleted.Count()
+		stats.Deleted += len(ids)
+	}
+
+	// 全てのドキュメントが削除されたセグメントは一覧から外す
+	live := m.Segments[:0]
+	for _, s := range m.Segments {
+		if s.LiveDocs() > 0 {
+			live = append(live, s)
+		} else {
+			obsolete = append(obsolete, s.indexFile(), s.Tombstones)
+		}
+	}
+	m.Segments = live
+
+	if err := writeManifest(dir, m); err != nil {
+		return stats, err
+	}
+	removeFiles(dir, obsolete)
+	return stats, nil
+}
+
+// postedDocs はポスティングを持つドキュメントIDの集合を返します。
+func postedDocs(index map[string][]indexer.Posting) map[int]bool {
+	ids := make(map[int]bool)
+	for _, postings := range index {
+		for _, p := range postings {
+			ids[p.DocID] = true
+		}
+	}
+	return ids
+}
+
+// carryPostings は情報だけが変わったドキュメントのポスティングと保存された本文を、
+// 元のセグメントから新しいセグメントに書き込むインデックスに写します。
+func carryPostings(dir string, segments []SegmentInfo, carried map[int][]int, written *indexer.InvertedIndex) error {
+	touched := make(map[string]bool)
+	for i, ids := range carried {
+		s := segments[i]
+		idx, err := store.LoadIndex(filepath.Join(dir, s.indexFile()))
+		if err != nil {
+			return fmt.Errorf("failed to load segment %s: %w", s.Name, err)
+		}
+		want := make(map[int]bool, len(ids))
+		for _, id := range ids {
+			want[id] = true
+			if content, ok := idx.Stored[id]; ok {
+				written.Stored[id] = content
+			}
+		}
+		for term, postings := range idx.Index {
+			for _, p := range postings {
+				if want[p.DocID] {
+					written.Index[term] = append(written.Index[term], p)
+					touched[term] = true
+				}
+			}
+		}
+	}
+	for term := range touched {
+		postings := written.Index[term]
+		sort.Slice(postings, func(i, j int) bool { return postings[i].DocID < postings[j].DocID })
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+// go-my-index/server/server.go
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"gmi/indexer"
+	"gmi/searcher"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLimit   = 20   // /searchで返す既定の件数
+	defaultSuggest = 10   // /suggestで返す既定の件数
+	maxLimit       = 1000 // limitに指定できる最大値
+)
+
+// Server は読み込み済みのインデックスを検索するHTTPハンドラです。
+// インデックスは起動時に一度だけ開き、全てのリクエストで共有します。
+type Server struct {
+	idx       indexer.Reader
+	indexPath string
+	loadedAt  time.Time
+	mux       *http.ServeMux
+}
+
+// New はidxを検索するServerを作成します。indexPathは/statsに表示するためだけに使います。
+func New(idx indexer.Reader, indexPath string) *Server {
+	s := &Server{idx: idx, indexPath: indexPath, loadedAt: time.Now(), mux: http.NewServeMux()}
+	s.mux.HandleFunc("GET /search", s.handleSearch)
+	s.mux.HandleFunc("GET /doc/{id}", s.handleDoc)
+	s.mux.HandleFunc("GET /stats", s.handleStats)
+	s.mux.HandleFunc("GET /suggest", s.handleSuggest)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// searchResponse は/searchの応答です。totalはページ分割前の件数で、total_exactがfalseなら下限です。
+type searchResponse struct {
+	Query      string         `json:"query"`
+	Mode       string         `json:"mode"`
+	Total      int            `json:"total"`
+	TotalExact bool           `json:"total_exact"`
+	Offset     int            `json:"offset"`
+	Limit      int            `json:"limit"`
+	Results    []searcher.Hit `json:"results"`
+}
+
+// handleSearch はクエリパラメータq, mode, limit, offset, sortと、
+// 絞り込みのsource (取り込み元) とpath (パスの前方一致) を受け付けます。
+func (s *Server) handleSearch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	query := q.Get("q")
+	if strings.TrimSpace(query) == "" {
+		writeError(w, http.StatusBadRequest, "query parameter 'q' is required")
+		return
+	}
+	mode := strings.ToLower(q.Get("mode"))
+	if mode == "" {
+		mode = "and"
+	}
+	if mode != "and" && mode != "or" {
+		writeError(w, http.StatusBadRequest, "mode must be 'and' or 'or'")
+		return
+	}
+	if _, _, err := searcher.ParseFilters(query); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sortOrder, err := searcher.ParseSort(q.Get("sort"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit, offset, err := pagination(q.Get("limit"), q.Get("offset"), defaultLimit)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	sources := q["source"]
+	pathPrefix := q.Get("path")
+	filter := func(doc indexer.Document) bool {
+		source := doc.Source
+		if source == "" {
+			source = indexer.SourceFile
+		}
+		if len(sources) > 0 && !slices.Contains(sources, source) {
+			return false
+		}
+		return pathPrefix == "" || strings.HasPrefix(doc.Path, pathPrefix)
+	}
+
+	page := searcher.SearchPage(s.idx, query, mode, searcher.SearchOptions{Limit: limit, Offset: offset, Filter: filter, Sort: sortOrder})
+	if page.Err != nil {
+		writeError(w, http.StatusInternalServerError, page.Err.Error())
+		return
+	}
+	response := searchResponse{Query: query, Mode: mode, Total: page.Total, TotalExact: page.TotalExact, Offset: offset, Limit: limit, Results: []searcher.Hit{}}
+	for i, res := range page.Results {
+		response.Results = append(response.Results, searcher.NewHit(offset+i+1, res))
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// docResponse は/doc/{id}の応答です。
+type docResponse struct {
+	ID           int               `json:"id"`
+	Path         string            `json:"path"`
+	Source       string            `json:"source"`
+	Root         string            `json:"root,omitempty"`
+	Encoding     string            `json:"encoding,omitempty"`
+	TotalWords   int               `json:"total_words"`
+	LastModified time.Time         `json:"last_modified"`
+	Size         int64             `json:"size"`
+	Ext          string            `json:"ext,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	Content      *string           `json:"content,omitempty"`
+	ContentError string            `json:"content_error,omitempty"`
+}
+
+// handleDoc はドキュメントの情報を返します。content=falseを指定しなければ本文も含めます。
+func (s *Server) handleDoc(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "document id must be an integer")
+		return
+	}
+	doc, ok := s.idx.Document(id)
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Sprintf("document %d not found", id))
+		return
+	}
+	response := docResponse{
+		ID:           doc.ID,
+		Path:         doc.Path,
+		Source:       doc.Source,
+		Root:         doc.Root,
+		Encoding:     doc.Encoding,
+		TotalWords:   doc.TotalWords,
+		LastModified: doc.LastModified,
+		Size:         doc.Size,
+		Ext:          doc.Ext,
+		Meta:         doc.Meta,
+	}
+	if response.Source == "" {
+		response.Source = indexer.SourceFile
+	}
+	if r.URL.Query().Get("content") != "false" {
+		if content, err := s.idx.Content(doc); err != nil {
+			response.ContentError = err.Error()
+		} else {
+			response.Content = &content
+		}
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// statsResponse は/statsの応答です。
+type statsResponse struct {
+	Index     string    `json:"index"`
+	Documents int       `json:"documents"`
+	Terms     int       `json:"terms"`
+	LoadedAt  time.Time `json:"loaded_at"`
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	terms, err := s.idx.Terms("")
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, statsResponse{Index: s.indexPath, Documents: s.idx.NumDocs(), Terms: len(terms), LoadedAt: s.loadedAt})
+}
+
+// suggestion は/suggestの候補1件です。
+type suggestion struct {
+	Term    string `json:"term"`
+	DocFreq int    `json:"doc_freq"`
+}
+
+// handleSuggest はprefixで始まる単語を、含むドキュメントの多い順にlimit件返します。
+func (s *Server) handleSuggest(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	prefix := strings.ToLower(strings.TrimSpace(q.Get("prefix")))
+	if prefix == "" {
+		writeError(w, http.StatusBadRequest, "query parameter 'prefix' is required")
+		return
+	}
+	limit, _, err := pagination(q.Get("limit"), "", defaultSuggest)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	terms, err := s.idx.Terms(prefix)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	sort.SliceStable(terms, func(i, j int) bool { return terms[i].DocFreq > terms[j].DocFreq })
+	suggestions := []suggestion{}
+	for i := 0; i < len(terms) && i < limit; i++ {
+		suggestions = append(suggestions, suggestion{Term: terms[i].Term, DocFreq: terms[i].DocFreq})
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"prefix": prefix, "suggestions": suggestions})
+}
+
+// pagination はlimitとoffsetのクエリパラメータを検証して返します。
+func pagination(limitParam, offsetParam string, defaultLimit int) (limit, offset int, err error) {
+	limit = defaultLimit
+	if limitParam != "" {
+		limit, err = strconv.Atoi(limitParam)
+		if err != nil || limit < 1 || limit > maxLimit {
+			return 0, 0, fmt.Errorf("limit must be an integer between 1 and %d", maxLimit)
+		}
+	}
+	if offsetParam != "" {
+		offset, err = strconv.Atoi(offsetParam)
+		if err != nil || offset < 0 || offset > searcher.MaxOffset {
+			return 0, 0, fmt.Errorf("offset must be an integer between 0 and %d", searcher.MaxOffset)
+		}
+	}
+	return limit, offset, nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: failed to write response: %v\n", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
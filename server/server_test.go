@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"gmi/indexer"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	idx := indexer.NewInvertedIndex()
+	notes := []struct{ id, text string }{
+		{"notes/go.md", "go search engine"},
+		{"notes/golang.md", "golang go tools"},
+		{"wiki/rust.md", "rust search"},
+	}
+	for _, n := range notes {
+		if _, err := idx.AddDocument(indexer.Document{Path: n.id, Source: indexer.SourceStdin}, n.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return New(idx, "test.idx")
+}
+
+func get(t *testing.T, s *Server, url string, wantStatus int, v any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+	if rec.Code != wantStatus {
+		t.Fatalf("GET %s status = %d, want %d: %s", url, rec.Code, wantStatus, rec.Body)
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), v); err != nil {
+		t.Fatalf("GET %s: invalid JSON: %v", url, err)
+	}
+}
+
+func TestSearchPaginationAndFilters(t *testing.T) {
+	s := newTestServer(t)
+	var resp searchResponse
+	get(t, s, "/search?q=search+go&mode=or&limit=1&offset=1", http.StatusOK, &resp)
+	// WANDで読み飛ばしたドキュメントがあれば、totalは下限になる
+	if resp.Total > 3 || (resp.TotalExact && resp.Total != 3) || len(resp.Results) != 1 || resp.Results[0].Rank != 2 {
+		t.Errorf("paged search = %+v, want result 2 of 3", resp)
+	}
+
+	get(t, s, "/search?q=search&path=wiki/", http.StatusOK, &resp)
+	if resp.Total != 1 || resp.Results[0].Path != "wiki/rust.md" {
+		t.Errorf("search filtered by path = %+v", resp)
+	}
+	get(t, s, "/search?q=search&source=jsonl", http.StatusOK, &resp)
+	if resp.Total != 0 || resp.Results == nil {
+		t.Errorf("search filtered by source = %+v, want an empty list", resp)
+	}
+
+	var errResp map[string]string
+	get(t, s, "/search?q=go&limit=0", http.StatusBadRequest, &errResp)
+	get(t, s, "/search?q=go&offset=9223372036854775807", http.StatusBadRequest, &errResp)
+	get(t, s, "/search", http.StatusBadRequest, &errResp)
+}
+
+func TestDocStatsAndSuggest(t *testing.T) {
+	s := newTestServer(t)
+	var doc docResponse
+	get(t, s, "/doc/2", http.StatusOK, &doc)
+	if doc.Path != "wiki/rust.md" || doc.Content == nil || *doc.Content != "rust search" {
+		t.Errorf("/doc/2 = %+v", doc)
+	}
+	var errResp map[string]string
+	get(t, s, "/doc/99", http.StatusNotFound, &errResp)
+
+	var stats statsResponse
+	get(t, s, "/stats", http.StatusOK, &stats)
+	if stats.Documents != 3 || stats.Terms != 6 {
+		t.Errorf("/stats = %+v", stats)
+	}
+
+	var suggest struct {
+		Suggestions []suggestion `json:"suggestions"`
+	}
+	get(t, s, "/suggest?prefix=Go", http.StatusOK, &suggest)
+	if len(suggest.Suggestions) != 2 || suggest.Suggestions[0].Term != "go" || suggest.Suggestions[0].DocFreq != 2 {
+		t.Errorf("/suggest = %+v", suggest)
+	}
+}
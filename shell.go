@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gmi/indexer"
+	"gmi/searcher"
+	"gmi/ui"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	shellPrompt     = "gmi> "
+	maxHistoryLines = 1000 // 履歴ファイルに残す最大行数
+	shellMaxResults = 50   // 1回の検索で表示する結果の最大数。TUIと同じく上位だけを作る
+)
+
+// shell はgmi shellの状態です。インデックスは起動時に一度だけ開き、
+// 直前の検索結果を:openや:explainで番号指定できるよう保持します。
+type shell struct {
+	idx       indexer.Reader
+	indexPath string
+	loadedAt  time.Time
+	mode      string
+	results   []searcher.SearchResult
+	out       io.Writer
+}
+
+func newShell(idx indexer.Reader, indexPath string, out io.Writer) *shell {
+	return &shell{idx: idx, indexPath: indexPath, loadedAt: time.Now(), mode: "and", out: out}
+}
+
+// run は入力が終わるか:quitが入力されるまで1行ずつ実行します。
+// 標準入力が端末なら行編集と履歴を使い、そうでなければパイプからの入力として読みます。
+func (s *shell) run(historyPath string) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if s.execute(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+
+	history, err := loadHistory(historyPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s could not read history: %v\n", ui.Yellow("Warning:"), err)
+	}
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, shellPrompt)
+	t.History = history
+
+	fmt.Fprintf(s.out, "%s Loaded %d document(s) from %s. Type :help for commands, Ctrl+D to quit.\n", ui.Green("✔"), s.idx.NumDocs(), s.indexPath)
+	for {
+		// 行編集の間だけ端末をrawモードにし、検索結果の表示は通常のモードで行う
+		state, err := term.MakeRaw(fd)
+		if err != nil {
+			return fmt.Errorf("failed to set terminal mode: %w", err)
+		}
+		if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+			t.SetSize(width, height)
+		}
+		line, err := t.ReadLine()
+		term.Restore(fd, state)
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				fmt.Fprintln(s.out)
+				return nil
+			}
+			return err
+		}
+		if s.execute(line) {
+			return nil
+		}
+	}
+}
+
+// execute は1行を実行し、シェルを終了する場合にtrueを返します。
+// ":"で始まる行はコマンド、それ以外は現在のモードでの検索クエリです。
+func (s *shell) execute(line string) (quit bool) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return false
+	}
+	if !strings.HasPrefix(line, ":") {
+		s.search(line)
+		return false
+	}
+
+	fields := strings.Fields(line[1:])
+	if len(fields) == 0 {
+		s.help()
+		return false
+	}
+	command, args := fields[0], fields[1:]
+	switch command {
+	case "q", "quit", "exit":
+		return true
+	case "help", "h", "?":
+		s.help()
+	case "mode":
+		s.setMode(args)
+	case "open":
+		if res, ok := s.result(args); ok {
+			s.open(res)
+		}
+	case "explain":
+		if res, ok := s.result(args); ok {
+			s.explain(res)
+		}
+	case "stats":
+		s.stats()
+	default:
+		fmt.Fprintf(s.out, "%s Unknown command: %s (type :help)\n", ui.Yellow("!"), ui.Red(":"+command))
+	}
+	return false
+}
+
+func (s *shell) help() {
+	fmt.Fprintln(s.out, ui.Bold("Commands:"))
+	fmt.Fprintln(s.out, "  ", ui.Cyan("<query>"), "        Search the index with the current mode")
+	fmt.Fprintln(s.out, "  ", ui.Cyan(":mode [and|or]"), " Show or change the search mode")
+	fmt.Fprintln(s.out, "  ", ui.Cyan(":open <n>"), "      Show the full text of result n")
+	fmt.Fprintln(s.out, "  ", ui.Cyan(":explain <n>"), "   Show how the score of result n was computed")
+	fmt.Fprintln(s.out, "  ", ui.Cyan(":stats"), "         Show index statistics")
+	fmt.Fprintln(s.out, "  ", ui.Cyan(":quit"), "          Leave the shell (or Ctrl+D)")
+}
+
+func (s *shell) search(query string) {
+	page := searcher.SearchPage(s.idx, query, s.mode, searcher.SearchOptions{Limit: shellMaxResults, Log: os.Stderr})
+	s.results = page.Results
+	if page.Err != nil {
+		return // エラーはopts.Logに書き出されている
+	}
+	printSearchResults(s.out, searchPage{query: query, mode: s.mode, results: page.Results, total: page.Total, totalExact: page.TotalExact, limit: shellMaxResults})
+}
+
+func (s *shell) setMode(args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(s.out, "mode:", s.mode)
+		return
+	}
+	mode := strings.ToLower(args[0])
+	if mode != "and" && mode != "or" {
+		fmt.Fprintln(s.out, ui.Red("Error:"), "Invalid search mode. Must be 'and' or 'or'.")
+		return
+	}
+	s.mode = mode
+	fmt.Fprintln(s.out, "mode:", s.mode)
+}
+
+// result は引数の番号 (1始まり) に対応する直前の検索結果を返します。
+func (s *shell) result(args []string) (searcher.SearchResult, bool) {
+	if len(args) != 1 {
+		fmt.Fprintln(s.out, ui.Red("Error:"), "Expected a result number, e.g. ':open 3'.")
+		return searcher.SearchResult{}, false
+	}
+	if len(s.results) == 0 {
+		fmt.Fprintln(s.out, ui.Red("Error:"), "No results yet. Run a search first.")
+		return searcher.SearchResult{}, false
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(s.results) {
+		fmt.Fprintf(s.out, "%s Result number must be between 1 and %d.\n", ui.Red("Error:"), len(s.results))
+		return searcher.SearchResult{}, false
+	}
+	return s.results[n-1], true
+}
+
+func (s *shell) open(res searcher.SearchResult) {
+	doc := res.Document
+	content, err := s.idx.Content(doc)
+	if err != nil {
+		fmt.Fprintf(s.out, "%s %v\n", ui.Red("Error reading document:"), err)
+		return
+	}
+	source := doc.Source
+	if source == "" {
+		source = indexer.SourceFile
+	}
+	fmt.Fprintf(s.out, "%s %s [%s] (DocID: %d, TotalWords: %d)\n", ui.Bold("==>"), doc.Path, source, doc.ID, doc.TotalWords)
+	fmt.Fprintln(s.out, strings.TrimRight(content, "\n"))
+}
+
+func (s *shell) explain(res searcher.SearchResult) {
+	scores, err := searcher.Explain(s.idx, res)
+	if err != nil {
+		fmt.Fprintf(s.out, "%s %v\n", ui.Red("Error explaining score:"), err)
+		return
+	}
+	fmt.Fprintf(s.out, "%s (DocID: %d) score %.4f = sum of tf * idf, idf = log(N / df), N = %d\n",
+		res.Document.Path, res.Document.ID, res.Score, s.idx.NumDocs())
+	for _, ts := range scores {
+		fmt.Fprintf(s.out, "   %-20s tf=%-4d df=%-6d idf=%.4f  %s\n", ts.Term, ts.Frequency, ts.DocFreq, ts.IDF, ui.Cyan(fmt.Sprintf("%.4f", ts.Score)))
+	}
+}
+
+func (s *shell) stats() {
+	terms, err := s.idx.Terms("")
+	if err != nil {
+		fmt.Fprintf(s.out, "%s %v\n", ui.Red("Error reading terms:"), err)
+		return
+	}
+	fmt.Fprintln(s.out, "index:    ", s.indexPath)
+	fmt.Fprintln(s.out, "documents:", s.idx.NumDocs())
+	fmt.Fprintln(s.out, "terms:    ", len(terms))
+	fmt.Fprintln(s.out, "mode:     ", s.mode)
+	fmt.Fprintln(s.out, "loaded:   ", s.loadedAt.Format(time.RFC3339))
+}
+
+// fileHistory はファイルに保存される入力履歴です。term.Historyを実装します。
+// pathが空なら保存せず、メモリ上にだけ保持します。
+type fileHistory struct {
+	path  string
+	lines []string // 古い順
+}
+
+// loadHistory はpathから履歴を読み込みます。ファイルが無ければ空の履歴を返します。
+func loadHistory(path string) (*fileHistory, error) {
+	h := &fileHistory{path: path}
+	if path == "" {
+		return h, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return h, nil
+		}
+		return h, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			h.lines = append(h.lines, line)
+		}
+	}
+	if len(h.lines) > maxHistoryLines {
+		// 追記し続けたファイルが大きくなりすぎないよう、読み込み時に切り詰める
+		h.lines = h.lines[len(h.lines)-maxHistoryLines:]
+		if err := os.WriteFile(path, []byte(strings.Join(h.lines, "\n")+"\n"), 0o600); err != nil {
+			return h, err
+		}
+	}
+	return h, nil
+}
+
+// Add は空行と直前と同じ行を除いて履歴に追加し、ファイルに追記します。
+func (h *fileHistory) Add(entry string) {
+	if strings.TrimSpace(entry) == "" || (len(h.lines) > 0 && h.lines[len(h.lines)-1] == entry) {
+		return
+	}
+	h.lines = append(h.lines, entry)
+	if len(h.lines) > maxHistoryLines {
+		h.lines = h.lines[1:]
+	}
+	if h.path == "" {
+		return
+	}
+	f, err := os.OpenFile(h.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintln(f, entry)
+}
+
+func (h *fileHistory) Len() int { return len(h.lines) }
+
+func (h *fileHistory) At(idx int) string { return h.lines[len(h.lines)-1-idx] }
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"gmi/indexer"
+	"gmi/searcher"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func newTestShell(t *testing.T) (*shell, *bytes.Buffer) {
+	t.Helper()
+	idx := indexer.NewInvertedIndex()
+	for i, text := range []string{"go search engine", "go index", "rust search"} {
+		if _, err := idx.AddDocument(indexer.Document{Path: fmt.Sprintf("note-%d", i+1), Source: indexer.SourceStdin}, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var out bytes.Buffer
+	return newShell(idx, "test.idx", &out), &out
+}
+
+func TestShellExecute(t *testing.T) {
+	tests := []struct {
+		line    string
+		quit    bool
+		mode    string
+		output  string
+		results int
+	}{
+		{"", false, "and", "", 0},
+		{"   ", false, "and", "", 0},
+		{":quit", true, "and", "", 0},
+		{":q", true, "and", "", 0},
+		{":exit", true, "and", "", 0},
+		{":", false, "and", "Commands:", 0},
+		{":help", false, "and", "Commands:", 0},
+		{":mode", false, "and", "mode: and", 0},
+		{":mode OR", false, "or", "mode: or", 0},
+		{":mode xor", false, "and", "Invalid search mode", 0},
+		{":stats", false, "and", "documents: 3", 0},
+		{":bogus", false, "and", "Unknown command", 0},
+		{"go search", false, "and", "Found 1 document(s)", 1},
+		{"missing", false, "and", "No documents found", 0},
+	}
+	for _, tt := range tests {
+		s, out := newTestShell(t)
+		if quit := s.execute(tt.line); quit != tt.quit {
+			t.Errorf("execute(%q) = %v, want %v", tt.line, quit, tt.quit)
+		}
+		if s.mode != tt.mode {
+			t.Errorf("execute(%q) mode = %q, want %q", tt.line, s.mode, tt.mode)
+		}
+		if !strings.Contains(out.String(), tt.output) {
+			t.Errorf("execute(%q) output = %q, want it to contain %q", tt.line, out.String(), tt.output)
+		}
+		if len(s.results) != tt.results {
+			t.Errorf("execute(%q) kept %d results, want %d", tt.line, len(s.results), tt.results)
+		}
+	}
+}
+
+func TestShellSearchUsesCurrentModeAndLimit(t *testing.T) {
+	s, out := newTestShell(t)
+	s.execute(":mode or")
+	s.execute("go search")
+	if len(s.results) != 3 {
+		t.Fatalf("or search kept %d results, want 3", len(s.results))
+	}
+	if !strings.Contains(out.String(), "mode: or") {
+		t.Errorf("output = %q, want the or mode in the header", out.String())
+	}
+
+	idx := indexer.NewInvertedIndex()
+	for i := 0; i < shellMaxResults+5; i++ {
+		if _, err := idx.AddDocument(indexer.Document{Path: fmt.Sprintf("n%d", i), Source: indexer.SourceStdin}, "common"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	s = newShell(idx, "test.idx", &buf)
+	s.execute("common")
+	if len(s.results) != shellMaxResults {
+		t.Errorf("search kept %d results, want %d", len(s.results), shellMaxResults)
+	}
+	if want := fmt.Sprintf("Found %d document(s)", shellMaxResults+5); !strings.Contains(buf.String(), want) {
+		t.Errorf("output = %q, want it to contain %q", buf.String(), want)
+	}
+}
+
+func TestShellResult(t *testing.T) {
+	s, out := newTestShell(t)
+	if _, ok := s.result([]string{"1"}); ok || !strings.Contains(out.String(), "No results yet") {
+		t.Errorf("result() before a search = %v, output %q", ok, out.String())
+	}
+	s.results = []searcher.SearchResult{
+		{Document: indexer.Document{Path: "first"}},
+		{Document: indexer.Document{Path: "second"}},
+	}
+	tests := []struct {
+		args []string
+		ok   bool
+		path string
+	}{
+		{[]string{"1"}, true, "first"},
+		{[]string{"2"}, true, "second"},
+		{[]string{"0"}, false, ""},
+		{[]string{"3"}, false, ""},
+		{[]string{"-1"}, false, ""},
+		{[]string{"x"}, false, ""},
+		{nil, false, ""},
+		{[]string{"1", "2"}, false, ""},
+	}
+	for _, tt := range tests {
+		out.Reset()
+		res, ok := s.result(tt.args)
+		if ok != tt.ok || res.Document.Path != tt.path {
+			t.Errorf("result(%q) = %q, %v; want %q, %v", tt.args, res.Document.Path, ok, tt.path, tt.ok)
+		}
+		if !ok && !strings.Contains(out.String(), "Error:") {
+			t.Errorf("result(%q) output = %q, want an error", tt.args, out.String())
+		}
+	}
+}
+
+func TestFileHistory(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	var lines []string
+	for i := 0; i < maxHistoryLines+10; i++ {
+		lines = append(lines, fmt.Sprintf("query %d", i))
+	}
+	if err := os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := loadHistory(path)
+	if err != nil {
+		t.Fatalf("loadHistory() error = %v", err)
+	}
+	if h.Len() != maxHistoryLines || h.At(0) != lines[len(lines)-1] || h.At(h.Len()-1) != "query 10" {
+		t.Errorf("loadHistory() kept %d lines, newest %q, oldest %q", h.Len(), h.At(0), h.At(h.Len()-1))
+	}
+	if data, _ := os.ReadFile(path); strings.Count(string(data), "\n") != maxHistoryLines {
+		t.Errorf("history file has %d lines after loading, want it trimmed to %d", strings.Count(string(data), "\n"), maxHistoryLines)
+	}
+
+	h.Add("")
+	h.Add("  ")
+	h.Add(lines[len(lines)-1]) // 直前と同じ
+	h.Add("new query")
+	if h.Len() != maxHistoryLines || h.At(0) != "new query" || h.At(1) != lines[len(lines)-1] || h.At(h.Len()-1) != "query 11" {
+		t.Errorf("after Add: %d lines, newest %q, oldest %q", h.Len(), h.At(0), h.At(h.Len()-1))
+	}
+	data, err := os.ReadFile(path)
+	if err != nil || !strings.HasSuffix(string(data), lines[len(lines)-1]+"\nnew query\n") {
+		t.Errorf("history file does not end with the added query: %v", err)
+	}
+
+	memory, err := loadHistory("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory.Add("only in memory")
+	if memory.Len() != 1 || memory.At(0) != "only in memory" {
+		t.Errorf("in-memory history = %+v", memory.lines)
+	}
+}
@@ -0,0 +1,127 @@
+package store
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// backupSuffix は1つ前のバージョンのインデックスファイルに付ける接尾辞です。
+const backupSuffix = ".bak"
+
+func backupPath(filePath string) string {
+	return filePath + backupSuffix
+}
+
+// WriteFileAtomic はwriteの出力を同じディレクトリの一時ファイルに書き込み、
+// fsyncしてから対象のパスにリネームします。途中でクラッシュしても既存のファイルは壊れません。
+// 既存のファイルは置き換える前に.bakとして残します。
+func WriteFileAtomic(filePath string, write func(io.Writer) error) error {
+	return writeFileAtomic(filePath, write, true)
+}
+
+// writeFileAtomic はWriteFileAtomicと同じですが、backupがfalseなら既存の.bakをそのまま残します。
+func writeFileAtomic(filePath string, write func(io.Writer) error, backup bool) (err error) {
+	dir := filepath.Dir(filePath)
+	tmp, err := os.CreateTemp(dir, filepath.Base(filePath)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file in %s: %w", dir, err)
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		if err != nil {
+			tmp.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	mode := os.FileMode(0o644)
+	if info, statErr := os.Stat(filePath); statErr == nil {
+		mode = info.Mode().Perm()
+	}
+	if err := tmp.Chmod(mode); err != nil {
+		return fmt.Errorf("failed to set permissions on %s: %w", tmpPath, err)
+	}
+
+	w := bufio.NewWriter(tmp)
+	if err := write(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmpPath, err)
+	}
+	if err := tmp.Sync(); err != nil {
+		return fmt.Errorf("failed to sync %s: %w", tmpPath, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close %s: %w", tmpPath, err)
+	}
+
+	if backup {
+		if err := keepBackup(filePath); err != nil {
+			return err
+		}
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("failed to replace %s: %w", filePath, err)
+	}
+	syncDir(dir)
+	return nil
+}
+
+// keepBackup は既存のファイルを.bakとして残します。
+// 対象のパスは最後のリネームまで元のファイルを指したままにするため、移動ではなくリンクかコピーを使います。
+func keepBackup(filePath string) error {
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		return nil
+	}
+	bak := backupPath(filePath)
+	if err := os.Remove(bak); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove old backup %s: %w", bak, err)
+	}
+	if err := os.Link(filePath, bak); err == nil {
+		return nil
+	}
+	if err := copyFile(filePath, bak); err != nil {
+		return fmt.Errorf("failed to back up %s: %w", filePath, err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// syncDir はリネームを永続化するためにディレクトリをfsyncします。
+// ディレクトリをfsyncできないプラットフォームもあるため、エラーは無視します。
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,131 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"gmi/indexer"
+	"gmi/ui"
+	"os"
+	"sort"
+)
+
+// Backend はインデックスの永続化方法を抽象化したものです。
+// 検索や取り込みの処理はBackendを通してインデックスを扱い、保存形式を意識しません。
+//
+// 実装は単一ファイルのFileBackend、テスト用のMemoryBackend、
+// セグメントディレクトリのsegment.Backendがあります。
+type Backend interface {
+	// Open は検索用にインデックスを開きます。単語のポスティングやドキュメントはReaderから読みます。
+	Open() (ReadCloser, error)
+	// Load はインデックス全体をメモリに読み込みます。
+	Load() (*indexer.InvertedIndex, error)
+	// Documents は全ドキュメントをIDの昇順で返します。
+	Documents() ([]indexer.Document, error)
+	// Update はapplyでインデックスを変更し、変更を書き込みます。
+	Update(apply func(idx *indexer.InvertedIndex) error) error
+}
+
+// FileBackend はインデックス全体を1つのファイルに保存するBackendです。
+type FileBackend struct {
+	path    string
+	rebuild bool // 既存のファイルを読み込めなければ空のインデックスから作り直す
+}
+
+// NewFileBackend はpathのインデックスファイルを扱うFileBackendを作成します。
+func NewFileBackend(path string) *FileBackend {
+	return &FileBackend{path: path}
+}
+
+// Open はインデックスファイルをOpenReaderで開きます。
+func (b *FileBackend) Open() (ReadCloser, error) {
+	return OpenReader(b.path)
+}
+
+// Load はインデックスファイルをLoadIndexで読み込みます。
+func (b *FileBackend) Load() (*indexer.InvertedIndex, error) {
+	return LoadIndex(b.path)
+}
+
+// Documents はドキュメントのレコードだけを読み込んで返します。
+// 遅延読み込みできない古いフォーマットのファイルは全体を読み込みます。
+func (b *FileBackend) Documents() ([]indexer.Document, error) {
+	m, err := OpenMapped(b.path)
+	if err == nil {
+		defer m.Close()
+		return m.Documents()
+	}
+	if !errors.Is(err, errNotMappable) && !errors.Is(err, ErrCorruptIndex) && !os.IsNotExist(err) {
+		return nil, err
+	}
+	idx, err := b.Load()
+	if err != nil {
+		return nil, err
+	}
+	return sortedDocuments(idx), nil
+}
+
+// RebuildOnLoadError は、既存のファイルが壊れているなどで読み込めない場合に、Updateがエラーを返さず
+// 空のインデックスから作り直すようにします。ディレクトリの内容から全体を作り直す場合だけに使います。
+func (b *FileBackend) RebuildOnLoadError() *FileBackend {
+	b.rebuild = true
+	return b
+}
+
+// Update はインデックスファイルを読み込んで変更し、原子的に書き戻します。
+// 既存のファイルを読み込めない場合はエラーを返し、ファイルには触れません。
+// 変更だけのインデックスで既存の内容を置き換えてしまわないためです。
+// RebuildOnLoadErrorを指定した場合は警告を表示して新しいインデックスとして作り直しますが、
+// 新しいバージョンのファイルは上書きせずErrUnsupportedVersionを返します。
+func (b *FileBackend) Update(apply func(idx *indexer.InvertedIndex) error) error {
+	idx, err := LoadIndex(b.path)
+	if err != nil && (!b.rebuild || errors.Is(err, ErrUnsupportedVersion)) {
+		return err
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s Error loading existing index: %v. A new index will be built.\n", ui.Yellow("Warning:"), err)
+		idx = indexer.NewInvertedIndex()
+	}
+	if err := apply(idx); err != nil {
+		return err
+	}
+	return SaveIndex(idx, b.path)
+}
+
+// MemoryBackend はインデックスをメモリ上にだけ保持するBackendです。主にテストで使います。
+type MemoryBackend struct {
+	idx *indexer.InvertedIndex
+}
+
+// NewMemoryBackend は空のインデックスを持つMemoryBackendを作成します。
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{idx: indexer.NewInvertedIndex()}
+}
+
+// Open はメモリ上のインデックスをそのままReaderとして返します。
+func (b *MemoryBackend) Open() (ReadCloser, error) {
+	return memoryReader{b.idx}, nil
+}
+
+// Load はメモリ上のインデックスを返します。コピーではないため、変更はBackendにも反映されます。
+func (b *MemoryBackend) Load() (*indexer.InvertedIndex, error) {
+	return b.idx, nil
+}
+
+// Documents は全ドキュメントをIDの昇順で返します。
+func (b *MemoryBackend) Documents() ([]indexer.Document, error) {
+	return sortedDocuments(b.idx), nil
+}
+
+// Update はメモリ上のインデックスに直接applyを適用します。
+func (b *MemoryBackend) Update(apply func(idx *indexer.InvertedIndex) error) error {
+	return apply(b.idx)
+}
+
+func sortedDocuments(idx *indexer.InvertedIndex) []indexer.Document {
+	docs := make([]indexer.Document, 0, len(idx.Docs))
+	for _, doc := range idx.Docs {
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool { return docs[i].ID < docs[j].ID })
+	return docs
+}
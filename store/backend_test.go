@@ -0,0 +1,78 @@
+package store
+
+import (
+	"gmi/indexer"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackendsBehaveAlike(t *testing.T) {
+	backends := map[string]Backend{
+		"file":   NewFileBackend(filepath.Join(t.TempDir(), "test.idx")),
+		"memory": NewMemoryBackend(),
+	}
+	for name, b := range backends {
+		t.Run(name, func(t *testing.T) {
+			for _, note := range []struct{ id, text string }{{"n1", "go search"}, {"n2", "go index"}} {
+				err := b.Update(func(idx *indexer.InvertedIndex) error {
+					_, err := idx.AddDocument(indexer.Document{Path: note.id, Source: indexer.SourceStdin}, note.text)
+					return err
+				})
+				if err != nil {
+					t.Fatalf("Update() error = %v", err)
+				}
+			}
+
+			r, err := b.Open()
+			if err != nil {
+				t.Fatalf("Open() error = %v", err)
+			}
+			defer r.Close()
+			if postings, err := r.Postings("go"); err != nil || len(postings) != 2 {
+				t.Errorf("Postings(go) = %+v, %v; want 2", postings, err)
+			}
+			doc, ok := r.Document(1)
+			if !ok || doc.Path != "n2" {
+				t.Fatalf("Document(1) = %+v, %v", doc, ok)
+			}
+			if content, err := r.Content(doc); err != nil || content != "go index" {
+				t.Errorf("Content(n2) = %q, %v", content, err)
+			}
+
+			docs, err := b.Documents()
+			if err != nil || len(docs) != 2 || docs[0].Path != "n1" || docs[1].Path != "n2" {
+				t.Errorf("Documents() = %+v, %v", docs, err)
+			}
+			idx, err := b.Load()
+			if err != nil || len(idx.Index["go"]) != 2 {
+				t.Errorf("Load() = %+v, %v", idx, err)
+			}
+		})
+	}
+}
+
+func TestFileBackendUpdateKeepsUnreadableIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	garbage := []byte("not an index")
+	if err := os.WriteFile(path, garbage, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	add := func(idx *indexer.InvertedIndex) error {
+		_, err := idx.AddDocument(indexer.Document{Path: "n1", Source: indexer.SourceStdin}, "go search")
+		return err
+	}
+	if err := NewFileBackend(path).Update(add); err == nil {
+		t.Fatal("Update() replaced an unreadable index")
+	}
+	if data, err := os.ReadFile(path); err != nil || string(data) != string(garbage) {
+		t.Errorf("index file was modified: %q, %v", data, err)
+	}
+
+	if err := NewFileBackend(path).RebuildOnLoadError().Update(add); err != nil {
+		t.Fatalf("Update() with RebuildOnLoadError error = %v", err)
+	}
+	if idx, err := LoadIndex(path); err != nil || len(idx.Docs) != 1 {
+		t.Errorf("rebuilt index = %+v, %v", idx, err)
+	}
+}
@@ -0,0 +1,42 @@
+package store
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+)
+
+// 本文のレコード (バージョン4以降)
+//
+// 本文はドキュメントごとにDEFLATEで圧縮して格納します。
+// レコード単位で圧縮するので、検索時はヒットしたドキュメントの本文だけを展開できます。
+
+// compressRecord は本文のレコードを圧縮します。
+func compressRecord(text string) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.WriteString(w, text); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeStoredRecord はフォーマットのバージョンに応じて本文のレコードを文字列に戻します。
+// バージョン3のレコードは圧縮されていません。
+func decodeStoredRecord(version uint16, id int, record []byte) (string, error) {
+	if version < 4 {
+		return string(record), nil
+	}
+	text, err := io.ReadAll(flate.NewReader(bytes.NewReader(record)))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid stored content of document %d: %v", ErrCorruptIndex, id, err)
+	}
+	return string(text), nil
+}
@@ -0,0 +1,240 @@
+package store
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"gmi/indexer"
+	"gmi/tokenizer"
+	"gmi/ui"
+	"io"
+	"os"
+	"sort"
+	"time"
+)
+
+// JSON Linesのエクスポート形式
+//
+// 1行に1つのJSONオブジェクトを書き、"type"で種類を区別します。
+//
+//	{"type":"header","format":"gmi-export","version":1,"analyzer":"...","next_doc_id":3,"store_content":false}
+//	{"type":"doc","id":0,"path":"...","source":"file","total_words":12,"last_modified":"...","content":"..."}
+//	{"type":"term","term":"go","postings":[{"doc":0,"freq":2,"positions":[3,9]}]}
+//
+// 先頭は必ずheaderで、その後にdocがIDの昇順、termが単語の昇順で続きます。
+// docのcontentはインデックスに本文が保存されている場合だけ出力されます。
+const (
+	exportFormat  = "gmi-export"
+	exportVersion = 1
+)
+
+type exportHeader struct {
+	Type         string `json:"type"`
+	Format       string `json:"format"`
+	Version      int    `json:"version"`
+	Analyzer     string `json:"analyzer"`
+	NextDocID    int    `json:"next_doc_id"`
+	StoreContent bool   `json:"store_content,omitempty"`
+}
+
+type exportDoc struct {
+	Type         string            `json:"type"`
+	ID           int               `json:"id"`
+	Path         string            `json:"path"`
+	Source       string            `json:"source,omitempty"`
+	Root         string            `json:"root,omitempty"`
+	Encoding     string            `json:"encoding,omitempty"`
+	TotalWords   int               `json:"total_words"`
+	LastModified time.Time         `json:"last_modified"`
+	Size         int64             `json:"size"`
+	Ext          string            `json:"ext,omitempty"`
+	Meta         map[string]string `json:"meta,omitempty"`
+	Content      *string           `json:"content,omitempty"`
+}
+
+type exportTerm struct {
+	Type     string          `json:"type"`
+	Term     string          `json:"term"`
+	Postings []exportPosting `json:"postings"`
+}
+
+type exportPosting struct {
+	DocID     int   `json:"doc"`
+	Frequency int   `json:"freq"`
+	Positions []int `json:"positions"`
+	Offsets   []int `json:"offsets,omitempty"`
+}
+
+// ExportJSONL はインデックスのドキュメント・単語・ポスティングをJSON Linesで書き出します。
+// 出力は決定的で、同じインデックスからは同じバイト列が得られます。
+func ExportJSONL(idx *indexer.InvertedIndex, w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	enc.SetEscapeHTML(false)
+
+	if err := enc.Encode(exportHeader{
+		Type:         "header",
+		Format:       exportFormat,
+		Version:      exportVersion,
+		Analyzer:     tokenizer.Analyzer,
+		NextDocID:    idx.NextDocID,
+		StoreContent: idx.StoreContent,
+	}); err != nil {
+		return err
+	}
+
+	ids := make([]int, 0, len(idx.Docs))
+	for id := range idx.Docs {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		doc := idx.Docs[id]
+		record := exportDoc{
+			Type:         "doc",
+			ID:           doc.ID,
+			Path:         doc.Path,
+			Source:       doc.Source,
+			Root:         doc.Root,
+			Encoding:     doc.Encoding,
+			TotalWords:   doc.TotalWords,
+			LastModified: doc.LastModified,
+			Size:         doc.Size,
+			Ext:          doc.Ext,
+			Meta:         doc.Meta,
+		}
+		if content, ok := idx.Stored[id]; ok {
+			record.Content = &content
+		}
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("failed to export document %d: %w", id, err)
+		}
+	}
+
+	terms := make([]string, 0, len(idx.Index))
+	for term := range idx.Index {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+	for _, term := range terms {
+		record := exportTerm{Type: "term", Term: term, Postings: make([]exportPosting, len(idx.Index[term]))}
+		for i, p := range idx.Index[term] {
+			record.Postings[i] = exportPosting{DocID: p.DocID, Frequency: p.Frequency, Positions: p.Positions, Offsets: p.Offsets}
+		}
+		if err := enc.Encode(record); err != nil {
+			return fmt.Errorf("failed to export term %q: %w", term, err)
+		}
+	}
+	return bw.Flush()
+}
+
+// ImportJSONL はExportJSONLの出力からInvertedIndexを組み立て直します。
+// ポスティングが存在しないドキュメントを指している場合などはエラーになります。
+func ImportJSONL(r io.Reader) (*indexer.InvertedIndex, error) {
+	idx := indexer.NewInvertedIndex()
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 256*1024*1024)
+	lineNo := 0
+	sawHeader := false
+	for scanner.Scan() {
+		lineNo++
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var kind struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(line, &kind); err != nil {
+			return nil, fmt.Errorf("line %d: invalid JSON: %w", lineNo, err)
+		}
+		if !sawHeader && kind.Type != "header" {
+			return nil, fmt.Errorf("line %d: expected a header record first, got %q", lineNo, kind.Type)
+		}
+
+		switch kind.Type {
+		case "header":
+			if sawHeader {
+				return nil, fmt.Errorf("line %d: duplicate header record", lineNo)
+			}
+			var h exportHeader
+			if err := json.Unmarshal(line, &h); err != nil {
+				return nil, fmt.Errorf("line %d: invalid header: %w", lineNo, err)
+			}
+			if h.Format != exportFormat {
+				return nil, fmt.Errorf("line %d: not a gmi export (format %q)", lineNo, h.Format)
+			}
+			if h.Version > exportVersion {
+				return nil, fmt.Errorf("line %d: export version %d is newer than supported version %d", lineNo, h.Version, exportVersion)
+			}
+			if h.Analyzer != tokenizer.Analyzer {
+				fmt.Fprintf(os.Stderr, "%s export was built with analyzer %q but this build uses %q; rebuild the index for accurate results.\n",
+					ui.Yellow("Warning:"), h.Analyzer, tokenizer.Analyzer)
+			}
+			idx.NextDocID = h.NextDocID
+			idx.StoreContent = h.StoreContent
+			sawHeader = true
+
+		case "doc":
+			var d exportDoc
+			if err := json.Unmarshal(line, &d); err != nil {
+				return nil, fmt.Errorf("line %d: invalid doc record: %w", lineNo, err)
+			}
+			if _, exists := idx.Docs[d.ID]; exists {
+				return nil, fmt.Errorf("line %d: duplicate document id %d", lineNo, d.ID)
+			}
+			doc := indexer.Document{
+				ID:           d.ID,
+				Path:         d.Path,
+				TotalWords:   d.TotalWords,
+				LastModified: d.LastModified,
+				Size:         d.Size,
+				Ext:          d.Ext,
+				Source:       d.Source,
+				Root:         d.Root,
+				Encoding:     d.Encoding,
+				Meta:         d.Meta,
+			}
+			if d.Content != nil {
+				idx.Stored[d.ID] = *d.Content
+				doc.ContentStored = true
+			}
+			idx.Docs[d.ID] = doc
+			idx.NextDocID = max(idx.NextDocID, d.ID+1)
+
+		case "term":
+			var t exportTerm
+			if err := json.Unmarshal(line, &t); err != nil {
+				return nil, fmt.Errorf("line %d: invalid term record: %w", lineNo, err)
+			}
+			if _, exists := idx.Index[t.Term]; exists {
+				return nil, fmt.Errorf("line %d: duplicate term %q", lineNo, t.Term)
+			}
+			postings := make([]indexer.Posting, len(t.Postings))
+			for i, p := range t.Postings {
+				if _, ok := idx.Docs[p.DocID]; !ok {
+					return nil, fmt.Errorf("line %d: term %q refers to unknown document %d", lineNo, t.Term, p.DocID)
+				}
+				if p.Frequency != len(p.Positions) {
+					return nil, fmt.Errorf("line %d: term %q in document %d has freq %d but %d positions", lineNo, t.Term, p.DocID, p.Frequency, len(p.Positions))
+				}
+				if p.Offsets != nil && len(p.Offsets) != len(p.Positions) {
+					return nil, fmt.Errorf("line %d: term %q in document %d has %d offsets but %d positions", lineNo, t.Term, p.DocID, len(p.Offsets), len(p.Positions))
+				}
+				postings[i] = indexer.Posting{DocID: p.DocID, Frequency: p.Frequency, Positions: p.Positions, Offsets: p.Offsets}
+			}
+			sort.Slice(postings, func(i, j int) bool { return postings[i].DocID < postings[j].DocID })
+			idx.Index[t.Term] = postings
+
+		default:
+			return nil, fmt.Errorf("line %d: unknown record type %q", lineNo, kind.Type)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read export: %w", err)
+	}
+	if !sawHeader {
+		return nil, fmt.Errorf("export is empty")
+	}
+	return idx, nil
+}
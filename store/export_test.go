@@ -0,0 +1,52 @@
+package store
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	idx := newTestIndex(t)
+	var dump bytes.Buffer
+	if err := ExportJSONL(idx, &dump); err != nil {
+		t.Fatalf("ExportJSONL() error = %v", err)
+	}
+	imported, err := ImportJSONL(bytes.NewReader(dump.Bytes()))
+	if err != nil {
+		t.Fatalf("ImportJSONL() error = %v", err)
+	}
+	if !reflect.DeepEqual(imported.Index, idx.Index) || !reflect.DeepEqual(imported.Stored, idx.Stored) || imported.NextDocID != idx.NextDocID {
+		t.Errorf("imported index differs:\n got %+v\nwant %+v", imported, idx)
+	}
+	for id, want := range idx.Docs {
+		if got := imported.Docs[id]; got.Path != want.Path || got.Source != want.Source || got.TotalWords != want.TotalWords || got.ContentStored != want.ContentStored {
+			t.Errorf("Docs[%d] = %+v, want %+v", id, got, want)
+		}
+	}
+
+	var again bytes.Buffer
+	if err := ExportJSONL(imported, &again); err != nil {
+		t.Fatal(err)
+	}
+	if again.String() != dump.String() {
+		t.Errorf("re-export differs from the original export")
+	}
+}
+
+func TestImportJSONLRejectsInvalidInput(t *testing.T) {
+	header := `{"type":"header","format":"gmi-export","version":1}` + "\n"
+	tests := map[string]string{
+		"missing header":   `{"type":"doc","id":0,"path":"a"}`,
+		"unknown type":     header + `{"type":"shard"}`,
+		"unknown document": header + `{"type":"term","term":"go","postings":[{"doc":7,"freq":1,"positions":[0]}]}`,
+		"freq mismatch":    header + `{"type":"doc","id":0,"path":"a"}` + "\n" + `{"type":"term","term":"go","postings":[{"doc":0,"freq":2,"positions":[0]}]}`,
+		"newer version":    `{"type":"header","format":"gmi-export","version":99}`,
+	}
+	for name, input := range tests {
+		if _, err := ImportJSONL(strings.NewReader(input)); err == nil {
+			t.Errorf("%s: ImportJSONL() succeeded, want error", name)
+		}
+	}
+}
@@ -0,0 +1,214 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// インデックスファイルの形式
+//
+//	magic        [8]byte  "GMIINDEX"
+//	version      uint16   フォーマットのバージョン
+//	sectionCount uint16
+//	preambleCRC  uint32   magicからsectionCountまでのCRC (バージョン7以降)
+//	sections     sectionCount個の {id uint16, offset uint64, length uint64, crc uint32}
+//	tableCRC     uint32   ここまでのバイト列のCRC
+//	payloads     各セクションの中身 (offsetはファイル先頭からの位置)
+//
+// バージョン1はポスティングをgobのまま格納し、バージョン2以降は圧縮形式 (postings.go) で格納します。
+// バージョン3以降はドキュメントと本文をID単位で取り出せるレコード形式 (records.go) で格納します。
+// バージョン4以降は本文のレコードを圧縮して格納します (compress.go)。
+// バージョン5以降は単語辞書とポスティングのスキップ情報にfrequencyの最大値を格納します (postings.go)。
+// バージョン6以降はポスティングに出現位置ごとの本文中のバイトオフセットを格納します (postings.go)。
+// バージョン7以降はpreambleCRCを格納し、バージョンを解釈する前に先頭部分が壊れていないことを確かめます。
+// これがないと、バージョンのビット化けが破損ではなく新しいバージョンのファイルとして報告されます。
+// 以降のバージョンもpreambleCRCの位置は変えません。
+//
+// 数値は全てリトルエンディアン、CRCはCRC-32C(Castagnoli)です。
+const (
+	FormatVersion = 7 // このビルドが書き出すフォーマットのバージョン
+
+	preambleCRCVersion = 7 // preambleCRCを持つ最初のバージョン
+
+	preambleSize     = 8 + 2 + 2
+	sectionEntrySize = 2 + 8 + 8 + 4
+)
+
+var magic = [8]byte{'G', 'M', 'I', 'I', 'N', 'D', 'E', 'X'}
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrCorruptIndex はインデックスファイルが壊れている場合に返されます。
+	ErrCorruptIndex = errors.New("index file is corrupt")
+	// ErrUnsupportedVersion はこのビルドより新しいフォーマットのファイルを読もうとした場合に返されます。
+	ErrUnsupportedVersion = errors.New("unsupported index format version")
+)
+
+type sectionID uint16
+
+const (
+	sectionHeader   sectionID = 1 // JSONのHeader
+	sectionDocs     sectionID = 2 // gobの[]indexer.Document (バージョン3以降はJSONのレコード)
+	sectionPostings sectionID = 3 // gobのmap[string][]indexer.Posting (バージョン1のみ)
+	sectionStored   sectionID = 4 // gobのmap[int]string (バージョン3以降は本文のレコード、4以降は圧縮)
+
+	sectionTerms         sectionID = 5 // 単語辞書 (バージョン2以降)
+	sectionPostingBlocks sectionID = 6 // 圧縮ポスティング (バージョン2以降)
+	sectionDocOffsets    sectionID = 7 // sectionDocsのレコードの位置 (バージョン3以降)
+	sectionStoredOffsets sectionID = 8 // sectionStoredのレコードの位置 (バージョン3以降)
+)
+
+func (id sectionID) String() string {
+	switch id {
+	case sectionHeader:
+		return "header"
+	case sectionDocs:
+		return "docs"
+	case sectionPostings:
+		return "postings"
+	case sectionStored:
+		return "stored"
+	case sectionTerms:
+		return "terms"
+	case sectionPostingBlocks:
+		return "posting blocks"
+	case sectionDocOffsets:
+		return "doc offsets"
+	case sectionStoredOffsets:
+		return "stored offsets"
+	}
+	return fmt.Sprintf("section(%d)", uint16(id))
+}
+
+// Header はインデックスファイルのメタデータです。
+type Header struct {
+	FormatVersion int       `json:"format_version"`
+	Analyzer      string    `json:"analyzer"` // インデックス作成時のトークナイザ設定
+	CreatedAt     time.Time `json:"created_at"`
+	NextDocID     int       `json:"next_doc_id"`
+	DocCount      int       `json:"doc_count"`
+	TermCount     int       `json:"term_count"`
+	StoreContent  bool      `json:"store_content,omitempty"` // ファイルの本文も保存しているか
+}
+
+type section struct {
+	id      sectionID
+	payload []byte
+}
+
+type sectionEntry struct {
+	id     sectionID
+	offset uint64
+	length uint64
+	crc    uint32
+}
+
+// writeSections はヘッダとセクション表に続けて各セクションを書き出します。
+func writeSections(w io.Writer, version uint16, sections []section) error {
+	var table bytes.Buffer
+	table.Write(magic[:])
+	binary.Write(&table, binary.LittleEndian, version)
+	binary.Write(&table, binary.LittleEndian, uint16(len(sections)))
+	if version >= preambleCRCVersion {
+		binary.Write(&table, binary.LittleEndian, crc32.Checksum(table.Bytes(), crcTable))
+	}
+
+	offset := uint64(tableStart(version) + len(sections)*sectionEntrySize + 4)
+	for _, s := range sections {
+		binary.Write(&table, binary.LittleEndian, uint16(s.id))
+		binary.Write(&table, binary.LittleEndian, offset)
+		binary.Write(&table, binary.LittleEndian, uint64(len(s.payload)))
+		binary.Write(&table, binary.LittleEndian, crc32.Checksum(s.payload, crcTable))
+		offset += uint64(len(s.payload))
+	}
+	binary.Write(&table, binary.LittleEndian, crc32.Checksum(table.Bytes(), crcTable))
+
+	if _, err := w.Write(table.Bytes()); err != nil {
+		return err
+	}
+	for _, s := range sections {
+		if _, err := w.Write(s.payload); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hasMagic はデータが現行フォーマットのインデックスファイルかどうかを返します。
+func hasMagic(data []byte) bool {
+	return len(data) >= len(magic) && bytes.Equal(data[:len(magic)], magic[:])
+}
+
+// tableStart はセクション表の最初のエントリの位置を返します。
+func tableStart(version uint16) int {
+	if version >= preambleCRCVersion {
+		return preambleSize + 4
+	}
+	return preambleSize
+}
+
+// readSectionTable はセクション表を検証して読み込みます。セクションの中身のCRCは検証しません。
+//
+// バージョン7以降を名乗るファイルは、バージョンを信用する前にpreambleCRCを検証します。
+// それより前のバージョンを名乗るファイルは、バージョンも含むtableCRCで検証されます。
+func readSectionTable(data []byte) (uint16, []sectionEntry, error) {
+	if len(data) < preambleSize+4 {
+		return 0, nil, fmt.Errorf("%w: file too short (%d bytes)", ErrCorruptIndex, len(data))
+	}
+	version := binary.LittleEndian.Uint16(data[8:10])
+	if version >= preambleCRCVersion {
+		if crc32.Checksum(data[:preambleSize], crcTable) != binary.LittleEndian.Uint32(data[preambleSize:preambleSize+4]) {
+			return version, nil, fmt.Errorf("%w: preamble checksum mismatch", ErrCorruptIndex)
+		}
+		if version > FormatVersion {
+			return version, nil, fmt.Errorf("%w: file has format version %d, this build reads up to version %d", ErrUnsupportedVersion, version, FormatVersion)
+		}
+	}
+	count := int(binary.LittleEndian.Uint16(data[10:12]))
+	start := tableStart(version)
+	tableEnd := start + count*sectionEntrySize
+	if len(data) < tableEnd+4 {
+		return version, nil, fmt.Errorf("%w: truncated section table", ErrCorruptIndex)
+	}
+	if crc32.Checksum(data[:tableEnd], crcTable) != binary.LittleEndian.Uint32(data[tableEnd:tableEnd+4]) {
+		return version, nil, fmt.Errorf("%w: section table checksum mismatch", ErrCorruptIndex)
+	}
+
+	entries := make([]sectionEntry, count)
+	for i := range entries {
+		p := data[start+i*sectionEntrySize:]
+		entries[i] = sectionEntry{
+			id:     sectionID(binary.LittleEndian.Uint16(p[0:2])),
+			offset: binary.LittleEndian.Uint64(p[2:10]),
+			length: binary.LittleEndian.Uint64(p[10:18]),
+			crc:    binary.LittleEndian.Uint32(p[18:22]),
+		}
+		if entries[i].offset > uint64(len(data)) || entries[i].length > uint64(len(data))-entries[i].offset {
+			return version, nil, fmt.Errorf("%w: %s section points outside the file", ErrCorruptIndex, entries[i].id)
+		}
+	}
+	return version, entries, nil
+}
+
+// readSections はセクション表を読み込み、各セクションのCRCを検証して中身を返します。
+func readSections(data []byte) (uint16, map[sectionID][]byte, error) {
+	version, entries, err := readSectionTable(data)
+	if err != nil {
+		return version, nil, err
+	}
+	sections := make(map[sectionID][]byte, len(entries))
+	for _, e := range entries {
+		payload := data[e.offset : e.offset+e.length]
+		if crc32.Checksum(payload, crcTable) != e.crc {
+			return version, nil, fmt.Errorf("%w: %s section checksum mismatch", ErrCorruptIndex, e.id)
+		}
+		sections[e.id] = payload
+	}
+	return version, sections, nil
+}
@@ -0,0 +1,115 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// lockSuffix はインデックスのロックファイルに付ける接尾辞です。
+// インデックスファイルはリネームで置き換えられるため、ロックは別のファイルに対して取ります。
+const lockSuffix = ".lock"
+
+// DefaultLockTimeout はロックの取得を待つ既定の時間です。
+const DefaultLockTimeout = 10 * time.Second
+
+// lockRetryInterval はロックが取れなかったときに再試行するまでの間隔です。
+const lockRetryInterval = 50 * time.Millisecond
+
+// ErrLocked は待ち時間内にロックを取得できなかった場合に返されます。
+var ErrLocked = errors.New("index is locked by another process")
+
+// Lock はインデックスに対するプロセス間のアドバイザリロックです。
+// 書き込み側は排他ロック、読み取り側は共有ロックを取ります。
+type Lock struct {
+	file      *os.File
+	exclusive bool
+}
+
+func lockPath(indexPath string) string {
+	return indexPath + lockSuffix
+}
+
+// LockExclusive はインデックスを書き込むための排他ロックを取得します。
+// 他のプロセスがロックを持っている間はtimeoutまで待ち、取れなければErrLockedを返します。
+func LockExclusive(indexPath string, timeout time.Duration) (*Lock, error) {
+	return acquireLock(indexPath, true, timeout)
+}
+
+// LockShared はインデックスを読むための共有ロックを取得します。
+// 共有ロックは同時に複数取れますが、排他ロックとは両立しません。
+func LockShared(indexPath string, timeout time.Duration) (*Lock, error) {
+	return acquireLock(indexPath, false, timeout)
+}
+
+func acquireLock(indexPath string, exclusive bool, timeout time.Duration) (*Lock, error) {
+	path := lockPath(indexPath)
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil && !exclusive && os.IsPermission(err) {
+		// 書き込めない場所にあるインデックスでも検索はできるようにする
+		f, err = os.Open(path)
+		if os.IsNotExist(err) {
+			return &Lock{}, nil
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open lock file %s: %w", path, err)
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLock(f, exclusive)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock %s: %w", path, err)
+		}
+		if ok {
+			break
+		}
+		if !time.Now().Before(deadline) {
+			holder := lockHolder(f)
+			f.Close()
+			return nil, fmt.Errorf("%w: %s (%s, waited %s)", ErrLocked, indexPath, holder, timeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+
+	if exclusive {
+		// 待っている側がエラーに表示できるよう、ロックを持つプロセスのPIDを書いておく
+		if err := f.Truncate(0); err == nil {
+			f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+		}
+	}
+	return &Lock{file: f, exclusive: exclusive}, nil
+}
+
+// lockHolder はロックファイルに書かれたPIDからロックを持つプロセスの説明を返します。
+// PIDが書かれていなければ、共有ロックを持つ読み取り側が待たせているとみなします。
+func lockHolder(f *os.File) string {
+	buf := make([]byte, 32)
+	n, _ := f.ReadAt(buf, 0)
+	pid, err := strconv.Atoi(strings.TrimSpace(string(buf[:n])))
+	if err != nil || pid <= 0 {
+		return "held by a reader"
+	}
+	return fmt.Sprintf("held by pid %d", pid)
+}
+
+// Unlock はロックを解放します。nilのLockに対しては何もしません。
+func (l *Lock) Unlock() error {
+	if l == nil || l.file == nil {
+		return nil
+	}
+	if l.exclusive {
+		l.file.Truncate(0) // 解放後に古いPIDが表示されないようにする
+	}
+	err := unlockFile(l.file)
+	if closeErr := l.file.Close(); err == nil {
+		err = closeErr
+	}
+	l.file = nil
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !unix
+
+package store
+
+import "os"
+
+// tryLock はflockを使えないプラットフォームでは常に成功します (ロックなし)。
+func tryLock(f *os.File, exclusive bool) (bool, error) {
+	return true, nil
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
@@ -0,0 +1,60 @@
+//go:build unix
+
+package store
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLockExcludesWritersAndReaders(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	writer, err := LockExclusive(path, time.Second)
+	if err != nil {
+		t.Fatalf("LockExclusive() error = %v", err)
+	}
+
+	_, err = LockShared(path, 100*time.Millisecond)
+	if !errors.Is(err, ErrLocked) {
+		t.Fatalf("LockShared() while writing error = %v, want ErrLocked", err)
+	}
+	if want := fmt.Sprintf("pid %d", os.Getpid()); !strings.Contains(err.Error(), want) {
+		t.Errorf("error %q does not name the holder (%s)", err, want)
+	}
+	if err := writer.Unlock(); err != nil {
+		t.Fatal(err)
+	}
+
+	r1, err := LockShared(path, time.Second)
+	if err != nil {
+		t.Fatalf("LockShared() error = %v", err)
+	}
+	r2, err := LockShared(path, time.Second)
+	if err != nil {
+		t.Fatalf("second LockShared() error = %v", err)
+	}
+	_, err = LockExclusive(path, 100*time.Millisecond)
+	if !errors.Is(err, ErrLocked) || !strings.Contains(err.Error(), "reader") {
+		t.Errorf("LockExclusive() while reading error = %v, want ErrLocked held by a reader", err)
+	}
+	r1.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		l, err := LockExclusive(path, 2*time.Second)
+		if err == nil {
+			err = l.Unlock()
+		}
+		done <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	r2.Unlock()
+	if err := <-done; err != nil {
+		t.Errorf("LockExclusive() after readers finished error = %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gmi/indexer"
+	"gmi/tokenizer"
+	"gmi/ui"
+	"hash/crc32"
+	"os"
+)
+
+// errNotMappable は遅延読み込みに対応していない古いフォーマットのファイルを表します。
+var errNotMappable = errors.New("index format does not support lazy loading")
+
+// ReadCloser はClose可能な読み取り専用のインデックスです。
+type ReadCloser interface {
+	indexer.Reader
+	Close() error
+}
+
+// MappedIndex はメモリマップしたインデックスファイルへの読み取り専用のアクセスです。
+// 開く際には単語辞書を展開せず、間引いた単語の索引だけをメモリに読み込みます。ポスティングやドキュメントは
+// 要求されたものだけを展開するため、検索の待ち時間がインデックスの大きさに左右されません。
+//
+// 開く際に検証するのはセクション表とヘッダ・単語辞書・オフセット表のCRCだけです。
+// ポスティングと本文のCRCは全体を読み込むLoadIndexで検証されます。
+type MappedIndex struct {
+	header   Header
+	version  uint16
+	data     []byte
+	unmap    func() error
+	terms    *termDict
+	postings []byte
+	docs     recordTable
+	stored   recordTable
+}
+
+// OpenMapped はインデックスファイルをメモリマップして開きます。
+// バージョン3より前のフォーマットのファイルには対応していません。
+func OpenMapped(filePath string) (m *MappedIndex, err error) {
+	f, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, unmap, err := mapFile(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to map index file %s: %w", filePath, err)
+	}
+	defer func() {
+		if err != nil {
+			unmap()
+		}
+	}()
+
+	if !hasMagic(data) {
+		return nil, errNotMappable
+	}
+	version, entries, err := readSectionTable(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open index file %s: %w", filePath, err)
+	}
+	if version < 3 {
+		return nil, errNotMappable
+	}
+
+	sections := make(map[sectionID][]byte, len(entries))
+	for _, e := range entries {
+		payload := data[e.offset : e.offset+e.length]
+		switch e.id {
+		case sectionHeader, sectionTerms, sectionDocOffsets, sectionStoredOffsets:
+			if crc32.Checksum(payload, crcTable) != e.crc {
+				return nil, fmt.Errorf("failed to open index file %s: %w: %s section checksum mismatch", filePath, ErrCorruptIndex, e.id)
+			}
+		}
+		sections[e.id] = payload
+	}
+
+	m = &MappedIndex{version: version, data: data, unmap: unmap, postings: sections[sectionPostingBlocks]}
+	if m.header, err = decodeHeader(sections); err != nil {
+		return nil, err
+	}
+	if m.header.Analyzer != tokenizer.Analyzer {
+		fmt.Fprintf(os.Stderr, "%s index was built with analyzer %q but this build uses %q; rebuild the index for accurate results.\n",
+			ui.Yellow("Warning:"), m.header.Analyzer, tokenizer.Analyzer)
+	}
+	if m.terms, err = openTermDict(version, sections[sectionTerms]); err != nil {
+		return nil, err
+	}
+	if m.docs, err = recordSections(sections, sectionDocOffsets, sectionDocs); err != nil {
+		return nil, err
+	}
+	if m.stored, err = recordSections(sections, sectionStoredOffsets, sectionStored); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// OpenReader は検索用にインデックスファイルを開きます。
+// 現行フォーマットのファイルはメモリマップし、古いフォーマットのファイルや
+// 開けなかったファイルはLoadIndexで全体を読み込みます (バックアップへの切り替えも行われます)。
+func OpenReader(filePath string) (ReadCloser, error) {
+	m, err := OpenMapped(filePath)
+	if err == nil {
+		fmt.Fprintf(os.Stderr, "%s Index mapped from %s. Terms: %d, Docs: %d\n", ui.Cyan("ℹ"), filePath, m.terms.len(), m.NumDocs())
+		return m, nil
+	}
+	if !errors.Is(err, errNotMappable) && !errors.Is(err, ErrCorruptIndex) && !os.IsNotExist(err) {
+		return nil, err
+	}
+	idx, err := LoadIndex(filePath)
+	if err != nil {
+		return nil, err
+	}
+	return memoryReader{idx}, nil
+}
+
+// Header はインデックスファイルのヘッダを返します。
+func (m *MappedIndex) Header() Header {
+	return m.header
+}
+
+// Postings は単語のポスティングを展開して返します。
+func (m *MappedIndex) Postings(term string) ([]indexer.Posting, error) {
+	e, ok := m.terms.lookup(term)
+	if !ok {
+		return nil, nil
+	}
+	data, err := m.postingsData(e)
+	if err != nil {
+		return nil, err
+	}
+	postings, err := decodePostings(m.version, data)
+	if err != nil {
+		return nil, fmt.Errorf("postings of term %q: %w", term, err)
+	}
+	return postings, nil
+}
+
+// Iterator は単語のポスティングを、たどった位置のブロックだけ展開するイテレータを返します。
+// frequencyの最大値を持たないバージョン4以前のファイルでは、全て展開してから上限を計算します。
+func (m *MappedIndex) Iterator(term string) (indexer.PostingIterator, error) {
+	e, ok := m.terms.lookup(term)
+	if !ok {
+		return indexer.NewSliceIterator(nil), nil
+	}
+	if m.version < 5 {
+		postings, err := m.Postings(term)
+		if err != nil {
+			return nil, err
+		}
+		return indexer.NewSliceIterator(postings), nil
+	}
+	data, err := m.postingsData(e)
+	if err != nil {
+		return nil, err
+	}
+	bp, err := openPostings(m.version, data)
+	if err != nil {
+		return nil, fmt.Errorf("postings of term %q: %w", term, err)
+	}
+	it, err := newBlockIterator(bp, e.docFreq, e.maxFreq)
+	if err != nil {
+		return nil, fmt.Errorf("postings of term %q: %w", term, err)
+	}
+	return it, nil
+}
+
+// postingsData は単語辞書のエントリが指すポスティングのバイト列を返します。
+func (m *MappedIndex) postingsData(e termEntry) ([]byte, error) {
+	if e.offset > uint64(len(m.postings)) || e.length > uint64(len(m.postings))-e.offset {
+		return nil, fmt.Errorf("%w: postings of term %q point outside the section", ErrCorruptIndex, e.term)
+	}
+	return m.postings[e.offset : e.offset+e.length], nil
+}
+
+// Document はドキュメントIDのレコードを展開して返します。
+func (m *MappedIndex) Document(id int) (indexer.Document, bool) {
+	record, ok, err := m.docs.lookup(id)
+	if err != nil || !ok {
+		return indexer.Document{}, false
+	}
+	var doc indexer.Document
+	if err := json.Unmarshal(record, &doc); err != nil {
+		return indexer.Document{}, false
+	}
+	return doc, true
+}
+
+// Documents は全ドキュメントをIDの昇順で展開して返します。
+func (m *MappedIndex) Documents() ([]indexer.Document, error) {
+	docs := make([]indexer.Document, 0, m.docs.len())
+	for i := 0; i < m.docs.len(); i++ {
+		id, record, err := m.docs.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		var doc indexer.Document
+		if err := json.Unmarshal(record, &doc); err != nil {
+			return nil, fmt.Errorf("%w: invalid document record %d: %v", ErrCorruptIndex, id, err)
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// NumDocs はインデックス内のドキュメント数を返します。
+func (m *MappedIndex) NumDocs() int {
+	return m.docs.len()
+}
+
+// Terms はprefixで始まる単語とそれを含むドキュメント数を単語辞書から返します。
+func (m *MappedIndex) Terms(prefix string) ([]indexer.TermStat, error) {
+	var terms []indexer.TermStat
+	for _, e := range m.terms.withPrefix(prefix) {
+		terms = append(terms, indexer.TermStat{Term: e.term, DocFreq: e.docFreq})
+	}
+	return terms, nil
+}
+
+// Content はインデックスに保存された本文か、ファイルを読み直した本文を返します。
+func (m *MappedIndex) Content(doc indexer.Document) (string, error) {
+	record, ok, err := m.stored.lookup(doc.ID)
+	if err != nil {
+		return "", err
+	}
+	if ok {
+		return decodeStoredRecord(m.version, doc.ID, record)
+	}
+	if !doc.IsFile() {
+		return "", fmt.Errorf("no stored content for %s document %q", doc.Source, doc.Path)
+	}
+	return indexer.ReadFileContent(doc)
+}
+
+// Close はメモリマップを解除します。返したポスティングやドキュメントはコピーなので、Close後も使えます。
+func (m *MappedIndex) Close() error {
+	if m.unmap == nil {
+		return nil
+	}
+	err := m.unmap()
+	m.unmap = nil
+	m.data = nil
+	return err
+}
+
+// memoryReader はメモリ上のInvertedIndexをReadCloserとして扱います。
+type memoryReader struct {
+	*indexer.InvertedIndex
+}
+
+func (memoryReader) Close() error { return nil }
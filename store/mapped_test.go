@@ -0,0 +1,146 @@
+package store
+
+import (
+	"fmt"
+	"gmi/indexer"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestMappedIndexMatchesLoadedIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	idx := newTestIndex(t)
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatalf("OpenMapped() error = %v", err)
+	}
+	defer m.Close()
+
+	if m.NumDocs() != idx.NumDocs() {
+		t.Errorf("NumDocs() = %d, want %d", m.NumDocs(), idx.NumDocs())
+	}
+	for term, want := range idx.Index {
+		got, err := m.Postings(term)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("Postings(%q) = %+v, %v; want %+v", term, got, err, want)
+		}
+	}
+	if got, err := m.Postings("missing"); got != nil || err != nil {
+		t.Errorf("Postings(missing) = %+v, %v; want nil", got, err)
+	}
+	for id, want := range idx.Docs {
+		got, ok := m.Document(id)
+		if !ok || !reflect.DeepEqual(got.Path, want.Path) || got.Source != want.Source {
+			t.Errorf("Document(%d) = %+v, %v; want %+v", id, got, ok, want)
+		}
+	}
+	note, _ := idx.FindDocument("note-1")
+	if content, err := m.Content(note); err != nil || content != "stored note about go" {
+		t.Errorf("Content(note-1) = %q, %v", content, err)
+	}
+}
+
+func TestOpenReaderFallsBackForMissingFile(t *testing.T) {
+	r, err := OpenReader(filepath.Join(t.TempDir(), "missing.idx"))
+	if err != nil {
+		t.Fatalf("OpenReader() error = %v", err)
+	}
+	defer r.Close()
+	if r.NumDocs() != 0 {
+		t.Errorf("NumDocs() = %d, want 0", r.NumDocs())
+	}
+}
+
+func TestMappedIndexReadsCompressedStoredContent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	idx := indexer.NewInvertedIndex()
+	idx.StoreContent = true
+	text := strings.Repeat("compressible file text ", 100)
+	id, err := idx.AddDocument(indexer.Document{Path: "/gone/a.txt", Source: indexer.SourceFile}, text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatal(err)
+	}
+	if info, _ := os.Stat(path); info.Size() >= int64(len(text)) {
+		t.Errorf("index size %d is not smaller than the stored text (%d bytes)", info.Size(), len(text))
+	}
+
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if !m.Header().StoreContent {
+		t.Error("Header().StoreContent = false")
+	}
+	doc, _ := m.Document(id)
+	if content, err := m.Content(doc); err != nil || content != text {
+		t.Errorf("Content() = %q, %v; want the stored text", content, err)
+	}
+
+	loaded, err := LoadIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loaded.StoreContent || loaded.Stored[id] != text {
+		t.Errorf("LoadIndex() StoreContent = %v, stored text intact = %v", loaded.StoreContent, loaded.Stored[id] == text)
+	}
+}
+
+func TestMappedIndexLooksUpTermsAcrossDictionarySamples(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	idx := indexer.NewInvertedIndex()
+	var words []string
+	for i := 0; i < 3*termDictSampleInterval+5; i++ {
+		words = append(words, fmt.Sprintf("w%04d", i))
+	}
+	if _, err := idx.AddDocument(indexer.Document{Path: "words", Source: indexer.SourceStdin}, strings.Join(words, " ")); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatal(err)
+	}
+	m, err := OpenMapped(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+
+	for term := range idx.Index {
+		if postings, err := m.Postings(term); err != nil || len(postings) != 1 {
+			t.Errorf("Postings(%q) = %+v, %v; want 1 posting", term, postings, err)
+		}
+	}
+	for _, missing := range []string{"a", "w0063x", "w9999", "zzz"} {
+		if postings, err := m.Postings(missing); postings != nil || err != nil {
+			t.Errorf("Postings(%q) = %+v, %v; want nil", missing, postings, err)
+		}
+	}
+	var want []string
+	for term := range idx.Index {
+		if strings.HasPrefix(term, "w01") {
+			want = append(want, term)
+		}
+	}
+	sort.Strings(want)
+	terms, err := m.Terms("w01")
+	var got []string
+	for _, ts := range terms {
+		got = append(got, ts.Term)
+	}
+	if err != nil || len(want) < termDictSampleInterval || !reflect.DeepEqual(got, want) {
+		t.Errorf("Terms(w01) = %v, %v; want %v", got, err, want)
+	}
+	if all, _ := m.Terms(""); len(all) != len(idx.Index) {
+		t.Errorf("Terms(\"\") = %d terms, want %d", len(all), len(idx.Index))
+	}
+}
@@ -0,0 +1,484 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"gmi/indexer"
+	"sort"
+	"strings"
+)
+
+// postingsBlockSize は1ブロックに格納するポスティングの数です。
+const postingsBlockSize = 128
+
+// 圧縮ポスティングの形式 (数値は全てuvarint)
+//
+// 単語辞書セクション (sectionTerms)
+//
+//	termCount
+//	termCount個の {len(term), term, docFreq, maxFreq, offset, length}  単語の辞書順
+//
+// ポスティングセクション (sectionPostingBlocks) は単語ごとのリストを連結したもので、
+// 辞書のoffset/lengthが各リストの範囲を指します。1つのリストは
+//
+//	blockCount
+//	blockCount個のスキップ情報 {lastDocIDの差分, ブロックのバイト長, maxFreq}
+//	ブロック本体 (最大postingsBlockSize件の {docIDの差分, frequency, frequency個の位置の差分,
+//	             offsetCount, offsetCount個のバイトオフセットの差分})
+//
+// docIDの差分はリスト内の直前のポスティングから、位置とバイトオフセットの差分は同じポスティング内の直前の値からのものです。
+// offsetCountはバイトオフセットを記録していないポスティングでは0、それ以外ではfrequencyです。
+// スキップ情報を使うと、目的のdocIDを含まないブロックを展開せずに読み飛ばせます。
+//
+// maxFreqは単語全体またはブロック内のfrequencyの最大値で、検索時のWANDがスコアの上限の計算に使います。
+// バージョン4以前のファイルにはmaxFreqが、バージョン5以前のファイルにはoffsetCountとバイトオフセットがありません。
+
+// termEntry は単語辞書の1エントリです。
+type termEntry struct {
+	term    string
+	docFreq int
+	maxFreq int // バージョン4以前のファイルでは0
+	offset  uint64
+	length  uint64
+}
+
+// encodeTermPostings は全単語のポスティングを圧縮し、単語辞書とポスティングのセクションを返します。
+func encodeTermPostings(index map[string][]indexer.Posting) (dict []byte, blob []byte) {
+	terms := make([]string, 0, len(index))
+	for term := range index {
+		terms = append(terms, term)
+	}
+	sort.Strings(terms)
+
+	dict = binary.AppendUvarint(dict, uint64(len(terms)))
+	for _, term := range terms {
+		start := len(blob)
+		blob = appendPostings(blob, index[term])
+		dict = binary.AppendUvarint(dict, uint64(len(term)))
+		dict = append(dict, term...)
+		dict = binary.AppendUvarint(dict, uint64(len(index[term])))
+		dict = binary.AppendUvarint(dict, uint64(maxFrequency(index[term])))
+		dict = binary.AppendUvarint(dict, uint64(start))
+		dict = binary.AppendUvarint(dict, uint64(len(blob)-start))
+	}
+	return dict, blob
+}
+
+// maxFrequency はポスティングのfrequencyの最大値を返します。
+func maxFrequency(postings []indexer.Posting) int {
+	m := 0
+	for _, p := range postings {
+		m = max(m, len(p.Positions))
+	}
+	return m
+}
+
+// decodeTermPostings は単語辞書とポスティングのセクションから全単語のポスティングを復元します。
+func decodeTermPostings(version uint16, dict []byte, blob []byte) (map[string][]indexer.Posting, error) {
+	entries, err := decodeTermDict(version, dict)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string][]indexer.Posting, len(entries))
+	for _, e := range entries {
+		if e.offset > uint64(len(blob)) || e.length > uint64(len(blob))-e.offset {
+			return nil, fmt.Errorf("%w: postings of term %q point outside the section", ErrCorruptIndex, e.term)
+		}
+		postings, err := decodePostings(version, blob[e.offset:e.offset+e.length])
+		if err != nil {
+			return nil, fmt.Errorf("postings of term %q: %w", e.term, err)
+		}
+		if len(postings) != e.docFreq {
+			return nil, fmt.Errorf("%w: term %q has %d postings, dictionary says %d", ErrCorruptIndex, e.term, len(postings), e.docFreq)
+		}
+		index[e.term] = postings
+	}
+	return index, nil
+}
+
+// decodeTermDict は単語辞書セクションを読み込みます。
+func decodeTermDict(version uint16, dict []byte) ([]termEntry, error) {
+	r := uvarintReader{data: dict}
+	count := r.next()
+	if r.err != nil || count > uint64(len(dict)) {
+		return nil, fmt.Errorf("%w: invalid term dictionary", ErrCorruptIndex)
+	}
+	entries := make([]termEntry, 0, count)
+	for i := uint64(0); i < count; i++ {
+		term, e := readTermEntry(&r, version)
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: invalid term dictionary entry %d", ErrCorruptIndex, i)
+		}
+		e.term = string(term)
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// readTermEntry は単語辞書の1エントリを読み込みます。単語は辞書のバイト列を指したまま返し、e.termは設定しません。
+func readTermEntry(r *uvarintReader, version uint16) (term []byte, e termEntry) {
+	term = r.bytes(r.next())
+	e.docFreq = int(r.next())
+	if version >= 5 {
+		e.maxFreq = int(r.next())
+	}
+	e.offset, e.length = r.next(), r.next()
+	return term, e
+}
+
+// termDictSampleInterval はtermDictが単語と位置を覚えておくエントリの間隔です。
+const termDictSampleInterval = 64
+
+// termDict は単語辞書セクションを展開せずに引くための索引です。
+// エントリは単語の辞書順に並んでいるため、termDictSampleInterval件ごとの単語と位置だけを持ち、
+// 二分探索で見つけた区間をバイト列から順に読んで目的のエントリを探します。
+type termDict struct {
+	version uint16
+	data    []byte
+	count   int
+	samples []termSample
+}
+
+// termSample はtermDictが覚えておくエントリの単語と、辞書セクション内の位置です。
+type termSample struct {
+	term string
+	pos  int
+}
+
+// openTermDict は単語辞書セクションを1度走査し、エントリが壊れておらず辞書順に並んでいることを確かめて索引を作ります。
+func openTermDict(version uint16, dict []byte) (*termDict, error) {
+	r := uvarintReader{data: dict}
+	count := r.next()
+	if r.err != nil || count > uint64(len(dict)) {
+		return nil, fmt.Errorf("%w: invalid term dictionary", ErrCorruptIndex)
+	}
+	d := &termDict{version: version, data: dict, count: int(count)}
+	var prev []byte
+	for i := 0; i < d.count; i++ {
+		pos := r.pos
+		term, _ := readTermEntry(&r, version)
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: invalid term dictionary entry %d", ErrCorruptIndex, i)
+		}
+		if i > 0 && bytes.Compare(prev, term) >= 0 {
+			return nil, fmt.Errorf("%w: term dictionary entry %d is out of order", ErrCorruptIndex, i)
+		}
+		if i%termDictSampleInterval == 0 {
+			d.samples = append(d.samples, termSample{term: string(term), pos: pos})
+		}
+		prev = term
+	}
+	return d, nil
+}
+
+// len は辞書の単語数を返します。
+func (d *termDict) len() int {
+	return d.count
+}
+
+// lookup は単語のエントリを返します。
+func (d *termDict) lookup(term string) (termEntry, bool) {
+	i := sort.Search(len(d.samples), func(i int) bool { return d.samples[i].term > term })
+	if i == 0 {
+		return termEntry{}, false
+	}
+	found := false
+	var entry termEntry
+	d.scan(i-1, func(t []byte, e termEntry) bool {
+		if string(t) < term {
+			return true
+		}
+		if string(t) == term {
+			entry, found = e, true
+			entry.term = term
+		}
+		return false
+	})
+	return entry, found
+}
+
+// withPrefix はprefixで始まる単語のエントリを辞書順に返します。
+func (d *termDict) withPrefix(prefix string) []termEntry {
+	i := sort.Search(len(d.samples), func(i int) bool { return d.samples[i].term >= prefix })
+	var entries []termEntry
+	d.scan(max(i-1, 0), func(t []byte, e termEntry) bool {
+		if string(t) < prefix {
+			return true
+		}
+		if !strings.HasPrefix(string(t), prefix) {
+			return false
+		}
+		e.term = string(t)
+		entries = append(entries, e)
+		return true
+	})
+	return entries
+}
+
+// scan はsample番目の索引の位置から辞書の終わりまで、fnがfalseを返すまでエントリを順に渡します。
+// 辞書はopenTermDictで検証済みのため、読み込みのエラーは起きません。
+func (d *termDict) scan(sample int, fn func(term []byte, e termEntry) bool) {
+	if sample >= len(d.samples) {
+		return
+	}
+	r := uvarintReader{data: d.data, pos: d.samples[sample].pos}
+	for i := sample * termDictSampleInterval; i < d.count; i++ {
+		term, e := readTermEntry(&r, d.version)
+		if r.err != nil || !fn(term, e) {
+			return
+		}
+	}
+}
+
+// appendPostings は1単語分のポスティングリストを圧縮してbufに追加します。
+func appendPostings(buf []byte, postings []indexer.Posting) []byte {
+	sorted := postings
+	if !sort.SliceIsSorted(postings, func(i, j int) bool { return postings[i].DocID < postings[j].DocID }) {
+		sorted = append([]indexer.Posting(nil), postings...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i].DocID < sorted[j].DocID })
+	}
+
+	blockCount := (len(sorted) + postingsBlockSize - 1) / postingsBlockSize
+	var skips, blocks []byte
+	prevDocID, prevBlockLast := 0, 0
+	for b := 0; b < blockCount; b++ {
+		end := min((b+1)*postingsBlockSize, len(sorted))
+		blockStart := len(blocks)
+		blockMax := maxFrequency(sorted[b*postingsBlockSize : end])
+		for _, p := range sorted[b*postingsBlockSize : end] {
+			blocks = binary.AppendUvarint(blocks, uint64(p.DocID-prevDocID))
+			blocks = binary.AppendUvarint(blocks, uint64(len(p.Positions)))
+			prevPos := 0
+			for _, pos := range p.Positions {
+				blocks = binary.AppendUvarint(blocks, uint64(pos-prevPos))
+				prevPos = pos
+			}
+			offsets := p.Offsets
+			if len(offsets) != len(p.Positions) {
+				offsets = nil
+			}
+			blocks = binary.AppendUvarint(blocks, uint64(len(offsets)))
+			prevOffset := 0
+			for _, off := range offsets {
+				blocks = binary.AppendUvarint(blocks, uint64(off-prevOffset))
+				prevOffset = off
+			}
+			prevDocID = p.DocID
+		}
+		skips = binary.AppendUvarint(skips, uint64(prevDocID-prevBlockLast))
+		skips = binary.AppendUvarint(skips, uint64(len(blocks)-blockStart))
+		skips = binary.AppendUvarint(skips, uint64(blockMax))
+		prevBlockLast = prevDocID
+	}
+
+	buf = binary.AppendUvarint(buf, uint64(blockCount))
+	buf = append(buf, skips...)
+	return append(buf, blocks...)
+}
+
+// skipEntry はブロックのスキップ情報です。
+type skipEntry struct {
+	lastDocID int // ブロック内の最後のdocID
+	firstPrev int // ブロックの直前のdocID (ブロック先頭の差分の基準)
+	offset    int // リスト先頭からのブロック本体の位置
+	length    int
+	maxFreq   int // ブロック内のfrequencyの最大値 (バージョン4以前のファイルでは0)
+}
+
+// blockPostings は圧縮された1単語分のポスティングリストです。
+type blockPostings struct {
+	version uint16
+	data    []byte
+	skips   []skipEntry
+}
+
+// openPostings はポスティングリストのスキップ情報だけを読み込みます。
+func openPostings(version uint16, data []byte) (*blockPostings, error) {
+	r := uvarintReader{data: data}
+	blockCount := r.next()
+	if r.err != nil || blockCount > uint64(len(data)) {
+		return nil, fmt.Errorf("%w: invalid postings block count", ErrCorruptIndex)
+	}
+	skips := make([]skipEntry, blockCount)
+	prevLast := 0
+	for i := range skips {
+		skips[i].firstPrev = prevLast
+		skips[i].lastDocID = prevLast + int(r.next())
+		skips[i].length = int(r.next())
+		if version >= 5 {
+			skips[i].maxFreq = int(r.next())
+		}
+		prevLast = skips[i].lastDocID
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: invalid postings skip data", ErrCorruptIndex)
+	}
+	offset := r.pos
+	for i := range skips {
+		skips[i].offset = offset
+		offset += skips[i].length
+	}
+	if offset != len(data) {
+		return nil, fmt.Errorf("%w: postings blocks do not match skip data", ErrCorruptIndex)
+	}
+	return &blockPostings{version: version, data: data, skips: skips}, nil
+}
+
+// findBlock はdocID以上のポスティングを含む可能性のある最初のブロックの番号を返します。
+// 該当するブロックがなければブロック数を返します。
+func (bp *blockPostings) findBlock(docID int) int {
+	return sort.Search(len(bp.skips), func(i int) bool { return bp.skips[i].lastDocID >= docID })
+}
+
+// decodeBlock はi番目のブロックを展開してpostingsに追加します。
+func (bp *blockPostings) decodeBlock(i int, postings []indexer.Posting) ([]indexer.Posting, error) {
+	s := bp.skips[i]
+	r := uvarintReader{data: bp.data[s.offset : s.offset+s.length]}
+	docID := s.firstPrev
+	for r.pos < len(r.data) {
+		docID += int(r.next())
+		freq := r.next()
+		if r.err != nil || freq > uint64(len(r.data)) {
+			return nil, fmt.Errorf("%w: invalid posting in block %d", ErrCorruptIndex, i)
+		}
+		positions := make([]int, freq)
+		pos := 0
+		for j := range positions {
+			pos += int(r.next())
+			positions[j] = pos
+		}
+		var offsets []int
+		if bp.version >= 6 {
+			if n := r.next(); n > 0 {
+				if n != freq {
+					return nil, fmt.Errorf("%w: posting in block %d has %d offsets for %d positions", ErrCorruptIndex, i, n, freq)
+				}
+				offsets = make([]int, n)
+				off := 0
+				for j := range offsets {
+					off += int(r.next())
+					offsets[j] = off
+				}
+			}
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("%w: invalid positions in block %d", ErrCorruptIndex, i)
+		}
+		postings = append(postings, indexer.Posting{DocID: docID, Frequency: int(freq), Positions: positions, Offsets: offsets})
+	}
+	if docID != s.lastDocID {
+		return nil, fmt.Errorf("%w: block %d does not end at its skip entry", ErrCorruptIndex, i)
+	}
+	return postings, nil
+}
+
+// decodePostings は1単語分のポスティングリストを全て展開します。
+func decodePostings(version uint16, data []byte) ([]indexer.Posting, error) {
+	bp, err := openPostings(version, data)
+	if err != nil {
+		return nil, err
+	}
+	var postings []indexer.Posting
+	for i := range bp.skips {
+		if postings, err = bp.decodeBlock(i, postings); err != nil {
+			return nil, err
+		}
+	}
+	return postings, nil
+}
+
+// blockIterator は圧縮されたポスティングリストを、必要なブロックだけ展開しながらたどるindexer.PostingIteratorです。
+// BlockMaxはスキップ情報だけで答えるので、WANDが読み飛ばしたブロックは展開されません。
+type blockIterator struct {
+	bp       *blockPostings
+	docFreq  int
+	maxFreq  int
+	block    int               // 展開済みのブロックの番号
+	postings []indexer.Posting // 展開済みのブロックのポスティング
+	pos      int
+}
+
+// newBlockIterator は最初のブロックを展開したblockIteratorを作ります。
+func newBlockIterator(bp *blockPostings, docFreq, maxFreq int) (*blockIterator, error) {
+	it := &blockIterator{bp: bp, docFreq: docFreq, maxFreq: maxFreq}
+	return it, it.loadBlock(0)
+}
+
+func (it *blockIterator) loadBlock(b int) (err error) {
+	it.block, it.pos = b, 0
+	it.postings = it.postings[:0]
+	if b < len(it.bp.skips) {
+		it.postings, err = it.bp.decodeBlock(b, it.postings)
+	}
+	return err
+}
+
+func (it *blockIterator) Doc() int {
+	if it.pos >= len(it.postings) {
+		return indexer.NoMoreDocs
+	}
+	return it.postings[it.pos].DocID
+}
+
+func (it *blockIterator) Posting() indexer.Posting { return it.postings[it.pos] }
+
+func (it *blockIterator) Advance(target int) error {
+	if it.Doc() >= target {
+		return nil
+	}
+	if it.bp.skips[it.block].lastDocID < target {
+		if err := it.loadBlock(it.bp.findBlock(target)); err != nil {
+			return err
+		}
+	}
+	// ここではブロックの最後のdocIDがtarget以上なので、ブロック内で見つかる
+	rest := it.postings[it.pos:]
+	it.pos += sort.Search(len(rest), func(i int) bool { return rest[i].DocID >= target })
+	return nil
+}
+
+func (it *blockIterator) Len() int { return it.docFreq }
+
+func (it *blockIterator) MaxFrequency() int { return it.maxFreq }
+
+func (it *blockIterator) BlockMax(target int) (lastDocID, maxFreq int) {
+	b := it.bp.findBlock(target)
+	if b == len(it.bp.skips) {
+		return indexer.NoMoreDocs, 0
+	}
+	return it.bp.skips[b].lastDocID, it.bp.skips[b].maxFreq
+}
+
+// uvarintReader はuvarintの列を順に読み出します。最初のエラー以降の読み出しは0を返します。
+type uvarintReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *uvarintReader) next() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.data[r.pos:])
+	if n <= 0 {
+		r.err = fmt.Errorf("invalid uvarint at offset %d", r.pos)
+		return 0
+	}
+	r.pos += n
+	return v
+}
+
+func (r *uvarintReader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)-r.pos) {
+		r.err = fmt.Errorf("truncated data at offset %d", r.pos)
+		return nil
+	}
+	b := r.data[r.pos : r.pos+int(n)]
+	r.pos += int(n)
+	return b
+}
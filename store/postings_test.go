@@ -0,0 +1,170 @@
+package store
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"gmi/indexer"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// syntheticIndex はZipf分布に近い単語頻度を持つベンチマーク用のポスティングを生成します。
+func syntheticIndex(numDocs, numTerms int) map[string][]indexer.Posting {
+	rng := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(rng, 1.1, 1, uint64(numTerms-1))
+	index := make(map[string][]indexer.Posting)
+	for docID := 0; docID < numDocs; docID++ {
+		positions := make(map[string][]int)
+		for pos := 0; pos < 300; pos++ {
+			term := fmt.Sprintf("term%d", zipf.Uint64())
+			positions[term] = append(positions[term], pos)
+		}
+		for term, ps := range positions {
+			p := indexer.Posting{DocID: docID, Frequency: len(ps), Positions: ps}
+			if docID%2 == 0 {
+				// バイトオフセットを記録したポスティングと記録していないポスティングを混ぜる
+				p.Offsets = make([]int, len(ps))
+				for i, pos := range ps {
+					p.Offsets[i] = pos*7 + i
+				}
+			}
+			index[term] = append(index[term], p)
+		}
+	}
+	return index
+}
+
+func TestTermPostingsRoundTrip(t *testing.T) {
+	index := syntheticIndex(400, 2000)
+	dict, blob := encodeTermPostings(index)
+	decoded, err := decodeTermPostings(FormatVersion, dict, blob)
+	if err != nil {
+		t.Fatalf("decodeTermPostings() error = %v", err)
+	}
+	if !reflect.DeepEqual(decoded, index) {
+		t.Fatal("decoded postings differ from the original")
+	}
+}
+
+func TestFindBlockSkipsBlocks(t *testing.T) {
+	var postings []indexer.Posting
+	for docID := 0; docID < 1000; docID += 2 {
+		postings = append(postings, indexer.Posting{DocID: docID, Frequency: 1, Positions: []int{docID % 7}})
+	}
+	bp, err := openPostings(FormatVersion, appendPostings(nil, postings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bp.skips) != 4 {
+		t.Fatalf("block count = %d, want 4", len(bp.skips))
+	}
+	block := bp.findBlock(700)
+	got, err := bp.decodeBlock(block, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got[0].DocID > 700 || got[len(got)-1].DocID < 700 {
+		t.Errorf("findBlock(700) = block %d covering [%d, %d]", block, got[0].DocID, got[len(got)-1].DocID)
+	}
+	if bp.findBlock(1000) != len(bp.skips) {
+		t.Errorf("findBlock past the end = %d, want %d", bp.findBlock(1000), len(bp.skips))
+	}
+}
+
+func TestBlockIteratorAdvanceAndBlockMax(t *testing.T) {
+	var postings []indexer.Posting
+	for docID := 0; docID < 1000; docID += 2 {
+		freq := 1
+		if docID == 600 {
+			freq = 5
+		}
+		positions := make([]int, freq)
+		for i := range positions {
+			positions[i] = i
+		}
+		postings = append(postings, indexer.Posting{DocID: docID, Frequency: freq, Positions: positions})
+	}
+	bp, err := openPostings(FormatVersion, appendPostings(nil, postings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	it, err := newBlockIterator(bp, len(postings), 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if it.Doc() != 0 {
+		t.Fatalf("Doc() = %d, want 0", it.Doc())
+	}
+	// docID 600は3番目のブロック (docID 512-766) にある
+	if last, maxFreq := it.BlockMax(599); last != 766 || maxFreq != 5 {
+		t.Errorf("BlockMax(599) = (%d, %d), want (766, 5)", last, maxFreq)
+	}
+	if last, maxFreq := it.BlockMax(800); last != 998 || maxFreq != 1 {
+		t.Errorf("BlockMax(800) = (%d, %d), want (998, 1)", last, maxFreq)
+	}
+	if err := it.Advance(599); err != nil {
+		t.Fatal(err)
+	}
+	if it.Doc() != 600 || it.Posting().Frequency != 5 {
+		t.Errorf("after Advance(599): Doc() = %d, Frequency = %d", it.Doc(), it.Posting().Frequency)
+	}
+	if err := it.Advance(999); err != nil {
+		t.Fatal(err)
+	}
+	if it.Doc() != indexer.NoMoreDocs {
+		t.Errorf("Doc() past the end = %d, want NoMoreDocs", it.Doc())
+	}
+	if last, _ := it.BlockMax(999); last != indexer.NoMoreDocs {
+		t.Errorf("BlockMax past the end = %d, want NoMoreDocs", last)
+	}
+}
+
+func TestDecodePostingsRejectsCorruptData(t *testing.T) {
+	data := appendPostings(nil, []indexer.Posting{{DocID: 3, Frequency: 2, Positions: []int{1, 5}}})
+	if _, err := decodePostings(FormatVersion, data[:len(data)-1]); err == nil {
+		t.Error("decodePostings() accepted truncated data")
+	}
+}
+
+func BenchmarkPostingsEncoding(b *testing.B) {
+	index := syntheticIndex(2000, 20000)
+
+	var gobBuf bytes.Buffer
+	if err := gob.NewEncoder(&gobBuf).Encode(index); err != nil {
+		b.Fatal(err)
+	}
+	dict, blob := encodeTermPostings(index)
+
+	b.Run("gob/load", func(b *testing.B) {
+		b.ReportMetric(float64(gobBuf.Len()), "bytes")
+		for i := 0; i < b.N; i++ {
+			var decoded map[string][]indexer.Posting
+			if err := gob.NewDecoder(bytes.NewReader(gobBuf.Bytes())).Decode(&decoded); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("compact/load", func(b *testing.B) {
+		b.ReportMetric(float64(len(dict)+len(blob)), "bytes")
+		for i := 0; i < b.N; i++ {
+			if _, err := decodeTermPostings(FormatVersion, dict, blob); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("gob/save", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var buf bytes.Buffer
+			if err := gob.NewEncoder(&buf).Encode(index); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("compact/save", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			encodeTermPostings(index)
+		}
+	})
+}
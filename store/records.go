@@ -0,0 +1,77 @@
+package store
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// レコードセクションの形式 (バージョン3以降)
+//
+// ドキュメントIDごとの可変長レコードを連結した本体セクションと、
+// 固定長の {id uint64, offset uint64, length uint64} をidの昇順に並べたオフセットセクションの組です。
+// オフセットセクションを二分探索すれば、本体を全て展開せずに1件だけ取り出せます。
+const recordEntrySize = 8 + 8 + 8
+
+// encodeRecords はドキュメントIDごとのレコードを本体とオフセットのセクションにします。
+func encodeRecords(records map[int][]byte) (offsets []byte, blob []byte) {
+	ids := make([]int, 0, len(records))
+	for id := range records {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	offsets = make([]byte, 0, len(ids)*recordEntrySize)
+	for _, id := range ids {
+		offsets = binary.LittleEndian.AppendUint64(offsets, uint64(id))
+		offsets = binary.LittleEndian.AppendUint64(offsets, uint64(len(blob)))
+		offsets = binary.LittleEndian.AppendUint64(offsets, uint64(len(records[id])))
+		blob = append(blob, records[id]...)
+	}
+	return offsets, blob
+}
+
+// recordTable はレコードセクションの組への読み取り専用のアクセスです。
+type recordTable struct {
+	offsets []byte
+	blob    []byte
+}
+
+func newRecordTable(offsets, blob []byte) (recordTable, error) {
+	if len(offsets)%recordEntrySize != 0 {
+		return recordTable{}, fmt.Errorf("%w: record offsets have invalid length %d", ErrCorruptIndex, len(offsets))
+	}
+	return recordTable{offsets: offsets, blob: blob}, nil
+}
+
+func (t recordTable) len() int {
+	return len(t.offsets) / recordEntrySize
+}
+
+// entry はi番目のレコードのIDと中身を返します。
+func (t recordTable) entry(i int) (int, []byte, error) {
+	e := t.offsets[i*recordEntrySize:]
+	id := binary.LittleEndian.Uint64(e[0:8])
+	offset := binary.LittleEndian.Uint64(e[8:16])
+	length := binary.LittleEndian.Uint64(e[16:24])
+	if offset > uint64(len(t.blob)) || length > uint64(len(t.blob))-offset {
+		return 0, nil, fmt.Errorf("%w: record %d points outside its section", ErrCorruptIndex, id)
+	}
+	return int(id), t.blob[offset : offset+length], nil
+}
+
+// lookup はIDのレコードを二分探索で探します。
+func (t recordTable) lookup(id int) ([]byte, bool, error) {
+	n := t.len()
+	i := sort.Search(n, func(i int) bool {
+		return binary.LittleEndian.Uint64(t.offsets[i*recordEntrySize:]) >= uint64(id)
+	})
+	if i == n {
+		return nil, false, nil
+	}
+	gotID, record, err := t.entry(i)
+	if err != nil || gotID != id {
+		return nil, false, err
+	}
+	return record, true, nil
+}
@@ -1,58 +1,301 @@
 package store
 
 import (
+	"bytes"
 	"encoding/gob"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"gmi/indexer"
+	"gmi/tokenizer"
 	"gmi/ui"
+	"io"
 	"os"
+	"time"
 )
 
 // SaveIndex は転置インデックスを指定されたファイルパスに保存します。
+// 一時ファイルに書き込んでからリネームするため、途中で中断しても既存のファイルは壊れません。
+// 置き換え前のファイルは<filePath>.bakとして残ります。
+// ただし置き換え前のファイルが壊れている場合は、正常なはずの既存の.bakを上書きしません。
 func SaveIndex(idx *indexer.InvertedIndex, filePath string) error {
-	fmt.Printf("%s Implement SaveIndex to %s\n", ui.Dim("TODO:"), filePath)
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create index file %s: %w", filePath, err)
+	backup := true
+	if _, err := os.Stat(filePath); err == nil && !verifyIndexFile(filePath) {
+		fmt.Fprintf(os.Stderr, "%s %s is damaged; keeping the existing backup %s.\n", ui.Yellow("Warning:"), filePath, backupPath(filePath))
+		backup = false
 	}
-	defer file.Close()
-
-	encoder := gob.NewEncoder(file)
-	if err := encoder.Encode(idx); err != nil {
-		return fmt.Errorf("failed to encode index to file %s: %w", filePath, err)
+	err := writeFileAtomic(filePath, func(w io.Writer) error {
+		return encodeIndex(w, idx)
+	}, backup)
+	if err != nil {
+		return fmt.Errorf("failed to save index to file %s: %w", filePath, err)
 	}
-	fmt.Printf("%s Index saved to %s\n", ui.Green("✔"), filePath)
+	fmt.Fprintf(os.Stderr, "%s Index saved to %s\n", ui.Green("✔"), filePath)
 	return nil
 }
 
 // LoadIndex は指定されたファイルパスから転置インデックスを読み込みます。
+// 壊れたファイルにはErrCorruptIndexを、新しすぎるフォーマットにはErrUnsupportedVersionを返します。
+// ファイルが壊れていて.bakのバックアップが正常に読める場合は、バックアップを代わりに使います。
+// バージョン管理導入前のgob形式のファイルも読み込め、次回の保存時に現行フォーマットへ移行されます。
 func LoadIndex(filePath string) (*indexer.InvertedIndex, error) {
-	fmt.Printf("%s Implement LoadIndex from %s\n", ui.Dim("TODO:"), filePath)
-	file, err := os.Open(filePath)
+	idx, err := loadIndexFile(filePath)
+	loadedFrom := filePath
+	if os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%s Index file %s not found, creating new index.\n", ui.Yellow("ℹ"), filePath)
+		return indexer.NewInvertedIndex(), nil
+	}
+	if errors.Is(err, ErrCorruptIndex) {
+		bak := backupPath(filePath)
+		bakIdx, bakErr := loadIndexFile(bak)
+		if bakErr == nil {
+			fmt.Fprintf(os.Stderr, "%s %v\n", ui.Yellow("Warning:"), err)
+			fmt.Fprintf(os.Stderr, "%s Falling back to the backup %s.\n", ui.Yellow("Warning:"), bak)
+			idx, err, loadedFrom = bakIdx, nil, bak
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(os.Stderr, "%s Index loaded from %s. NextDocID: %d, Index size: %d tokens, Docs: %d\n",
+		ui.Cyan("ℹ"), loadedFrom, idx.NextDocID, len(idx.Index), len(idx.Docs))
+	return idx, nil
+}
+
+// loadIndexFile は1つのインデックスファイルを読み込んで検証します。
+func loadIndexFile(filePath string) (*indexer.InvertedIndex, error) {
+	data, err := os.ReadFile(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			fmt.Printf("%s Index file %s not found, creating new index.\n", ui.Yellow("ℹ"), filePath)
-			return indexer.NewInvertedIndex(), nil
+			return nil, err
 		}
 		return nil, fmt.Errorf("failed to open index file %s: %w", filePath, err)
 	}
-	defer file.Close()
 
-	decoder := gob.NewDecoder(file)
-	var idx indexer.InvertedIndex
-	if err := decoder.Decode(&idx); err != nil {
+	var idx *indexer.InvertedIndex
+	if hasMagic(data) {
+		idx, err = decodeIndex(data)
+	} else {
+		idx, err = decodeLegacyIndex(data)
+		if err == nil {
+			fmt.Fprintf(os.Stderr, "%s %s uses the legacy gob format; it will be migrated to format version %d on the next save.\n", ui.Yellow("ℹ"), filePath, FormatVersion)
+		}
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to decode index from file %s: %w", filePath, err)
 	}
-	fmt.Printf("%s Index loaded from %s. NextDocID: %d, Index size: %d tokens, Docs: %d\n",
-		ui.Cyan("ℹ"), filePath, idx.NextDocID, len(idx.Index), len(idx.Docs))
+	return idx, nil
+}
+
+// verifyIndexFile はインデックスファイルのチェックサムを検証し、読み込めるならtrueを返します。
+// チェックサムのない古いgob形式のファイルは、デコードできるかどうかで判定します。
+func verifyIndexFile(filePath string) bool {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return false
+	}
+	if !hasMagic(data) {
+		_, err = decodeLegacyIndex(data)
+		return err == nil
+	}
+	_, _, err = readSections(data)
+	return err == nil
+}
+
+// ReadHeader はインデックスファイルのヘッダだけを読み込みます。
+func ReadHeader(filePath string) (Header, error) {
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return Header{}, err
+	}
+	if !hasMagic(data) {
+		return Header{}, fmt.Errorf("%s is not in a versioned index format", filePath)
+	}
+	_, sections, err := readSections(data)
+	if err != nil {
+		return Header{}, err
+	}
+	return decodeHeader(sections)
+}
+
+func encodeIndex(w io.Writer, idx *indexer.InvertedIndex) error {
+	header := Header{
+		FormatVersion: FormatVersion,
+		Analyzer:      tokenizer.Analyzer,
+		CreatedAt:     time.Now(),
+		NextDocID:     idx.NextDocID,
+		DocCount:      len(idx.Docs),
+		TermCount:     len(idx.Index),
+		StoreContent:  idx.StoreContent,
+	}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+
+	docRecords := make(map[int][]byte, len(idx.Docs))
+	for id, doc := range idx.Docs {
+		record, err := json.Marshal(doc)
+		if err != nil {
+			return fmt.Errorf("failed to encode document %d: %w", id, err)
+		}
+		docRecords[id] = record
+	}
+	storedRecords := make(map[int][]byte, len(idx.Stored))
+	for id, content := range idx.Stored {
+		record, err := compressRecord(content)
+		if err != nil {
+			return fmt.Errorf("failed to compress stored content of document %d: %w", id, err)
+		}
+		storedRecords[id] = record
+	}
 
-	// gobでデコードした際、mapがnilになる場合があるので初期化しておく
+	dict, blob := encodeTermPostings(idx.Index)
+	docOffsets, docBlob := encodeRecords(docRecords)
+	storedOffsets, storedBlob := encodeRecords(storedRecords)
+	return writeSections(w, FormatVersion, []section{
+		{id: sectionHeader, payload: headerBytes},
+		{id: sectionTerms, payload: dict},
+		{id: sectionPostingBlocks, payload: blob},
+		{id: sectionDocOffsets, payload: docOffsets},
+		{id: sectionDocs, payload: docBlob},
+		{id: sectionStoredOffsets, payload: storedOffsets},
+		{id: sectionStored, payload: storedBlob},
+	})
+}
+
+func decodeHeader(sections map[sectionID][]byte) (Header, error) {
+	var header Header
+	payload, ok := sections[sectionHeader]
+	if !ok {
+		return header, fmt.Errorf("%w: missing header section", ErrCorruptIndex)
+	}
+	if err := json.Unmarshal(payload, &header); err != nil {
+		return header, fmt.Errorf("%w: invalid header section: %v", ErrCorruptIndex, err)
+	}
+	return header, nil
+}
+
+func decodeIndex(data []byte) (*indexer.InvertedIndex, error) {
+	version, sections, err := readSections(data)
+	if err != nil {
+		return nil, err
+	}
+	header, err := decodeHeader(sections)
+	if err != nil {
+		return nil, err
+	}
+	if header.Analyzer != tokenizer.Analyzer {
+		fmt.Fprintf(os.Stderr, "%s index was built with analyzer %q but this build uses %q; rebuild the index for accurate results.\n",
+			ui.Yellow("Warning:"), header.Analyzer, tokenizer.Analyzer)
+	}
+
+	idx := indexer.NewInvertedIndex()
+	idx.NextDocID = header.NextDocID
+	idx.StoreContent = header.StoreContent
+
+	if version < 2 {
+		if err := decodeGobSection(sections, sectionPostings, &idx.Index); err != nil {
+			return nil, err
+		}
+	} else {
+		dict, hasDict := sections[sectionTerms]
+		blob, hasBlob := sections[sectionPostingBlocks]
+		if !hasDict || !hasBlob {
+			return nil, fmt.Errorf("%w: missing postings sections", ErrCorruptIndex)
+		}
+		if idx.Index, err = decodeTermPostings(version, dict, blob); err != nil {
+			return nil, err
+		}
+	}
+
+	if version < 3 {
+		var docs []indexer.Document
+		if err := decodeGobSection(sections, sectionDocs, &docs); err != nil {
+			return nil, err
+		}
+		for _, doc := range docs {
+			idx.Docs[doc.ID] = doc
+		}
+		if err := decodeGobSection(sections, sectionStored, &idx.Stored); err != nil {
+			return nil, err
+		}
+		initMaps(idx)
+		return idx, nil
+	}
+
+	docs, err := recordSections(sections, sectionDocOffsets, sectionDocs)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < docs.len(); i++ {
+		id, record, err := docs.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		var doc indexer.Document
+		if err := json.Unmarshal(record, &doc); err != nil {
+			return nil, fmt.Errorf("%w: invalid document record %d: %v", ErrCorruptIndex, id, err)
+		}
+		idx.Docs[id] = doc
+	}
+	stored, err := recordSections(sections, sectionStoredOffsets, sectionStored)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < stored.len(); i++ {
+		id, record, err := stored.entry(i)
+		if err != nil {
+			return nil, err
+		}
+		if idx.Stored[id], err = decodeStoredRecord(version, id, record); err != nil {
+			return nil, err
+		}
+	}
+	return idx, nil
+}
+
+// decodeGobSection はバージョン3より前のgobで格納されたセクションをデコードします。
+func decodeGobSection(sections map[sectionID][]byte, id sectionID, target any) error {
+	payload, ok := sections[id]
+	if !ok {
+		return fmt.Errorf("%w: missing %s section", ErrCorruptIndex, id)
+	}
+	if err := gob.NewDecoder(bytes.NewReader(payload)).Decode(target); err != nil {
+		return fmt.Errorf("%w: invalid %s section: %v", ErrCorruptIndex, id, err)
+	}
+	return nil
+}
+
+// recordSections はオフセットと本体のセクションの組からrecordTableを作ります。
+func recordSections(sections map[sectionID][]byte, offsetsID, blobID sectionID) (recordTable, error) {
+	offsets, hasOffsets := sections[offsetsID]
+	blob, hasBlob := sections[blobID]
+	if !hasOffsets || !hasBlob {
+		return recordTable{}, fmt.Errorf("%w: missing %s section", ErrCorruptIndex, blobID)
+	}
+	return newRecordTable(offsets, blob)
+}
+
+// decodeLegacyIndex はバージョン管理導入前の、InvertedIndexをそのままgobにしたファイルを読み込みます。
+func decodeLegacyIndex(data []byte) (*indexer.InvertedIndex, error) {
+	var idx indexer.InvertedIndex
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&idx); err != nil {
+		return nil, fmt.Errorf("%w: not a gmi index file (%v)", ErrCorruptIndex, err)
+	}
+	initMaps(&idx)
+	return &idx, nil
+}
+
+// initMaps はgobでデコードした際にnilになりうるmapを初期化します。
+func initMaps(idx *indexer.InvertedIndex) {
 	if idx.Index == nil {
 		idx.Index = make(map[string][]indexer.Posting)
 	}
 	if idx.Docs == nil {
 		idx.Docs = make(map[int]indexer.Document)
 	}
-
-	return &idx, nil
+	if idx.Stored == nil {
+		idx.Stored = make(map[int]string)
+	}
 }
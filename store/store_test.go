@@ -0,0 +1,179 @@
+package store
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"gmi/indexer"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func newTestIndex(t *testing.T) *indexer.InvertedIndex {
+	t.Helper()
+	idx := indexer.NewInvertedIndex()
+	if _, err := idx.AddDocument(indexer.Document{Path: "a.txt", Source: indexer.SourceFile}, "go index go"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idx.AddDocument(indexer.Document{Path: "note-1", Source: indexer.SourceStdin}, "stored note about go"); err != nil {
+		t.Fatal(err)
+	}
+	return idx
+}
+
+func TestSaveLoadRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	idx := newTestIndex(t)
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatalf("SaveIndex() error = %v", err)
+	}
+	loaded, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if loaded.NextDocID != idx.NextDocID || len(loaded.Docs) != len(idx.Docs) || len(loaded.Index) != len(idx.Index) {
+		t.Errorf("loaded index = %d docs, %d terms, next %d; want %d, %d, %d",
+			len(loaded.Docs), len(loaded.Index), loaded.NextDocID, len(idx.Docs), len(idx.Index), idx.NextDocID)
+	}
+	if got := loaded.Index["go"]; len(got) != 2 || got[0].Frequency != 2 {
+		t.Errorf("postings for 'go' = %+v", got)
+	}
+	if doc, ok := loaded.FindDocument("note-1"); !ok || loaded.Stored[doc.ID] != "stored note about go" {
+		t.Errorf("stored content was not preserved")
+	}
+
+	header, err := ReadHeader(path)
+	if err != nil || header.FormatVersion != FormatVersion || header.DocCount != 2 {
+		t.Errorf("ReadHeader() = %+v, %v", header, err)
+	}
+}
+
+func TestLoadIndexDetectsCorruption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	if err := SaveIndex(newTestIndex(t), path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[len(data)-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIndex(path); !errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("LoadIndex() error = %v, want ErrCorruptIndex", err)
+	}
+}
+
+func TestLoadIndexRejectsNewerVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	if err := SaveIndex(newTestIndex(t), path); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	binary.LittleEndian.PutUint16(data[8:10], FormatVersion+1)
+
+	// バージョンだけが変わっていればビット化けとして扱う
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIndex(path); !errors.Is(err, ErrCorruptIndex) || errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("LoadIndex() with a flipped version error = %v, want ErrCorruptIndex", err)
+	}
+
+	binary.LittleEndian.PutUint32(data[preambleSize:], crc32.Checksum(data[:preambleSize], crcTable))
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadIndex(path); !errors.Is(err, ErrUnsupportedVersion) {
+		t.Errorf("LoadIndex() error = %v, want ErrUnsupportedVersion", err)
+	}
+}
+
+func TestReadSectionTableWithoutPreambleCRC(t *testing.T) {
+	payload := []byte("payload")
+	var buf bytes.Buffer
+	if err := writeSections(&buf, preambleCRCVersion-1, []section{{id: sectionHeader, payload: payload}}); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	version, sections, err := readSections(data)
+	if err != nil || version != preambleCRCVersion-1 || !bytes.Equal(sections[sectionHeader], payload) {
+		t.Fatalf("readSections() = %d, %q, %v", version, sections, err)
+	}
+
+	binary.LittleEndian.PutUint16(data[8:10], FormatVersion+1)
+	if _, _, err := readSections(data); !errors.Is(err, ErrCorruptIndex) {
+		t.Errorf("readSections() with a flipped version error = %v, want ErrCorruptIndex", err)
+	}
+}
+
+func TestLoadIndexMigratesLegacyGob(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "legacy.idx")
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(newTestIndex(t)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v", err)
+	}
+	if len(idx.Docs) != 2 {
+		t.Errorf("len(Docs) = %d, want 2", len(idx.Docs))
+	}
+}
+
+func TestSaveIndexKeepsBackupAndLoadFallsBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.idx")
+	first := newTestIndex(t)
+	if err := SaveIndex(first, path); err != nil {
+		t.Fatal(err)
+	}
+	second := newTestIndex(t)
+	if _, err := second.AddDocument(indexer.Document{Path: "note-2", Source: indexer.SourceStdin}, "another"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveIndex(second, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path + ".bak"); err != nil {
+		t.Fatalf("backup not written: %v", err)
+	}
+	matches, _ := filepath.Glob(path + ".tmp-*")
+	if len(matches) != 0 {
+		t.Errorf("temporary files left behind: %v", matches)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data[:len(data)/2], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	idx, err := LoadIndex(path)
+	if err != nil {
+		t.Fatalf("LoadIndex() error = %v, want fallback to backup", err)
+	}
+	if len(idx.Docs) != len(first.Docs) {
+		t.Errorf("len(Docs) = %d, want %d from the backup", len(idx.Docs), len(first.Docs))
+	}
+
+	// 壊れたファイルを置き換えるときは、正常な.bakを壊れたファイルで上書きしない
+	if err := SaveIndex(idx, path); err != nil {
+		t.Fatal(err)
+	}
+	if !verifyIndexFile(path + ".bak") {
+		t.Error("SaveIndex() replaced the good backup with the damaged index")
+	}
+}
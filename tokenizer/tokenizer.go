@@ -6,6 +6,11 @@ import (
 	"strings"
 )
 
+// Analyzer はトークナイズ方法を表す名前です。インデックスファイルに記録され、
+// 異なる方法で作られたインデックスを検出するのに使われます。
+// トークナイズの仕様を変えた場合はこの値も変更してください。
+const Analyzer = "regexp:[a-zA-Z0-9]+;lowercase"
+
 var (
 	// 正規表現で単語として認識するパターン (英数字の連続)
 	// より高度にするならUnicodeの文字クラスなどを考慮
@@ -15,12 +20,17 @@ var (
 // Tokenize は与えられたテキストを単語のリストに分割し、正規化します。
 // 正規化処理として、小文字化を行います。
 func Tokenize(text string) []string {
-	words := wordRegex.FindAllString(text, -1)
-	var tokens []string
-	for _, word := range words {
-		if word != "" {
-			tokens = append(tokens, strings.ToLower(word))
+	tokens, _ := TokenizeWithOffsets(text)
+	return tokens
+}
+
+// TokenizeWithOffsets はTokenizeと同じ単語のリストと、各単語がtextの中で始まるバイトオフセットを返します。
+func TokenizeWithOffsets(text string) (tokens []string, offsets []int) {
+	for _, loc := range wordRegex.FindAllStringIndex(text, -1) {
+		if loc[1] > loc[0] {
+			tokens = append(tokens, strings.ToLower(text[loc[0]:loc[1]]))
+			offsets = append(offsets, loc[0])
 		}
 	}
-	return tokens
+	return tokens, offsets
 }
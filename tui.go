@@ -0,0 +1,534 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"gmi/indexer"
+	"gmi/searcher"
+	"gmi/tokenizer"
+	"gmi/ui"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+	"golang.org/x/text/width"
+)
+
+// 端末制御に使うエスケープシーケンス
+const (
+	escAltScreenOn  = "\x1b[?1049h"
+	escAltScreenOff = "\x1b[?1049l"
+	escHideCursor   = "\x1b[?25l"
+	escShowCursor   = "\x1b[?25h"
+	escHome         = "\x1b[H"
+	escClearLine    = "\x1b[K"
+	escClearBelow   = "\x1b[J"
+)
+
+// tuiMaxResults はTUIに一覧表示する検索結果の最大数です。キー入力ごとに検索するので、上位だけを作ります。
+const tuiMaxResults = 200
+
+// tuiKey はTUIが扱うキー入力です。文字の入力はtuiKeyRuneとrに入ります。
+type tuiKey int
+
+const (
+	tuiKeyNone tuiKey = iota // 無視する入力
+	tuiKeyRune
+	tuiKeyEnter
+	tuiKeyBackspace
+	tuiKeyDeleteWord
+	tuiKeyClear
+	tuiKeyUp
+	tuiKeyDown
+	tuiKeyPageUp
+	tuiKeyPageDown
+	tuiKeyTab
+	tuiKeyQuit
+)
+
+// tui は入力のたびに検索し直すフルスクリーンの検索画面です。
+// 画面は上からクエリ入力行、状態行、検索結果の一覧、選択中の結果のプレビューの順に並びます。
+type tui struct {
+	idx        indexer.Reader
+	fd         int
+	cooked     *term.State // TUIを始める前の端末の状態
+	out        *bufio.Writer
+	query      []rune
+	mode       string
+	terms      []string       // 補完後のクエリの単語 (ハイライトに使う)
+	matcher    *regexp.Regexp // termsのいずれかに一致する正規表現
+	complete   string         // 最後の単語を補完した場合の補完結果
+	results    []searcher.SearchResult
+	total      int  // ページ分割前の一致件数
+	totalExact bool // falseならtotalは下限 (WANDで読み飛ばした)
+	selected   int
+	top        int    // 一覧の先頭に表示している結果の番号
+	message    string // 状態行に一度だけ表示するメッセージ
+	err        error  // 現在のクエリで検索できなかった理由 (状態行に表示する)
+
+	previewID      int // previewContentを読み込んだドキュメントのID (-1なら未読み込み)
+	previewContent string
+	previewErr     error
+}
+
+// runTUI はidxを検索するTUIを起動し、終了するまで戻りません。
+func runTUI(idx indexer.Reader) error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) || !term.IsTerminal(int(os.Stdout.Fd())) {
+		return errors.New("gmi tui needs an interactive terminal; use 'gmi search' or 'gmi shell' for scripts")
+	}
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set terminal mode: %w", err)
+	}
+	defer term.Restore(fd, state)
+
+	t := &tui{idx: idx, fd: fd, cooked: state, out: bufio.NewWriter(os.Stdout), mode: "and", previewID: -1}
+	t.out.WriteString(escAltScreenOn)
+	defer func() {
+		t.out.WriteString(escShowCursor + escAltScreenOff)
+		t.out.Flush()
+	}()
+
+	// 入力は要求されたときだけ読む。エディタを開いている間にキー入力を横取りしないため
+	want := make(chan struct{})
+	input := make(chan []byte)
+	go func() {
+		buf := make([]byte, 1024)
+		for range want {
+			n, err := os.Stdin.Read(buf)
+			if err != nil {
+				close(input)
+				return
+			}
+			input <- append([]byte(nil), buf[:n]...)
+		}
+	}()
+	resize := make(chan os.Signal, 1)
+	notifyResize(resize)
+
+	t.render()
+	want <- struct{}{}
+	for {
+		select {
+		case data, ok := <-input:
+			if !ok {
+				return nil
+			}
+			if quit := t.handleInput(data); quit {
+				return nil
+			}
+			t.render()
+			want <- struct{}{}
+		case <-resize:
+			t.render()
+		}
+	}
+}
+
+// handleInput は1回の読み込みで届いたキー入力をまとめて処理し、終了する場合にtrueを返します。
+// 検索は全てのキーを処理した後に一度だけ行います。
+func (t *tui) handleInput(data []byte) (quit bool) {
+	changed := false
+	for len(data) > 0 {
+		key, r, n := parseTUIKey(data)
+		data = data[n:]
+		switch key {
+		case tuiKeyQuit:
+			return true
+		case tuiKeyRune:
+			t.query = append(t.query, r)
+			changed = true
+		case tuiKeyBackspace:
+			if len(t.query) > 0 {
+				t.query = t.query[:len(t.query)-1]
+				changed = true
+			}
+		case tuiKeyDeleteWord:
+			q := strings.TrimRight(string(t.query), " ")
+			t.query = []rune(q[:strings.LastIndex(q, " ")+1])
+			changed = true
+		case tuiKeyClear:
+			t.query = nil
+			changed = true
+		case tuiKeyTab:
+			if t.mode == "and" {
+				t.mode = "or"
+			} else {
+				t.mode = "and"
+			}
+			changed = true
+		case tuiKeyUp:
+			t.move(-1)
+		case tuiKeyDown:
+			t.move(1)
+		case tuiKeyPageUp:
+			t.move(-t.listHeight())
+		case tuiKeyPageDown:
+			t.move(t.listHeight())
+		case tuiKeyEnter:
+			if changed {
+				t.search()
+				changed = false
+			}
+			t.openSelected()
+			// エディタから戻った後の残りの入力は捨てる
+			return false
+		}
+	}
+	if changed {
+		t.search()
+	}
+	return false
+}
+
+// parseTUIKey はdataの先頭のキーを解釈し、消費したバイト数と共に返します。
+func parseTUIKey(data []byte) (key tuiKey, r rune, n int) {
+	switch b := data[0]; {
+	case b == 0x1b:
+		if len(data) == 1 {
+			return tuiKeyQuit, 0, 1 // Esc単独
+		}
+		if data[1] != '[' && data[1] != 'O' {
+			return tuiKeyNone, 0, 1 // Alt+キーなどは無視する (後続のキーはそのまま入力)
+		}
+		// CSI/SS3シーケンスは終端文字 (0x40-0x7E) まで読み飛ばす
+		end := 2
+		for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+			end++
+		}
+		if end == len(data) {
+			return tuiKeyNone, 0, len(data)
+		}
+		switch string(data[1 : end+1]) {
+		case "[A", "OA":
+			return tuiKeyUp, 0, end + 1
+		case "[B", "OB":
+			return tuiKeyDown, 0, end + 1
+		case "[5~":
+			return tuiKeyPageUp, 0, end + 1
+		case "[6~":
+			return tuiKeyPageDown, 0, end + 1
+		}
+		return tuiKeyNone, 0, end + 1
+	case b == 3: // Ctrl+C
+		return tuiKeyQuit, 0, 1
+	case b == '\r' || b == '\n':
+		return tuiKeyEnter, 0, 1
+	case b == 127 || b == 8:
+		return tuiKeyBackspace, 0, 1
+	case b == 23: // Ctrl+W
+		return tuiKeyDeleteWord, 0, 1
+	case b == 21: // Ctrl+U
+		return tuiKeyClear, 0, 1
+	case b == 16: // Ctrl+P
+		return tuiKeyUp, 0, 1
+	case b == 14: // Ctrl+N
+		return tuiKeyDown, 0, 1
+	case b == '\t':
+		return tuiKeyTab, 0, 1
+	case b < 0x20:
+		return tuiKeyNone, 0, 1
+	}
+	r, size := utf8.DecodeRune(data)
+	if r == utf8.RuneError {
+		return tuiKeyNone, 0, size
+	}
+	return tuiKeyRune, r, size
+}
+
+// search は現在のクエリで検索し直します。
+func (t *tui) search() {
+	t.results, t.total, t.selected, t.top = nil, 0, 0, 0
+	query, completed := completeQuery(t.idx, string(t.query))
+	t.complete = completed
+	text, _, err := searcher.ParseFilters(query)
+	t.err = err
+	t.terms = tokenizer.Tokenize(text)
+	t.matcher = nil
+	if len(t.terms) == 0 {
+		return
+	}
+	quoted := make([]string, len(t.terms))
+	for i, term := range t.terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	t.matcher = regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+	// 進捗メッセージは画面を崩すので書き出させず、エラーは状態行に表示する
+	page := searcher.SearchPage(t.idx, query, t.mode, searcher.SearchOptions{Limit: tuiMaxResults})
+	t.results, t.total, t.totalExact, t.err = page.Results, page.Total, page.TotalExact, page.Err
+}
+
+// completeQuery は入力途中の最後の単語を、その単語で始まる最も多くのドキュメントに含まれる単語に補完します。
+// クエリが単語で終わっていない場合や、最後の単語がそのままインデックスにある場合は補完しません。
+// 補完するのは末尾の単語だけで、それより前の入力 (path:などの条件を含む) はそのまま残します。
+func completeQuery(idx indexer.Reader, query string) (completedQuery, completion string) {
+	tokens, offsets := tokenizer.TokenizeWithOffsets(query)
+	if len(tokens) == 0 || offsets[len(offsets)-1]+len(tokens[len(tokens)-1]) != len(query) {
+		return query, ""
+	}
+	fields := strings.Fields(query)
+	if text, _, _ := searcher.ParseFilters(fields[len(fields)-1]); text == "" {
+		return query, "" // 入力途中の最後の語はpath:などの条件
+	}
+	last := tokens[len(tokens)-1]
+	if postings, err := idx.Postings(last); err != nil || len(postings) > 0 {
+		return query, ""
+	}
+	terms, err := idx.Terms(last)
+	if err != nil || len(terms) == 0 {
+		return query, ""
+	}
+	best := terms[0]
+	for _, ts := range terms[1:] {
+		if ts.DocFreq > best.DocFreq {
+			best = ts
+		}
+	}
+	return query[:offsets[len(offsets)-1]] + best.Term, best.Term
+}
+
+func (t *tui) move(delta int) {
+	if len(t.results) == 0 {
+		return
+	}
+	t.selected = min(max(t.selected+delta, 0), len(t.results)-1)
+}
+
+func (t *tui) size() (w, h int) {
+	w, h, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || w <= 0 || h <= 0 {
+		return 80, 24
+	}
+	return w, h
+}
+
+// listHeight は検索結果の一覧に使う行数です。残りの行はプレビューに使います。
+func (t *tui) listHeight() int {
+	_, h := t.size()
+	return max((h-3)/3, 1)
+}
+
+// render は画面全体を描き直します。
+func (t *tui) render() {
+	w, h := t.size()
+	listH := t.listHeight()
+	previewH := max(h-3-listH, 0)
+	var rows []string
+
+	rows = append(rows, ui.Cyan("> ")+string(t.query))
+
+	var status string
+	switch {
+	case t.message != "":
+		status = ui.Yellow(t.message)
+		t.message = ""
+	case t.err != nil:
+		status = ui.Red("Error: " + t.err.Error())
+	case len(t.terms) == 0:
+		status = ui.Dim(fmt.Sprintf("%d document(s) · mode: %s · type to search, ↑/↓ select, Enter open in $EDITOR, Tab and/or, Esc quit", t.idx.NumDocs(), t.mode))
+	default:
+		total := strconv.Itoa(t.total)
+		if !t.totalExact {
+			total = "≥" + total
+		}
+		status = fmt.Sprintf("%s/%d · mode: %s", total, t.idx.NumDocs(), t.mode)
+		if len(t.results) < t.total {
+			status += fmt.Sprintf(" · showing top %d", len(t.results))
+		}
+		if t.complete != "" {
+			status += " · completed to '" + t.complete + "'"
+		}
+		status = ui.Dim(status)
+	}
+	rows = append(rows, status)
+
+	// 選択中の結果が見えるように一覧をスクロールする
+	if t.selected < t.top {
+		t.top = t.selected
+	}
+	if t.selected >= t.top+listH {
+		t.top = t.selected - listH + 1
+	}
+	for i := t.top; i < t.top+listH; i++ {
+		if i >= len(t.results) {
+			rows = append(rows, "")
+			continue
+		}
+		res := t.results[i]
+		label := res.Document.Path
+		if !res.Document.IsFile() {
+			label += " [" + res.Document.Source + "]"
+		}
+		line := fitWidth(fmt.Sprintf("%3d. %s", i+1, label), w-12)
+		score := ui.Dim(fmt.Sprintf("%.4f", res.Score))
+		if i == t.selected {
+			rows = append(rows, ui.Cyan("▶ ")+ui.Bold(line)+"  "+score)
+		} else {
+			rows = append(rows, "  "+line+"  "+score)
+		}
+	}
+
+	rows = append(rows, t.previewRows(w, previewH)...)
+
+	t.out.WriteString(escHideCursor + escHome)
+	for i, row := range rows {
+		if i >= h {
+			break
+		}
+		if i > 0 {
+			t.out.WriteString("\r\n")
+		}
+		t.out.WriteString(row + escClearLine)
+	}
+	t.out.WriteString(escClearBelow)
+	// カーソルをクエリの末尾に置く
+	fmt.Fprintf(t.out, "\x1b[1;%dH", min(2+displayWidth(string(t.query))+1, w))
+	t.out.WriteString(escShowCursor)
+	t.out.Flush()
+}
+
+// previewRows は選択中の結果の本文を、最初に一致した行の周辺だけ行番号付きで返します。
+// 先頭の1行は区切り線で、ファイルのパスと一致した行番号を表示します。
+func (t *tui) previewRows(w, h int) []string {
+	if h == 0 {
+		return nil
+	}
+	rows := make([]string, 0, h)
+	if len(t.results) == 0 {
+		return append(rows, ui.Dim(strings.Repeat("─", w)))
+	}
+	res := t.results[t.selected]
+	content, err := t.content(res.Document)
+	if err != nil {
+		rows = append(rows, ui.Dim(fitWidth("── "+res.Document.Path+" ", w)))
+		return append(rows, ui.Red(fitWidth(err.Error(), w)))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	matchLine := t.matchLine(content)
+	header := fmt.Sprintf("── %s:%d ", res.Document.Path, matchLine+1)
+	header += strings.Repeat("─", max(w-displayWidth(header), 0))
+	rows = append(rows, ui.Dim(fitWidth(header, w)))
+
+	start := max(matchLine-(h-1)/3, 0)
+	for i := start; i < len(lines) && len(rows) < h; i++ {
+		gutter := fmt.Sprintf("%5d │ ", i+1)
+		rows = append(rows, ui.Dim(gutter)+t.highlight(fitWidth(printable(lines[i]), w-displayWidth(gutter))))
+	}
+	return rows
+}
+
+// content はドキュメントの本文を返します。同じドキュメントを続けて表示する場合は読み直しません。
+func (t *tui) content(doc indexer.Document) (string, error) {
+	if t.previewID != doc.ID {
+		t.previewID = doc.ID
+		t.previewContent, t.previewErr = t.idx.Content(doc)
+	}
+	return t.previewContent, t.previewErr
+}
+
+// matchLine はクエリの単語が最初に現れる行の番号 (0始まり) を返します。
+func (t *tui) matchLine(content string) int {
+	if t.matcher == nil {
+		return 0
+	}
+	loc := t.matcher.FindStringIndex(content)
+	if loc == nil {
+		return 0
+	}
+	return strings.Count(content[:loc[0]], "\n")
+}
+
+// highlight は行の中でクエリの単語に一致した箇所を強調します。
+func (t *tui) highlight(line string) string {
+	if t.matcher == nil {
+		return line
+	}
+	return t.matcher.ReplaceAllStringFunc(line, func(m string) string { return ui.Bold(ui.Yellow(m)) })
+}
+
+// openSelected は選択中のファイルを$VISUALか$EDITOR (未設定ならvi) で、一致した行を指定して開きます。
+func (t *tui) openSelected() {
+	if len(t.results) == 0 {
+		return
+	}
+	res := t.results[t.selected]
+	if !res.Document.IsFile() {
+		t.message = fmt.Sprintf("%s is a %s document, not a file", res.Document.Path, res.Document.Source)
+		return
+	}
+	editor := os.Getenv("VISUAL")
+	if editor == "" {
+		editor = os.Getenv("EDITOR")
+	}
+	if editor == "" {
+		editor = "vi"
+	}
+	line := 1
+	if content, err := t.content(res.Document); err == nil {
+		line = t.matchLine(content) + 1
+	}
+	args := strings.Fields(editor)
+	cmd := exec.Command(args[0], append(args[1:], fmt.Sprintf("+%d", line), res.Document.Path)...)
+	cmd.Stdin, cmd.Stdout = os.Stdin, os.Stdout
+
+	// エディタの間は通常の画面と端末モードに戻す
+	t.out.WriteString(escShowCursor + escAltScreenOff)
+	t.out.Flush()
+	term.Restore(t.fd, t.cooked)
+	err := cmd.Run()
+	term.MakeRaw(t.fd)
+	t.out.WriteString(escAltScreenOn)
+	if err != nil {
+		t.message = fmt.Sprintf("%s: %v", editor, err)
+	}
+}
+
+// printable はタブを空白に展開し、画面を崩す制御文字を空白に置き換えます。
+func printable(line string) string {
+	line = strings.ReplaceAll(strings.TrimRight(line, "\r"), "\t", "    ")
+	return strings.Map(func(r rune) rune {
+		if r < 0x20 || r == 0x7f {
+			return ' '
+		}
+		return r
+	}, line)
+}
+
+// fitWidth は表示幅がwを超えないようにsを切り詰めます。全角文字は幅2として数えます。
+func fitWidth(s string, w int) string {
+	used := 0
+	for i, r := range s {
+		rw := runeWidth(r)
+		if used+rw > w {
+			return s[:i]
+		}
+		used += rw
+	}
+	return s
+}
+
+func displayWidth(s string) int {
+	n := 0
+	for _, r := range s {
+		n += runeWidth(r)
+	}
+	return n
+}
+
+func runeWidth(r rune) int {
+	if r < 0x20 {
+		return 0
+	}
+	switch width.LookupRune(r).Kind() {
+	case width.EastAsianWide, width.EastAsianFullwidth:
+		return 2
+	}
+	return 1
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// notifyResize はSIGWINCHの無いプラットフォームでは何もしません。画面は次のキー入力で描き直されます。
+func notifyResize(ch chan<- os.Signal) {}
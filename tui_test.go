@@ -0,0 +1,112 @@
+package main
+
+import (
+	"gmi/indexer"
+	"testing"
+)
+
+func TestParseTUIKey(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		key  tuiKey
+		r    rune
+		n    int
+	}{
+		{"esc alone", "\x1b", tuiKeyQuit, 0, 1},
+		{"alt key", "\x1bx", tuiKeyNone, 0, 1},
+		{"up", "\x1b[A", tuiKeyUp, 0, 3},
+		{"down ss3", "\x1bOB", tuiKeyDown, 0, 3},
+		{"page up", "\x1b[5~", tuiKeyPageUp, 0, 4},
+		{"page down then rune", "\x1b[6~a", tuiKeyPageDown, 0, 4},
+		{"unknown csi", "\x1b[1;5C", tuiKeyNone, 0, 6},
+		{"incomplete csi", "\x1b[1;", tuiKeyNone, 0, 4},
+		{"ctrl+c", "\x03", tuiKeyQuit, 0, 1},
+		{"enter", "\r", tuiKeyEnter, 0, 1},
+		{"backspace", "\x7f", tuiKeyBackspace, 0, 1},
+		{"ctrl+w", "\x17", tuiKeyDeleteWord, 0, 1},
+		{"ctrl+u", "\x15", tuiKeyClear, 0, 1},
+		{"tab", "\t", tuiKeyTab, 0, 1},
+		{"other control", "\x01", tuiKeyNone, 0, 1},
+		{"ascii", "ab", tuiKeyRune, 'a', 1},
+		{"utf-8", "検索", tuiKeyRune, '検', 3},
+		{"invalid utf-8", "\xff", tuiKeyNone, 0, 1},
+	}
+	for _, tt := range tests {
+		key, r, n := parseTUIKey([]byte(tt.data))
+		if key != tt.key || r != tt.r || n != tt.n {
+			t.Errorf("%s: parseTUIKey(%q) = %v, %q, %d; want %v, %q, %d", tt.name, tt.data, key, r, n, tt.key, tt.r, tt.n)
+		}
+	}
+}
+
+func TestCompleteQuery(t *testing.T) {
+	idx := indexer.NewInvertedIndex()
+	for i, text := range []string{"alpha beta", "alpha gamma", "alphabet"} {
+		if _, err := idx.AddDocument(indexer.Document{Path: string(rune('a'+i)) + ".md", Source: indexer.SourceStdin}, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		query, want, completion string
+	}{
+		{"alp", "alpha", "alpha"},
+		{"beta ALP", "beta alpha", "alpha"},
+		{"ext:md alp", "ext:md alpha", "alpha"},
+		{"path:docs/**  foo-alp", "path:docs/**  foo-alpha", "alpha"},
+		{"alpha", "alpha", ""}, // そのままインデックスにある
+		{"alp ", "alp ", ""},   // 空白で終わる
+		{"alp.", "alp.", ""},   // 単語で終わっていない
+		{"ext:m", "ext:m", ""}, // 入力途中の条件
+		{"zzz", "zzz", ""},     // その単語で始まる単語がない
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		got, completion := completeQuery(idx, tt.query)
+		if got != tt.want || completion != tt.completion {
+			t.Errorf("completeQuery(%q) = %q, %q; want %q, %q", tt.query, got, completion, tt.want, tt.completion)
+		}
+	}
+}
+
+func TestFitWidth(t *testing.T) {
+	tests := []struct {
+		s     string
+		w     int
+		want  string
+		width int
+	}{
+		{"hello", 10, "hello", 5},
+		{"hello", 3, "hel", 5},
+		{"日本語", 4, "日本", 6},
+		{"日本語", 5, "日本", 6}, // 全角文字を半分だけ表示しない
+		{"aｱ日", 3, "aｱ", 4}, // 半角カナは幅1
+		{"", 3, "", 0},
+	}
+	for _, tt := range tests {
+		if got := fitWidth(tt.s, tt.w); got != tt.want {
+			t.Errorf("fitWidth(%q, %d) = %q, want %q", tt.s, tt.w, got, tt.want)
+		}
+		if got := displayWidth(tt.s); got != tt.width {
+			t.Errorf("displayWidth(%q) = %d, want %d", tt.s, got, tt.width)
+		}
+	}
+}
+
+func TestPrintable(t *testing.T) {
+	tests := []struct {
+		line, want string
+	}{
+		{"plain text", "plain text"},
+		{"a\tb", "a    b"},
+		{"crlf\r", "crlf"},
+		{"esc\x1b[31mred", "esc [31mred"},
+		{"bell\x07del\x7f", "bell del "},
+		{"日本語", "日本語"},
+	}
+	for _, tt := range tests {
+		if got := printable(tt.line); got != tt.want {
+			t.Errorf("printable(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}